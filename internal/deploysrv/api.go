@@ -0,0 +1,193 @@
+package deploysrv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+)
+
+const api = "api"
+
+// rollbackSource is the trigger source of the rollbacks to the earlier
+// deployments, requested via API.
+const rollbackSource = "rollback"
+
+// deploymentInfo is the API representation of the deployment.
+type deploymentInfo struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Disabled bool   `json:"disabled"`
+	Source   string `json:"source,omitempty"`
+}
+
+// initAPIHandlers initialises the API handlers.  API is enabled only if the
+// client certificate CA is configured, as all API endpoints require a
+// verified client certificate.
+func (s *Server) initAPIHandlers(mux *http.ServeMux) {
+	if s.clientCA == "" {
+		dlog.Debugln("client_ca is not configured, API is disabled")
+		return
+	}
+	handle := func(method string, elems []string, h http.HandlerFunc) {
+		p := path.Join(append([]string{"/", s.prefix, api}, elems...)...)
+		mux.Handle(method+" "+p, requireClientCert(h))
+	}
+	handle(http.MethodGet, []string{"deployments"}, s.apiListDeployments)
+	handle(http.MethodPost, []string{"deployments", "{name}", "trigger"}, s.apiTrigger)
+	handle(http.MethodGet, []string{"deployments", "{name}", "history"}, s.apiHistory)
+	handle(http.MethodPost, []string{"deployments", "{name}", "rollback"}, s.apiRollback)
+	handle(http.MethodGet, []string{"schedule"}, s.apiSchedule)
+	handle(http.MethodGet, []string{"jobs", "{id}"}, s.apiJob)
+}
+
+// requireClientCert is the route policy middleware that rejects requests
+// without a verified client certificate.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientSubject(r) == "" {
+			audit(r, "denied: no verified client certificate")
+			time.Sleep(stall)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientSubject returns the subject of the verified client certificate, or
+// an empty string.
+func clientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+// deployment returns the deployment by name.
+func (s *Server) deployment(name string) (Deployment, bool) {
+	for _, d := range s.deployments {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Deployment{}, false
+}
+
+func (s *Server) apiListDeployments(w http.ResponseWriter, r *http.Request) {
+	list := make([]deploymentInfo, 0, len(s.deployments))
+	for _, d := range s.deployments {
+		list = append(list, deploymentInfo{Name: d.Name, Type: d.Type, Disabled: d.Disabled, Source: d.Source})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) apiTrigger(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	d, ok := s.deployment(name)
+	if !ok {
+		http.Error(w, "no such deployment", http.StatusNotFound)
+		return
+	}
+	if d.Disabled {
+		http.Error(w, "deployment is disabled", http.StatusConflict)
+		return
+	}
+	select {
+	case s.jobs <- Job{Dep: d, Trigger: Trigger{Source: api}}:
+	default:
+		audit(r, "trigger %q: job queue is full", d.Name)
+		http.Error(w, "job queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	audit(r, "trigger %q", d.Name)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+// apiHistory lists the successful deployments, the most recent first.
+func (s *Server) apiHistory(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.deployment(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "no such deployment", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.deployed.list(d.Name))
+}
+
+// apiRollback re-runs the deployment with the trigger variables of the
+// earlier successful deployment, that has the job id from the "to" query
+// parameter.
+func (s *Server) apiRollback(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.deployment(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "no such deployment", http.StatusNotFound)
+		return
+	}
+	if d.Disabled {
+		http.Error(w, "deployment is disabled", http.StatusConflict)
+		return
+	}
+	to, err := uuid.Parse(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+	dv, ok := s.deployed.find(d.Name, to)
+	if !ok {
+		http.Error(w, "no such deployment in history", http.StatusNotFound)
+		return
+	}
+	select {
+	case s.jobs <- Job{Dep: d, Trigger: Trigger{Source: rollbackSource, Vars: dv.Vars}}:
+	default:
+		audit(r, "rollback %q to %s: job queue is full", d.Name, to)
+		http.Error(w, "job queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	audit(r, "rollback %q to %s", d.Name, to)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+// apiSchedule lists the scheduled deployments with the next run times.
+func (s *Server) apiSchedule(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.sched.list())
+}
+
+// apiJob returns the job metadata, including the callback delivery attempts.
+func (s *Server) apiJob(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+	if s.resultsDir == "" {
+		http.Error(w, "results are not stored", http.StatusNotFound)
+		return
+	}
+	s.metaMu.Lock()
+	m, err := s.loadMeta(id)
+	s.metaMu.Unlock()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			dlog.Printf("%s> job metadata: %s", id, err)
+		}
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// writeJSON writes v as the JSON response with the status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		dlog.Println(err)
+	}
+}
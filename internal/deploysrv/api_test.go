@@ -0,0 +1,143 @@
+package deploysrv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rusq/dlog"
+)
+
+// newMTLSServer starts the TLS test server with the API handlers, that
+// verifies client certificates issued by ca.
+func newMTLSServer(t *testing.T, s *Server, ca *testCert) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	srvCert := genSignedCert(t, dir, "hubdeploy.test", ca)
+	s.cert, s.privkey, s.clientCA = srvCert.certFile, srvCert.keyFile, ca.certFile
+
+	cfg, _, err := s.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig() error = %v", err)
+	}
+	mux := http.NewServeMux()
+	s.initAPIHandlers(mux)
+	ts := httptest.NewUnstartedServer(logMiddleware(mux))
+	ts.TLS = cfg
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// newTestClient returns the client that trusts the test server and presents
+// the client certificate, if it's not nil.
+func newTestClient(t *testing.T, ts *httptest.Server, client *testCert) *http.Client {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	cfg := &tls.Config{RootCAs: roots}
+	if client != nil {
+		pair, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
+
+func TestServer_API_clientCert(t *testing.T) {
+	var buf bytes.Buffer
+	dlog.SetOutput(&buf)
+	t.Cleanup(func() {
+		dlog.SetOutput(os.Stderr)
+	})
+
+	dir := t.TempDir()
+	ca := genSignedCert(t, dir, "test-ca", nil)
+	ci := genSignedCert(t, dir, "ci-client", ca)
+	rogueCA := genSignedCert(t, t.TempDir(), "rogue-ca", nil)
+	rogue := genSignedCert(t, t.TempDir(), "rogue-client", rogueCA)
+
+	s := &Server{
+		jobs:        make(chan Job, 1),
+		deployments: []Deployment{{Name: "web", Type: "stub"}, {Name: "off", Type: "stub", Disabled: true}},
+	}
+	ts := newMTLSServer(t, s, ca)
+
+	tests := []struct {
+		name     string
+		client   *testCert
+		method   string
+		path     string
+		wantCode int
+	}{
+		{"list without certificate", nil, http.MethodGet, "/api/deployments", http.StatusForbidden},
+		{"list with certificate", ci, http.MethodGet, "/api/deployments", http.StatusOK},
+		{"list with untrusted certificate", rogue, http.MethodGet, "/api/deployments", http.StatusForbidden},
+		{"trigger without certificate", nil, http.MethodPost, "/api/deployments/web/trigger", http.StatusForbidden},
+		{"trigger unknown", ci, http.MethodPost, "/api/deployments/nope/trigger", http.StatusNotFound},
+		{"trigger disabled", ci, http.MethodPost, "/api/deployments/off/trigger", http.StatusConflict},
+		{"trigger", ci, http.MethodPost, "/api/deployments/web/trigger", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := newTestClient(t, ts, tt.client).Do(req)
+			if err != nil {
+				t.Fatalf("request error: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+
+	select {
+	case j := <-s.jobs:
+		if j.Dep.Name != "web" {
+			t.Errorf("queued deployment %q, want %q", j.Dep.Name, "web")
+		}
+	default:
+		t.Error("trigger did not queue the job")
+	}
+	if !strings.Contains(buf.String(), `AUDIT POST /api/deployments/web/trigger subject="CN=ci-client"`) {
+		t.Errorf("audit log does not contain the client subject:\n%s", buf.String())
+	}
+}
+
+func TestServer_tlsConfig_clientCARequiresTLS(t *testing.T) {
+	ca := genSignedCert(t, t.TempDir(), "test-ca", nil)
+	if _, _, err := (&Server{clientCA: ca.certFile}).tlsConfig(); err == nil {
+		t.Fatal("tlsConfig() error = nil, want error")
+	}
+}
+
+func TestServer_apiTrigger_queueFull(t *testing.T) {
+	dir := t.TempDir()
+	ca := genSignedCert(t, dir, "test-ca", nil)
+	ci := genSignedCert(t, dir, "ci-client", ca)
+
+	s := &Server{
+		jobs:        make(chan Job), // no dispatcher, the queue is always full.
+		deployments: []Deployment{{Name: "web", Type: "stub"}},
+	}
+	ts := newMTLSServer(t, s, ca)
+	resp, err := newTestClient(t, ts, ci).Post(ts.URL+"/api/deployments/web/trigger", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
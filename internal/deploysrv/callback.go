@@ -0,0 +1,363 @@
+package deploysrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// callbacks is the name of the pending callbacks directory in the state
+// directory.
+const callbacks = "callbacks"
+
+const (
+	defCallbackAttempts   = 5
+	defCallbackBackoff    = 5 * time.Second
+	defCallbackMaxBackoff = 5 * time.Minute
+	defCallbackTimeout    = 30 * time.Second
+)
+
+// Callback delivery statuses, as reported in the job metadata.
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+// ContextCallbacker is an optional interface for the hookers, that support
+// the cancellation of the callback.  If implemented, it is used instead of
+// [Hooker.Callback], so that each delivery attempt is limited by the
+// timeout.
+type ContextCallbacker interface {
+	CallbackContext(ctx context.Context, data CallbackData) error
+}
+
+// CallbackRetry is the delivery policy of the callbacks to the source
+// systems.
+type CallbackRetry struct {
+	// Attempts is the maximum number of the delivery attempts, defaults to
+	// 5.
+	Attempts int `yaml:"attempts,omitempty"`
+	// Backoff is the delay before the first retry, it doubles with each
+	// attempt.  Defaults to 5s.
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+	// MaxBackoff is the maximum delay between the attempts, defaults to 5m.
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
+	// Timeout is the timeout of each attempt, defaults to 30s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// validate validates the policy and sets the defaults.
+func (c *CallbackRetry) validate() error {
+	if c.Attempts < 0 || c.Backoff < 0 || c.MaxBackoff < 0 || c.Timeout < 0 {
+		return errors.New("negative values are not allowed")
+	}
+	if c.Attempts == 0 {
+		c.Attempts = defCallbackAttempts
+	}
+	if c.Backoff == 0 {
+		c.Backoff = defCallbackBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defCallbackMaxBackoff
+	}
+	if c.MaxBackoff < c.Backoff {
+		return fmt.Errorf("max_backoff %s is less than backoff %s", c.MaxBackoff, c.Backoff)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defCallbackTimeout
+	}
+	return nil
+}
+
+// delay returns the delay before the next attempt, after n failed ones.
+func (c *CallbackRetry) delay(n int) time.Duration {
+	d := c.Backoff
+	for i := 1; i < n && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, c.MaxBackoff)
+}
+
+// CallbackAttempt is the callback delivery attempt.
+type CallbackAttempt struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// pendingCallback is the callback awaiting the delivery.  It is persisted in
+// the pending callbacks directory until it's delivered or the attempts are
+// exhausted.
+type pendingCallback struct {
+	// Type is the deployment type, that handles the callback.
+	Type        string            `json:"type"`
+	ID          uuid.UUID         `json:"id"`
+	Name        string            `json:"name"`
+	CallbackURL string            `json:"callback_url"`
+	Description string            `json:"description"`
+	Context     string            `json:"context"`
+	Error       string            `json:"error,omitempty"`
+	Outcome     Outcome           `json:"outcome"`
+	ResultsURL  string            `json:"results_url,omitempty"`
+	Trigger     Trigger           `json:"trigger"`
+	Attempts    []CallbackAttempt `json:"attempts,omitempty"`
+}
+
+func newPendingCallback(typ string, data CallbackData) *pendingCallback {
+	pc := &pendingCallback{
+		Type:        typ,
+		ID:          data.ID,
+		Name:        data.Name,
+		CallbackURL: data.CallbackURL,
+		Description: data.Description,
+		Context:     data.Context,
+		Outcome:     data.Outcome,
+		ResultsURL:  data.ResultsURL,
+		Trigger:     data.Trigger,
+	}
+	if data.Error != nil {
+		pc.Error = data.Error.Error()
+	}
+	return pc
+}
+
+func (pc *pendingCallback) data() CallbackData {
+	data := CallbackData{
+		ID:          pc.ID,
+		Name:        pc.Name,
+		CallbackURL: pc.CallbackURL,
+		Description: pc.Description,
+		Context:     pc.Context,
+		Outcome:     pc.Outcome,
+		ResultsURL:  pc.ResultsURL,
+		Trigger:     pc.Trigger,
+	}
+	if pc.Error != "" {
+		data.Error = errors.New(pc.Error)
+	}
+	return data
+}
+
+// callbackQueue delivers the callbacks to the source systems, retrying with
+// the exponential backoff.  Each callback is delivered in its own goroutine,
+// so that the one that's waiting for the retry doesn't delay the others.
+type callbackQueue struct {
+	cfg CallbackRetry
+	// dir is the pending callbacks directory, if empty, the callbacks are
+	// not persisted.
+	dir string
+	// update is called after each attempt to record it in the job
+	// metadata.
+	update func(id uuid.UUID, fn func(*jobMeta))
+	// sleep waits for d or until the context is done, it's replaced in
+	// tests.
+	sleep func(ctx context.Context, d time.Duration) bool
+}
+
+// newCallbackQueue creates the callback queue with the retry policy, that
+// must be valid.  If the stateDir is set, the pending callbacks are
+// persisted in it, and the ones left from the previous run are resumed.
+func newCallbackQueue(cfg CallbackRetry, stateDir string, update func(uuid.UUID, func(*jobMeta))) *callbackQueue {
+	q := &callbackQueue{cfg: cfg, update: update, sleep: sleepCtx}
+	if stateDir != "" {
+		q.dir = filepath.Join(stateDir, callbacks)
+	}
+	return q
+}
+
+// resume restarts the delivery of the pending callbacks from the previous
+// run.
+func (q *callbackQueue) resume(ctx context.Context) {
+	pending, err := q.restore()
+	if err != nil {
+		dlog.Printf("callbacks: unable to restore pending callbacks: %s", err)
+	}
+	if len(pending) > 0 {
+		dlog.Printf("callbacks: resuming %d pending callbacks", len(pending))
+	}
+	for _, pc := range pending {
+		go q.deliver(ctx, pc)
+	}
+}
+
+// enqueue queues the callback of the deployment type for the delivery.  If
+// q is nil, the callback is attempted once.
+func (q *callbackQueue) enqueue(ctx context.Context, typ string, data CallbackData) {
+	pc := newPendingCallback(typ, data)
+	if q == nil {
+		if err := callback(ctx, typ, data); err != nil {
+			dlog.Printf("%s> callback failed for %q: %v", data.ID, data.CallbackURL, err)
+		}
+		return
+	}
+	q.save(pc)
+	q.record(pc, CallbackPending)
+	go q.deliver(ctx, pc)
+}
+
+// deliver delivers the callback, retrying until it succeeds, the attempts
+// are exhausted or the context is cancelled.  On cancellation, the callback
+// is left pending to be resumed after the restart.
+func (q *callbackQueue) deliver(ctx context.Context, pc *pendingCallback) {
+	for len(pc.Attempts) < q.cfg.Attempts {
+		if n := len(pc.Attempts); n > 0 {
+			if !q.sleep(ctx, q.cfg.delay(n)) {
+				return
+			}
+		}
+		start := time.Now()
+		actx, cancel := context.WithTimeout(ctx, q.cfg.Timeout)
+		err := callback(actx, pc.Type, pc.data())
+		cancel()
+		a := CallbackAttempt{Time: start, Duration: time.Since(start)}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		pc.Attempts = append(pc.Attempts, a)
+		if err == nil {
+			dlog.Printf("%s> [%s] callback delivered, attempt %d/%d", pc.ID, pc.Name, len(pc.Attempts), q.cfg.Attempts)
+			q.record(pc, CallbackDelivered)
+			q.remove(pc)
+			return
+		}
+		if ctx.Err() != nil {
+			// shutting down, the attempt doesn't count.
+			pc.Attempts = pc.Attempts[:len(pc.Attempts)-1]
+			return
+		}
+		dlog.Printf("%s> callback failed for %q: attempt %d/%d: %v", pc.ID, pc.CallbackURL, len(pc.Attempts), q.cfg.Attempts, err)
+		if !retryable(err) {
+			dlog.Printf("%s> [%s] callback rejected, not retrying", pc.ID, pc.Name)
+			break
+		}
+		if len(pc.Attempts) < q.cfg.Attempts {
+			q.save(pc)
+			q.record(pc, CallbackPending)
+		}
+	}
+	dlog.Printf("%s> [%s] giving up on callback after %d attempts", pc.ID, pc.Name, len(pc.Attempts))
+	q.record(pc, CallbackFailed)
+	q.remove(pc)
+}
+
+// retryable reports whether the failed callback should be retried.  The
+// client errors, except the request timeout and the rate limit, are not
+// retried, as the source system will reject the same request again.
+func retryable(err error) bool {
+	var se *shared.StatusError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	return true
+}
+
+// callback calls the callback of the deployment type.
+func callback(ctx context.Context, typ string, data CallbackData) error {
+	dp, ok := deploymentTypes[typ]
+	if !ok {
+		return fmt.Errorf("*** INTERNAL ERROR***: unregistered deployment type %q", typ)
+	}
+	if cc, ok := dp.(ContextCallbacker); ok {
+		return cc.CallbackContext(ctx, data)
+	}
+	return dp.Callback(data)
+}
+
+// record records the callback attempts and the status in the job metadata.
+func (q *callbackQueue) record(pc *pendingCallback, status string) {
+	if q.update == nil {
+		return
+	}
+	attempts := slices.Clone(pc.Attempts)
+	q.update(pc.ID, func(m *jobMeta) {
+		m.Callback = &callbackMeta{Status: status, Attempts: attempts}
+	})
+}
+
+func (q *callbackQueue) pendingFile(pc *pendingCallback) string {
+	return filepath.Join(q.dir, pc.ID.String()+".json")
+}
+
+// save persists the pending callback, if the directory is set.
+func (q *callbackQueue) save(pc *pendingCallback) {
+	if q.dir == "" {
+		return
+	}
+	data, err := json.Marshal(pc)
+	if err != nil {
+		dlog.Printf("%s> callbacks: %s", pc.ID, err)
+		return
+	}
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		dlog.Printf("%s> callbacks: %s", pc.ID, err)
+		return
+	}
+	name := q.pendingFile(pc)
+	if err := os.WriteFile(name+".tmp", data, 0600); err != nil {
+		dlog.Printf("%s> callbacks: %s", pc.ID, err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		dlog.Printf("%s> callbacks: %s", pc.ID, err)
+	}
+}
+
+// remove removes the persisted pending callback.
+func (q *callbackQueue) remove(pc *pendingCallback) {
+	if q.dir == "" {
+		return
+	}
+	if err := os.Remove(q.pendingFile(pc)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		dlog.Printf("%s> callbacks: %s", pc.ID, err)
+	}
+}
+
+// restore returns the persisted pending callbacks.
+func (q *callbackQueue) restore() ([]*pendingCallback, error) {
+	if q.dir == "" {
+		return nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var pending []*pendingCallback
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var pc pendingCallback
+		if err := json.Unmarshal(data, &pc); err != nil {
+			dlog.Printf("callbacks: %s: %s, skipping", filepath.Base(name), err)
+			continue
+		}
+		pending = append(pending, &pc)
+	}
+	return pending, nil
+}
+
+// sleepCtx waits for the duration d, it returns false, if the context is
+// cancelled before that.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
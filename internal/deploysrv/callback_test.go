@@ -0,0 +1,244 @@
+package deploysrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// flakyHooker fails the first failN callbacks with err, or the generic
+// error, if it's not set, and blocks until the context is done, if block is
+// set.
+type flakyHooker struct {
+	stubHooker
+	mu    sync.Mutex
+	failN int
+	err   error
+	block bool
+	calls int
+}
+
+func (h *flakyHooker) CallbackContext(ctx context.Context, data CallbackData) error {
+	h.mu.Lock()
+	h.calls++
+	n := h.calls
+	h.mu.Unlock()
+	if h.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if n <= h.failN {
+		if h.err != nil {
+			return h.err
+		}
+		return errors.New("callback down")
+	}
+	return nil
+}
+
+// newTestQueue returns the callback queue, that doesn't wait between the
+// attempts, and the server that keeps the job metadata.
+func newTestQueue(t *testing.T, cfg CallbackRetry) (*callbackQueue, *Server) {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{resultsDir: t.TempDir()}
+	q := newCallbackQueue(cfg, t.TempDir(), s.updateMeta)
+	q.sleep = func(ctx context.Context, d time.Duration) bool { return ctx.Err() == nil }
+	return q, s
+}
+
+func TestCallbackRetry_delay(t *testing.T) {
+	cfg := CallbackRetry{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := cfg.delay(n); got != want {
+			t.Errorf("delay(%d) = %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestCallbackRetry_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     CallbackRetry
+		want    CallbackRetry
+		wantErr bool
+	}{
+		{"defaults", CallbackRetry{}, CallbackRetry{Attempts: 5, Backoff: 5 * time.Second, MaxBackoff: 5 * time.Minute, Timeout: 30 * time.Second}, false},
+		{"custom", CallbackRetry{Attempts: 2, Backoff: time.Minute, MaxBackoff: time.Hour, Timeout: time.Second}, CallbackRetry{Attempts: 2, Backoff: time.Minute, MaxBackoff: time.Hour, Timeout: time.Second}, false},
+		{"negative", CallbackRetry{Attempts: -1}, CallbackRetry{}, true},
+		{"max less than backoff", CallbackRetry{Backoff: time.Hour, MaxBackoff: time.Minute}, CallbackRetry{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.cfg != tt.want {
+				t.Errorf("validate() = %+v, want %+v", tt.cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallbackQueue_deliver(t *testing.T) {
+	withDeploymentTypes(t)
+
+	tests := []struct {
+		name         string
+		hook         *flakyHooker
+		wantStatus   string
+		wantAttempts int
+	}{
+		{"first attempt", &flakyHooker{}, CallbackDelivered, 1},
+		{"after retries", &flakyHooker{failN: 2}, CallbackDelivered, 3},
+		{"gives up", &flakyHooker{failN: 10}, CallbackFailed, 3},
+		{"rejected", &flakyHooker{failN: 10, err: &shared.StatusError{Code: http.StatusUnprocessableEntity}}, CallbackFailed, 1},
+		{"rate limited", &flakyHooker{failN: 2, err: &shared.StatusError{Code: http.StatusTooManyRequests}}, CallbackDelivered, 3},
+		{"server error", &flakyHooker{failN: 2, err: &shared.StatusError{Code: http.StatusBadGateway}}, CallbackDelivered, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deploymentTypes["stub"] = tt.hook
+			q, s := newTestQueue(t, CallbackRetry{Attempts: 3})
+			pc := newPendingCallback("stub", CallbackData{ID: uuid.Must(uuid.NewUUID()), Name: "web", CallbackURL: "https://callback.test"})
+			q.save(pc)
+
+			q.deliver(context.Background(), pc)
+
+			m, err := s.loadMeta(pc.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Callback == nil || m.Callback.Status != tt.wantStatus || len(m.Callback.Attempts) != tt.wantAttempts {
+				t.Fatalf("callback metadata = %+v", m.Callback)
+			}
+			if last := m.Callback.Attempts[tt.wantAttempts-1]; (last.Error == "") != (tt.wantStatus == CallbackDelivered) {
+				t.Errorf("last attempt = %+v", last)
+			}
+			if _, err := os.Stat(q.pendingFile(pc)); !os.IsNotExist(err) {
+				t.Errorf("pending callback is not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestCallbackQueue_timeout(t *testing.T) {
+	withDeploymentTypes(t)
+	deploymentTypes["stub"] = &flakyHooker{block: true}
+
+	q, s := newTestQueue(t, CallbackRetry{Attempts: 2, Timeout: 10 * time.Millisecond})
+	pc := newPendingCallback("stub", CallbackData{ID: uuid.Must(uuid.NewUUID()), Name: "web", CallbackURL: "https://callback.test"})
+	q.deliver(context.Background(), pc)
+
+	m, err := s.loadMeta(pc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Callback.Status != CallbackFailed || len(m.Callback.Attempts) != 2 {
+		t.Fatalf("callback metadata = %+v", m.Callback)
+	}
+	for i, a := range m.Callback.Attempts {
+		if a.Error != context.DeadlineExceeded.Error() {
+			t.Errorf("attempt %d error = %q, want %q", i, a.Error, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestCallbackQueue_resume(t *testing.T) {
+	withDeploymentTypes(t)
+	deploymentTypes["stub"] = &flakyHooker{}
+
+	q, s := newTestQueue(t, CallbackRetry{Attempts: 3})
+	// the callback that has failed once before the restart.
+	pc := newPendingCallback("stub", CallbackData{
+		ID:          uuid.Must(uuid.NewUUID()),
+		Name:        "web",
+		CallbackURL: "https://callback.test",
+		Error:       errors.New("exit status 1"),
+		Trigger:     Trigger{Source: "stub", Vars: map[string]string{"tag": "v1"}},
+	})
+	pc.Attempts = []CallbackAttempt{{Time: time.Now(), Error: "callback down"}}
+	q.save(pc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.resume(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, err := s.loadMeta(pc.ID)
+		if err == nil && m.Callback != nil && m.Callback.Status == CallbackDelivered {
+			if len(m.Callback.Attempts) != 2 {
+				t.Errorf("attempts = %d, want 2", len(m.Callback.Attempts))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("callback is not delivered, metadata: %+v", m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	files, _ := filepath.Glob(filepath.Join(q.dir, "*"))
+	if len(files) != 0 {
+		t.Errorf("pending callbacks are not removed: %v", files)
+	}
+}
+
+func TestServer_apiJob(t *testing.T) {
+	dir := t.TempDir()
+	ca := genSignedCert(t, dir, "test-ca", nil)
+	ci := genSignedCert(t, dir, "ci-client", ca)
+
+	s := &Server{resultsDir: t.TempDir()}
+	id := uuid.Must(uuid.NewUUID())
+	s.updateMeta(id, func(m *jobMeta) {
+		m.Name = "web"
+		m.Callback = &callbackMeta{Status: CallbackPending, Attempts: []CallbackAttempt{{Error: "callback down"}}}
+	})
+	ts := newMTLSServer(t, s, ca)
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{"found", "/api/jobs/" + id.String(), http.StatusOK},
+		{"unknown", "/api/jobs/" + uuid.Must(uuid.NewUUID()).String(), http.StatusNotFound},
+		{"invalid", "/api/jobs/nope", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := newTestClient(t, ts, ci).Get(ts.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var m jobMeta
+			if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+			if m.ID != id || m.Name != "web" || m.Callback.Status != CallbackPending || len(m.Callback.Attempts) != 1 {
+				t.Errorf("job = %+v", m)
+			}
+		})
+	}
+}
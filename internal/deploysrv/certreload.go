@@ -0,0 +1,110 @@
+package deploysrv
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rusq/dlog"
+)
+
+// defReloadInterval is how often the certificate files are checked for
+// changes.
+const defReloadInterval = 30 * time.Second
+
+// certReloader serves the certificate from the files, reloading it when the
+// files change, i.e. after renewal by certbot.  If the new files are broken,
+// the last good certificate is served.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	cert atomic.Pointer[tls.Certificate]
+
+	mu        sync.Mutex // guards the fields below
+	lastCheck time.Time
+	stamp     fileStamp
+}
+
+// fileStamp is the state of the certificate and key files.
+type fileStamp struct {
+	certMod, keyMod   time.Time
+	certSize, keySize int64
+}
+
+// newCertReloader loads the certificate and returns the reloader.  The
+// initial load must succeed.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: defReloadInterval,
+	}
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert.Store(&cert)
+	r.stamp = stamp
+	r.lastCheck = time.Now()
+	return r, nil
+}
+
+// GetCertificate implements [tls.Config.GetCertificate].
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	return r.cert.Load(), nil
+}
+
+// maybeReload reloads the certificate, if the check interval has passed and
+// the files have changed.
+func (r *certReloader) maybeReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < r.interval {
+		return
+	}
+	r.lastCheck = time.Now()
+	stamp, err := r.fileStamp()
+	if err != nil {
+		dlog.Printf("certificate reload: %s, keeping the current certificate", err)
+		return
+	}
+	if stamp == r.stamp {
+		return
+	}
+	// stamp is updated even if the load fails, so that the broken files are
+	// not reloaded on every check, until they change again.
+	r.stamp = stamp
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		dlog.Printf("certificate reload: %s, keeping the current certificate", err)
+		return
+	}
+	r.cert.Store(&cert)
+	dlog.Printf("certificate reloaded from %s", r.certFile)
+}
+
+func (r *certReloader) fileStamp() (fileStamp, error) {
+	cfi, err := os.Stat(r.certFile)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	kfi, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{
+		certMod:  cfi.ModTime(),
+		keyMod:   kfi.ModTime(),
+		certSize: cfi.Size(),
+		keySize:  kfi.Size(),
+	}, nil
+}
@@ -0,0 +1,107 @@
+package deploysrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func certCN(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+// replaceCert generates the certificate for cn and moves it over certFile and
+// keyFile, bumping the modification time.
+func replaceCert(t *testing.T, cn, certFile, keyFile string, mtime time.Time) {
+	t.Helper()
+	newCert, newKey := genCert(t, t.TempDir(), cn)
+	for _, f := range [][2]string{{newCert, certFile}, {newKey, keyFile}} {
+		data, err := os.ReadFile(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f[1], data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f[1], mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := genCert(t, dir, "old.test")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	r.interval = 0
+
+	get := func() string {
+		t.Helper()
+		cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("GetCertificate() error = %v", err)
+		}
+		return certCN(t, cert)
+	}
+
+	if cn := get(); cn != "old.test" {
+		t.Fatalf("initial certificate = %q, want %q", cn, "old.test")
+	}
+
+	// renewed certificate is picked up.
+	replaceCert(t, "new.test", certFile, keyFile, time.Now().Add(time.Minute))
+	if cn := get(); cn != "new.test" {
+		t.Fatalf("after renewal certificate = %q, want %q", cn, "new.test")
+	}
+
+	// broken certificate keeps the last good one.
+	if err := os.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(certFile, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if cn := get(); cn != "new.test" {
+		t.Fatalf("after broken renewal certificate = %q, want %q", cn, "new.test")
+	}
+
+	// removed files keep the last good one as well.
+	if err := os.Remove(filepath.Join(dir, "old.test.key")); err != nil {
+		t.Fatal(err)
+	}
+	if cn := get(); cn != "new.test" {
+		t.Fatalf("after removal certificate = %q, want %q", cn, "new.test")
+	}
+}
+
+func TestCertReloader_interval(t *testing.T) {
+	certFile, keyFile := genCert(t, t.TempDir(), "old.test")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	replaceCert(t, "new.test", certFile, keyFile, time.Now().Add(time.Minute))
+	cert, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+	if cn := certCN(t, cert); cn != "old.test" {
+		t.Fatalf("certificate reloaded before the interval: %q", cn)
+	}
+}
+
+func TestNewCertReloader_invalid(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "nope.crt"), filepath.Join(dir, "nope.key")); err == nil {
+		t.Fatal("newCertReloader() error = nil, want error")
+	}
+}
@@ -1,31 +1,67 @@
 package deploysrv
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
 
 	"github.com/rusq/dlog"
 )
 
 type Config struct {
+	// Listen is the listener configuration.
+	Listen Listen `yaml:"listen,omitempty"`
 	// ServerURL is the server url for results callback.
 	ServerURL string `yaml:"server_url"`
 	// Cert is the certificate for TLS enabled listener.
 	Cert string `yaml:"cert"`
 	// Key is the key for TLS enabled listener.
 	Key string `yaml:"key"`
+	// ACME is the automatic certificate management configuration.  If the
+	// static Cert and Key are set as well, they are used as a fallback.
+	ACME *ACME `yaml:"acme,omitempty"`
+	// ClientCA is the PEM file with the CA certificates to verify the client
+	// certificates with.  API endpoints are enabled only if it is set, and
+	// require a verified client certificate.  Webhooks do not.
+	ClientCA string `yaml:"client_ca,omitempty"`
 	// ResultsDir is the directory to store results.
 	ResultsDir string `yaml:"results_dir"`
+	// StateDir is the directory to persist the server state between
+	// restarts, i.e. the last scheduled run times, the pending notification
+	// deliveries and callbacks, and the history of the deployments.
+	StateDir string `yaml:"state_dir,omitempty"`
 	// Deployments is the list of deployments.
 	Deployments []Deployment `yaml:"deployments"`
+	// Notifications is the list of the result notification destinations.
+	Notifications []Destination `yaml:"notifications,omitempty"`
+	// Callbacks is the delivery policy of the callbacks to the source
+	// systems.
+	Callbacks *CallbackRetry `yaml:"callbacks,omitempty"`
+	// Include is the list of glob patterns of additional config files to
+	// load.  Relative patterns are resolved against the directory of the
+	// including file.
+	Include []string `yaml:"include,omitempty"`
+
+	// secrets are the interpolated secret values, see [Config.Redact].
+	secrets []string
 }
 
 type Deployment struct {
+	// Name is the unique name of the deployment.  It is used in logs, results
+	// and API paths.  If not set, it is derived from the type and the workdir.
+	Name string `yaml:"name"`
 	// Type is the deployment type from the [hookers] package, (i.e.
-	// dockerhub).
+	// dockerhub).  It may be empty, if the deployment runs only on the
+	// Schedule.
 	Type string `yaml:"type"`
 	// Disabled is the flag to disable the deployment.
 	Disabled bool `yaml:"disabled"`
@@ -34,9 +70,29 @@ type Deployment struct {
 	Workdir string `yaml:"work_dir"`
 	// Command is the command to run in the workdir.
 	Command []string `yaml:"command"`
+	// Steps are the pipeline steps to run in order, instead of the Command.
+	Steps []Step `yaml:"steps,omitempty"`
+	// Timeout is the maximum run time of the command or all the steps,
+	// after which it's killed.  If zero, there's no limit.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// OnFailure is the command to run, when the deployment fails or times
+	// out, i.e. to roll back to the last successful deployment.  Its
+	// trigger variables are passed to the command with HUBDEPLOY_PREV_
+	// prefix, i.e. HUBDEPLOY_PREV_TAG.  If the command has no timeout, the
+	// deployment timeout applies to it separately, or 10m, if there's none.
+	OnFailure *Step `yaml:"on_failure,omitempty"`
+	// Healthcheck is the check, that must pass after the command succeeds,
+	// for the deployment to succeed.
+	Healthcheck *Healthcheck `yaml:"healthcheck,omitempty"`
 	// Payload is the configuration of the deployment type, i.e. dockerhub
 	// configuration.
 	Payload any `yaml:"payload"`
+	// Schedule is the optional schedule to run the deployment on, in
+	// addition to the webhooks.
+	Schedule *Schedule `yaml:"schedule,omitempty"`
+
+	// Source is the config file this deployment was loaded from.
+	Source string `yaml:"-"`
 }
 
 func (c *Config) IsEmpty() bool {
@@ -49,6 +105,23 @@ func (c *Config) IsEmpty() bool {
 }
 
 func (c *Config) validate() error {
+	if err := c.initNames(); err != nil {
+		return err
+	}
+	if c.ACME != nil {
+		if err := c.ACME.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Callbacks == nil {
+		c.Callbacks = new(CallbackRetry)
+	}
+	if err := c.Callbacks.validate(); err != nil {
+		return fmt.Errorf("callbacks: %w", err)
+	}
+	if c.ClientCA != "" && c.ACME == nil && (c.Cert == "" || c.Key == "") {
+		return errors.New("client_ca requires TLS to be configured")
+	}
 	for i := range c.Deployments {
 		c.Deployments[i].initOrDisable()
 	}
@@ -58,54 +131,185 @@ func (c *Config) validate() error {
 	return nil
 }
 
+// reName is the allowed deployment name format.
+var reName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// initNames derives names for the deployments that don't have one, and
+// ensures that all names are valid and unique.
+func (c *Config) initNames() error {
+	seen := make(map[string]int, len(c.Deployments))
+	// explicit names first, so that derived names never take them.
+	for i, d := range c.Deployments {
+		if d.Name == "" {
+			continue
+		}
+		if !reName.MatchString(d.Name) {
+			return fmt.Errorf("deployment %s: invalid name %q", d.ref(i), d.Name)
+		}
+		if j, ok := seen[d.Name]; ok {
+			return fmt.Errorf("deployment %s: duplicate name %q, already used by deployment %s", d.ref(i), d.Name, c.Deployments[j].ref(j))
+		}
+		seen[d.Name] = i
+	}
+	for i := range c.Deployments {
+		d := &c.Deployments[i]
+		if d.Name != "" {
+			continue
+		}
+		base := d.derivedName()
+		name := base
+		for n := 2; ; n++ {
+			if _, ok := seen[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		d.Name = name
+		seen[name] = i
+	}
+	return nil
+}
+
+// ref returns the human readable reference to the deployment with index i.
+func (m *Deployment) ref(i int) string {
+	if m.Source == "" {
+		return fmt.Sprintf("#%d", i+1)
+	}
+	return fmt.Sprintf("#%d (%s)", i+1, m.Source)
+}
+
+// derivedName returns the name derived from the deployment type and the base
+// name of the workdir.
+func (m *Deployment) derivedName() string {
+	dir := m.Workdir
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	name := sanitizeName(m.Type) + "-" + sanitizeName(filepath.Base(dir))
+	return strings.Trim(name, "-._")
+}
+
+// sanitizeName replaces all characters that are not allowed in the deployment
+// name with dashes.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, s)
+}
+
 func (m *Deployment) initOrDisable() {
 	if m.Disabled {
 		return
 	}
+	if m.Timeout < 0 {
+		m.Disabled = true
+		dlog.Printf("[%s] invalid timeout: %s", m.Name, m.Timeout)
+		return
+	}
 	fi, err := os.Stat(m.Workdir)
 	if err != nil {
 		m.Disabled = true
-		dlog.Printf("workdir error for %q: %s", m.Type, err)
+		dlog.Printf("[%s] workdir error: %s", m.Name, err)
 		return
 	}
 	if !fi.IsDir() {
 		m.Disabled = true
-		dlog.Printf("[%s] %s is not a directory", m.Type, m.Workdir)
+		dlog.Printf("[%s] %s is not a directory", m.Name, m.Workdir)
 		return
 	}
+	if err := m.initSteps(); err != nil {
+		m.Disabled = true
+		dlog.Printf("[%s] invalid steps: %s", m.Name, err)
+		return
+	}
+	if m.OnFailure != nil {
+		if err := m.OnFailure.validate(m.Workdir); err != nil {
+			m.Disabled = true
+			dlog.Printf("[%s] invalid on_failure: %s", m.Name, err)
+			return
+		}
+	}
+	if m.Healthcheck != nil {
+		if err := m.Healthcheck.init(); err != nil {
+			m.Disabled = true
+			dlog.Printf("[%s] invalid healthcheck: %s", m.Name, err)
+			return
+		}
+		if m.Healthcheck.Rollback && m.OnFailure == nil {
+			m.Disabled = true
+			dlog.Printf("[%s] invalid healthcheck: rollback requires on_failure", m.Name)
+			return
+		}
+	}
+	if m.Schedule != nil {
+		if err := m.Schedule.init(); err != nil {
+			m.Disabled = true
+			dlog.Printf("[%s] invalid schedule: %s", m.Name, err)
+			return
+		}
+		if m.Type == "" {
+			// runs only on schedule.
+			return
+		}
+	}
 	if m.Payload == nil {
 		m.Disabled = true
-		dlog.Printf("no payload for %q deployment in %q", m.Type, m.Workdir)
+		dlog.Printf("[%s] no payload for %q deployment in %q", m.Name, m.Type, m.Workdir)
 		return
 	}
 
 	dp, ok := deploymentTypes[m.Type]
 	if !ok {
 		m.Disabled = true
-		dlog.Printf("unregistered deployment type %q for workdir %q", m.Type, m.Workdir)
+		dlog.Printf("[%s] unregistered deployment type %q", m.Name, m.Type)
 		return
 	}
 	if err := dp.Register(*m); err != nil {
 		m.Disabled = true
-		dlog.Printf("unable to register deployment type %q in workdir %q: %s", m.Type, m.Workdir, err)
+		dlog.Printf("[%s] unable to register deployment type %q: %s", m.Name, m.Type, err)
 		return
 	}
 }
 
+// LoadConfig loads the configuration from the file or, if filename is a
+// directory, from all YAML files in it, following the includes.
 func LoadConfig(filename string) (Config, error) {
-	f, err := os.Open(filename)
-	if err != nil {
+	l := loader{seen: make(map[string]bool)}
+	if err := l.load(filename); err != nil {
 		return Config{}, err
 	}
-	defer f.Close()
-	return readConfig(f)
+	return l.c, nil
 }
 
+// readConfig reads the configuration from r, expanding the environment
+// variable and secret file references in the values.
 func readConfig(r io.Reader) (Config, error) {
-	dec := yaml.NewDecoder(r, yaml.DisallowUnknownField(), yaml.DisallowDuplicateKey())
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return Config{}, err
+	}
+	if len(f.Docs) == 0 || f.Docs[0].Body == nil {
+		return Config{}, io.EOF
+	}
+	ip := newInterpolator()
+	body, err := ip.expand(f.Docs[0].Body)
+	if err != nil {
+		return Config{}, fmt.Errorf("config interpolation: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(nil), yaml.DisallowUnknownField(), yaml.DisallowDuplicateKey())
 	var c Config
-	if err := dec.Decode(&c); err != nil {
+	if err := dec.DecodeFromNode(body, &c); err != nil {
 		return Config{}, err
 	}
+	c.addSecrets(ip.secrets)
 	return c, nil
 }
@@ -1 +1,70 @@
 package deploysrv
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestConfig_initNames(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		deps      []Deployment
+		wantNames []string
+		wantErr   bool
+	}{
+		{
+			"explicit",
+			[]Deployment{{Name: "web", Type: "dockerhub"}, {Name: "api", Type: "dockerhub"}},
+			[]string{"web", "api"},
+			false,
+		},
+		{
+			"derived",
+			[]Deployment{{Type: "dockerhub", Workdir: dir}},
+			[]string{"dockerhub-" + filepath.Base(dir)},
+			false,
+		},
+		{
+			"derived collision",
+			[]Deployment{{Type: "dockerhub", Workdir: dir}, {Type: "dockerhub", Workdir: dir}},
+			[]string{"dockerhub-" + filepath.Base(dir), "dockerhub-" + filepath.Base(dir) + "-2"},
+			false,
+		},
+		{
+			"derived does not take explicit",
+			[]Deployment{{Type: "dockerhub", Workdir: dir}, {Name: "dockerhub-" + filepath.Base(dir), Type: "dockerhub"}},
+			[]string{"dockerhub-" + filepath.Base(dir) + "-2", "dockerhub-" + filepath.Base(dir)},
+			false,
+		},
+		{
+			"duplicate",
+			[]Deployment{{Name: "web"}, {Name: "web"}},
+			nil,
+			true,
+		},
+		{
+			"invalid",
+			[]Deployment{{Name: "web/../x"}},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Deployments: tt.deps}
+			err := c.initNames()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("initNames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for i, want := range tt.wantNames {
+				if got := c.Deployments[i].Name; got != want {
+					t.Errorf("Deployments[%d].Name = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package deploysrv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is the parsed standard 5-field cron expression:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Fields support lists (1,2), ranges (1-5), steps (*/15, 1-30/5) and month and
+// weekday names (jan, mon).  The @yearly, @monthly, @weekly, @daily and
+// @hourly descriptors are supported as well.
+type cronSpec struct {
+	minute, hour, dom, month, dow bits
+	// domStar and dowStar are set, if the day of month or the day of week is
+	// unrestricted.  If both are restricted, the day matches if either of
+	// them matches.
+	domStar, dowStar bool
+}
+
+// bits is the set of values of the cron field.
+type bits uint64
+
+func (b bits) has(n int) bool {
+	return b&(1<<uint(n)) != 0
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	fMinute = cronField{name: "minute", min: 0, max: 59}
+	fHour   = cronField{name: "hour", min: 0, max: 23}
+	fDom    = cronField{name: "day of month", min: 1, max: 31}
+	fMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// day of week allows 7 for Sunday, it is folded into 0 after parsing.
+	fDow = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses the cron expression.
+func parseCron(expr string) (*cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@") {
+		std, ok := cronDescriptors[strings.ToLower(expr)]
+		if !ok {
+			return nil, fmt.Errorf("cron %q: unknown descriptor", expr)
+		}
+		expr = std
+	}
+	ff := strings.Fields(expr)
+	if len(ff) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(ff))
+	}
+	var (
+		c   cronSpec
+		err error
+	)
+	for i, f := range []struct {
+		dst  *bits
+		spec cronField
+	}{
+		{&c.minute, fMinute},
+		{&c.hour, fHour},
+		{&c.dom, fDom},
+		{&c.month, fMonth},
+		{&c.dow, fDow},
+	} {
+		if *f.dst, err = f.spec.parse(ff[i]); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+	}
+	if c.dow.has(7) {
+		c.dow = c.dow&^(1<<7) | 1
+	}
+	// as in Vixie cron, the field starting with "*" is unrestricted.
+	c.domStar = strings.HasPrefix(ff[2], "*")
+	c.dowStar = strings.HasPrefix(ff[4], "*")
+	return &c, nil
+}
+
+// parse parses the comma separated list of ranges.
+func (f cronField) parse(s string) (bits, error) {
+	var b bits
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("%s: invalid step %q", f.name, stepStr)
+			}
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(loStr); err != nil {
+				return 0, err
+			}
+			switch {
+			case isRange:
+				if hi, err = f.value(hiStr); err != nil {
+					return 0, err
+				}
+			case !hasStep:
+				hi = lo
+			}
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("%s: invalid range %q", f.name, rng)
+		}
+		for i := lo; i <= hi; i += step {
+			b |= 1 << uint(i)
+		}
+	}
+	return b, nil
+}
+
+// value parses the single value of the field.
+func (f cronField) value(s string) (int, error) {
+	if n, ok := f.names[strings.ToLower(s)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid value %q", f.name, s)
+	}
+	if n < f.min || f.max < n {
+		return 0, fmt.Errorf("%s: value %d out of range [%d, %d]", f.name, n, f.min, f.max)
+	}
+	return n, nil
+}
+
+// errNoNextRun is returned, if the schedule never fires, i.e. "0 0 30 2 *".
+var errNoNextRun = errors.New("schedule has no next run time")
+
+// next returns the first time after t that matches the schedule, in the
+// location of t.
+func (c *cronSpec) next(t time.Time) (time.Time, error) {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// the schedule that doesn't fire within 5 years, never fires.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !c.month.has(int(m)):
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !c.hour.has(t.Hour()):
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case !c.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, errNoNextRun
+}
+
+// dayMatches reports whether the day of t matches the day of month and day
+// of week fields.
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	domOK, dowOK := c.dom.has(t.Day()), c.dow.has(int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
@@ -0,0 +1,122 @@
+package deploysrv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 0-6,22-23 1 jan-mar mon-fri", false},
+		{"0 0 * * 7", false},
+		{"@daily", false},
+		{"@every 5m", true},
+		{"* * * *", true},
+		{"60 * * * *", true},
+		{"* * 0 * *", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"* * * foo *", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := parseCron(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("parseCron() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronSpec_next(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name    string
+		expr    string
+		from    time.Time
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name: "next minute",
+			expr: "* * * * *",
+			from: time.Date(2024, 1, 1, 10, 0, 30, 0, time.UTC),
+			want: time.Date(2024, 1, 1, 10, 1, 0, 0, time.UTC),
+		},
+		{
+			name: "exact time is not included",
+			expr: "30 3 * * *",
+			from: time.Date(2024, 1, 1, 3, 30, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 2, 3, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "step",
+			expr: "*/20 * * * *",
+			from: time.Date(2024, 1, 1, 10, 41, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "weekday",
+			expr: "0 9 * * mon",
+			from: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), // wednesday
+			want: time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "sunday as 7",
+			expr: "0 0 * * 7",
+			from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), // monday
+			want: time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day of month or day of week",
+			expr: "0 0 15 * fri",
+			from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "leap day",
+			expr: "0 0 29 2 *",
+			from: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "never",
+			expr:    "0 0 30 2 *",
+			from:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantErr: true,
+		},
+		{
+			name: "time zone",
+			expr: "0 3 * * *",
+			from: time.Date(2024, 7, 1, 0, 0, 0, 0, london),
+			want: time.Date(2024, 7, 1, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "skipped by DST",
+			expr: "30 1 * * *",
+			from: time.Date(2024, 3, 31, 0, 0, 0, 0, london),
+			want: time.Date(2024, 4, 1, 1, 30, 0, 0, london),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.next(tt.from)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("next() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
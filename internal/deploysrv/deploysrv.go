@@ -1,14 +1,16 @@
 package deploysrv
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,6 +22,9 @@ const (
 	defJobQueueSz = 100
 	resultExt     = ".txt"
 	stall         = 991 * time.Millisecond
+	// waitDelay is how long to wait for the output after the command is
+	// killed on timeout.
+	waitDelay = 5 * time.Second
 
 	results = "results"
 )
@@ -33,6 +38,9 @@ var deploymentTypes = map[string]Hooker{}
 type Server struct {
 	cert    string
 	privkey string
+	acme    *ACME
+	// clientCA is the client certificates CA file, see [Config.ClientCA].
+	clientCA string
 
 	jobs    chan Job
 	results chan result
@@ -40,11 +48,68 @@ type Server struct {
 	url        string
 	resultsDir string
 	prefix     string
+
+	deployments []Deployment
+	// sched is the scheduler, nil if there are no scheduled deployments.
+	sched *scheduler
+	// notifier delivers the notifications, nil if there are no
+	// destinations.
+	notifier *notifier
+	// callbacks delivers the callbacks to the source systems.
+	callbacks *callbackQueue
+	// deployed keeps the history of the successful deployments.
+	deployed *deployedStore
+
+	metaMu sync.Mutex // guards the job metadata files
+
+	// ctx is the server lifetime context, it's cancelled on shutdown, see
+	// [Server.Close].
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
 type Job struct {
 	CallbackURL string
 	Dep         Deployment
+	// Trigger describes what has triggered the job.
+	Trigger Trigger
+	// Done, if set, is called with the deployment error after the job has
+	// run, i.e. for the hooker to persist its state only after the
+	// successful deployment.
+	Done func(error)
+}
+
+// envPrefix is the prefix of the trigger variables environment names.
+const envPrefix = "HUBDEPLOY_"
+
+// Trigger describes the event that has triggered the job.
+type Trigger struct {
+	// Source is the trigger source, i.e. the hooker type.
+	Source string
+	// Vars are the trigger variables, i.e. repository, tag, digest or ref.
+	// They are passed to the command as the environment variables with
+	// HUBDEPLOY_ prefix and upper-cased name, i.e. HUBDEPLOY_TAG.
+	Vars map[string]string
+}
+
+// Env returns the trigger variables as the environment variables, sorted by
+// name.
+func (t Trigger) Env() []string {
+	return t.env(envPrefix)
+}
+
+// env returns the trigger variables as the environment variables with the
+// prefix, sorted by name.
+func (t Trigger) env(prefix string) []string {
+	env := make([]string, 0, len(t.Vars)+1)
+	if t.Source != "" {
+		env = append(env, prefix+"SOURCE="+t.Source)
+	}
+	for k, v := range t.Vars {
+		env = append(env, prefix+strings.ToUpper(k)+"="+v)
+	}
+	sort.Strings(env)
+	return env
 }
 
 // Hooker is the interface for pluggable webhook handlers.
@@ -61,21 +126,45 @@ type Hooker interface {
 	// will also be a path of a webhook.
 	Type() string
 }
+
+// Poller is an optional interface for the hookers, that discover the changes
+// by polling the source system, instead of waiting for the webhook.
+type Poller interface {
+	// Poll must poll the source system until the context is cancelled, and
+	// post a Job to a Job channel, when there's a change.
+	Poll(ctx context.Context, jobs chan<- Job)
+}
+
 type CallbackData struct {
-	ID          uuid.UUID
+	ID uuid.UUID
+	// Name is the name of the deployment.
+	Name        string
 	CallbackURL string
 	Description string
 	Context     string
 	Error       error
-	ResultsURL  string
+	// Outcome is the outcome of the deployment, the hookers map it to the
+	// states of the source system.
+	Outcome    Outcome
+	ResultsURL string
+	// Trigger is the trigger of the job.
+	Trigger Trigger
 }
 
 type result struct {
-	id     uuid.UUID
-	output []byte
-	url    string
-	typ    string
-	err    error
+	id      uuid.UUID
+	name    string
+	output  []byte
+	url     string
+	typ     string
+	err     error
+	outcome Outcome
+	steps   []stepResult
+	rbk     *stepResult
+	health  *healthResult
+	trg     Trigger
+	start   time.Time
+	dur     time.Duration
 }
 
 type Option func(*Server)
@@ -114,11 +203,20 @@ func New(c Config, opts ...Option) (*Server, error) {
 	s := &Server{
 		cert:       c.Cert,
 		privkey:    c.Key,
+		acme:       c.ACME,
+		clientCA:   c.ClientCA,
 		resultsDir: c.ResultsDir,
 		results:    make(chan result),
 		jobs:       make(chan Job, defJobQueueSz),
 		url:        c.ServerURL,
+		prefix:     c.Listen.Prefix,
+
+		deployments: c.Deployments,
+		sched:       newScheduler(c.Deployments, c.StateDir),
+		notifier:    newNotifier(c.Notifications, c.StateDir),
+		deployed:    newDeployedStore(c.StateDir),
 	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
 
 	for _, opt := range opts {
 		opt(s)
@@ -128,6 +226,8 @@ func New(c Config, opts ...Option) (*Server, error) {
 			return nil, err
 		}
 	}
+	s.callbacks = newCallbackQueue(*c.Callbacks, c.StateDir, s.updateMeta)
+	s.callbacks.resume(s.ctx)
 
 	go s.dispatcher(s.results, s.jobs)
 	go s.processor(s.results)
@@ -160,6 +260,16 @@ func (s *Server) resultsURL() string {
 
 }
 
+// resultURL returns the URL of the result with the id, or an empty string,
+// if the results are not served.
+func (s *Server) resultURL(id uuid.UUID) string {
+	base := s.resultsURL()
+	if base == "" {
+		return ""
+	}
+	return base + id.String() + resultExt
+}
+
 // initResultDir checks if the directory exists, if not - creates it.
 func (s *Server) initResultDir() error {
 	absPath, err := filepath.Abs(s.resultsDir)
@@ -174,16 +284,93 @@ func (s *Server) initResultDir() error {
 }
 
 // ListenAndServe listens for incoming connections on the specified address and
-// Serves them.
+// Serves them, until the server is closed.
 func (s *Server) ListenAndServe(addr string) error {
 	defer close(s.jobs)
+	ctx := s.ctx
+	var wg sync.WaitGroup
+	// pollers must stop sending before the jobs channel is closed.
+	defer wg.Wait()
+	defer s.stop()
+	s.startPollers(ctx, &wg)
+	if s.sched != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.sched.run(ctx, s.jobs)
+		}()
+	}
+
 	mux := s.routes()
 	mux = logMiddleware(mux)
-	if s.cert != "" && s.privkey != "" {
-		dlog.Debugln("TLS enabled")
-		return http.ListenAndServeTLS(addr, s.cert, s.privkey, mux)
-	} else {
-		return http.ListenAndServe(addr, mux)
+	tlsCfg, challenge, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: addr, Handler: mux, TLSConfig: tlsCfg}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			dlog.Printf("shutdown: %s", err)
+		}
+	}()
+	// srv.ListenAndServe returns as soon as the shutdown starts, the
+	// webhook handlers may still be sending the jobs until it completes.
+	defer func() {
+		s.stop()
+		<-shutdown
+	}()
+	if tlsCfg == nil {
+		return ignoreClosed(srv.ListenAndServe())
+	}
+	if challenge != nil {
+		httpAddr := s.acme.HTTPAddr
+		if httpAddr == "" {
+			httpAddr = defACMEHTTPAddr
+		}
+		go func() {
+			dlog.Println("acme: http-01 challenge listener on", httpAddr)
+			if err := http.ListenAndServe(httpAddr, logMiddleware(challenge)); err != nil {
+				dlog.Printf("acme: http-01 challenge listener: %s", err)
+			}
+		}()
+	}
+	dlog.Debugln("TLS enabled")
+	return ignoreClosed(srv.ListenAndServeTLS("", ""))
+}
+
+// Close stops the server, if it's listening, and cancels the server context,
+// that stops the pollers, the scheduler and the callback deliveries.  The
+// pending callbacks are resumed on the next start, if the state directory is
+// set.
+func (s *Server) Close() error {
+	s.stop()
+	return nil
+}
+
+// ignoreClosed returns nil, if err is [http.ErrServerClosed].
+func ignoreClosed(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// startPollers starts the hookers that implement the [Poller] interface.
+func (s *Server) startPollers(ctx context.Context, wg *sync.WaitGroup) {
+	for name, d := range deploymentTypes {
+		p, ok := d.(Poller)
+		if !ok {
+			continue
+		}
+		dlog.Debugf("starting %s poller", name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Poll(ctx, s.jobs)
+		}()
 	}
 }
 
@@ -199,6 +386,7 @@ func (s *Server) routes() http.Handler {
 	}
 
 	s.initWebhookHandlers(mux)
+	s.initAPIHandlers(mux)
 
 	return mux
 }
@@ -216,13 +404,36 @@ func (s *Server) initWebhookHandlers(mux *http.ServeMux) {
 // dispatcher runs the deployments and sends the results to the results chan.
 func (s *Server) dispatcher(results chan<- result, jobs <-chan Job) {
 	for j := range jobs {
-		id, output, err := s.runDeployment(j.Dep)
+		id := uuid.Must(uuid.NewUUID())
+		start := time.Now()
+		s.notifier.started(Notification{
+			ID:         id,
+			Name:       j.Dep.Name,
+			ResultsURL: s.resultURL(id),
+			Trigger:    j.Trigger,
+			Time:       start,
+		})
+		r := s.runDeployment(id, j.Dep, j.Trigger)
+		if j.Done != nil {
+			j.Done(r.err)
+		}
+		if r.err == nil {
+			s.deployed.add(j.Dep.Name, newDeployedVersion(id, j.Trigger, start))
+		}
 		results <- result{
-			id:     id,
-			output: output,
-			typ:    j.Dep.Type,
-			url:    j.CallbackURL,
-			err:    err,
+			id:      id,
+			name:    j.Dep.Name,
+			output:  r.output,
+			typ:     j.Dep.Type,
+			url:     j.CallbackURL,
+			err:     r.err,
+			outcome: r.outcome,
+			steps:   r.steps,
+			rbk:     r.rollback,
+			health:  r.health,
+			trg:     j.Trigger,
+			start:   start,
+			dur:     time.Since(start),
 		}
 	}
 }
@@ -234,26 +445,56 @@ func (s *Server) processor(results <-chan result) {
 		if res.err != nil {
 			msg = res.err.Error()
 		}
-		dlog.Printf("%s>  result:  %s", res.id, msg)
+		dlog.Printf("%s> [%s] result:  %s", res.id, res.name, msg)
 
 		s.maybeSave(res.id, res.output)
-
-		dp, ok := deploymentTypes[res.typ]
-		if !ok {
+		s.updateMeta(res.id, func(m *jobMeta) {
+			m.Name = res.name
+			m.Source = res.trg.Source
+			m.Vars = res.trg.Vars
+			m.Started = res.start
+			m.Duration = res.dur
+			m.Outcome = res.outcome
+			m.Steps = res.steps
+			m.Rollback = res.rbk
+			m.Healthcheck = res.health
+			if res.err != nil {
+				m.Error = res.err.Error()
+			}
+		})
+		s.notifier.notify(Notification{
+			ID:         res.id,
+			Name:       res.name,
+			Error:      res.err,
+			Output:     res.output,
+			ResultsURL: s.resultURL(res.id),
+			Trigger:    res.trg,
+			Duration:   res.dur,
+			Time:       time.Now(),
+		})
+
+		if res.typ == "" {
+			continue // scheduled only, no one to call back.
+		}
+		if _, ok := deploymentTypes[res.typ]; !ok {
 			dlog.Printf("*** INTERNAL ERROR***: got result for unregistered deployment type %q", res.typ)
 			continue
 		}
+		if res.url == "" {
+			continue // not triggered by the webhook, nothing to report to.
+		}
 
-		if err := dp.Callback(CallbackData{
+		s.callbacks.enqueue(s.ctx, res.typ, CallbackData{
 			ID:          res.id,
+			Name:        res.name,
 			CallbackURL: res.url,
 			Description: ifErrNotNil(res.err, "deployed with error", "deployed OK"),
 			Context:     "Continuous integration by github.com/rusq/hubdeploy",
 			Error:       res.err,
-			ResultsURL:  s.resultsURL() + res.id.String() + resultExt,
-		}); err != nil {
-			dlog.Printf("%s> callback failed for %q: %v", res.id, res.url, err)
-		}
+			Outcome:     res.outcome,
+			ResultsURL:  s.resultURL(res.id),
+			Trigger:     res.trg,
+		})
 	}
 }
 
@@ -265,30 +506,60 @@ func ifErrNotNil(err error, whenNotNil, whenNil string) string {
 	return whenNil
 }
 
-// runDeployment runs the deployment, returning the result UUID, deployment
-// output and an error.
-func (*Server) runDeployment(d Deployment) (uuid.UUID, []byte, error) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return uuid.UUID{}, nil, err
-	}
-	defer os.Chdir(cwd)
-
-	id := uuid.Must(uuid.NewUUID())
-	dlog.Printf("%s> starting %q deployment in %q", id.String(), d.Type, d.Workdir)
+// run is the result of the deployment run.
+type run struct {
+	output  []byte
+	outcome Outcome
+	err     error
+	// steps are the results of the pipeline steps, nil, if the deployment
+	// has a single command.
+	steps []stepResult
+	// rollback is the result of the on_failure command, nil, if it didn't
+	// run.
+	rollback *stepResult
+	// health is the result of the health check, nil, if it didn't run.
+	health *healthResult
+}
 
-	if err := os.Chdir(d.Workdir); err != nil {
-		return id, nil, fmt.Errorf("%s> chdir to %q failed: %w", id.String(), d.Workdir, err)
+// runDeployment runs the deployment command or the pipeline steps with the
+// job id.  If it succeeds, the health check is polled, if it's set.  If it
+// fails, and the deployment has the on_failure command, it is run as well.
+func (s *Server) runDeployment(id uuid.UUID, d Deployment, t Trigger) run {
+	dlog.Printf("%s> [%s] starting %q deployment in %q", id.String(), d.Name, d.Type, d.Workdir)
+
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
 	}
-	command, args := head(d.Command...)
-	cmd := exec.Command(command, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return id, output, fmt.Errorf("%s> execution failed with %w: %s", id.String(), err, string(output))
+	var r run
+	if len(d.Steps) > 0 {
+		r = runPipeline(ctx, id, d, t)
+	} else {
+		sr := runStep(ctx, d.Workdir, Step{Command: d.Command}, t)
+		r = run{output: sr.output, outcome: sr.Outcome}
+		if sr.err != nil {
+			// the output may contain anything, it's available in the
+			// results.
+			r.err = fmt.Errorf("%s> execution failed with %w", id.String(), sr.err)
+		}
+	}
+	if r.err == nil && d.Healthcheck != nil {
+		checkHealth(id, d, t, &r)
+		if r.err != nil && !d.Healthcheck.Rollback {
+			return r
+		}
+	}
+	if r.err != nil {
+		if d.OnFailure != nil {
+			s.rollback(id, d, t, &r)
+		}
+		return r
 	}
-	dlog.Debugln(string(output))
-	dlog.Printf("%s> completed without errors.", id)
-	return id, output, nil
+	dlog.Debugln(string(r.output))
+	dlog.Printf("%s> [%s] completed without errors.", id, d.Name)
+	return r
 }
 
 // maybeSave maybe saves output to the file with UUID as name and resultExt as
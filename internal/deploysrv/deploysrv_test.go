@@ -3,6 +3,7 @@ package deploysrv
 import (
 	"bytes"
 	"errors"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -23,7 +24,7 @@ type stubHooker struct {
 
 func (s *stubHooker) Register(Deployment) error { return s.registerErr }
 func (s *stubHooker) Handler(chan<- Job) http.HandlerFunc {
-	panic("not used in tests")
+	return http.NotFound
 }
 func (s *stubHooker) Callback(data CallbackData) error {
 	if s.callbacks != nil {
@@ -166,3 +167,110 @@ func TestNew_requiresRegisteredHookersBeforeValidation(t *testing.T) {
 	close(srv.jobs)
 	close(srv.results)
 }
+
+func TestServer_Close(t *testing.T) {
+	withDeploymentTypes(t)
+	if err := Register(&stubHooker{}); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(Config{
+		Deployments: []Deployment{
+			{Type: "stub", Workdir: t.TempDir(), Command: []string{"echo", "ok"}, Payload: map[string]any{"repo": "demo"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.ListenAndServe("127.0.0.1:0")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Errorf("ListenAndServe() error = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenAndServe() did not return after Close()")
+	}
+	if srv.ctx.Err() == nil {
+		t.Error("server context is not cancelled")
+	}
+}
+
+// slowHooker is the hooker, which handler queues the job, after release is
+// closed.
+type slowHooker struct {
+	stubHooker
+	dep     Deployment
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (h *slowHooker) Handler(j chan<- Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		close(h.entered)
+		<-h.release
+		j <- Job{Dep: h.dep}
+	}
+}
+
+func TestServer_Close_inflightWebhook(t *testing.T) {
+	withDeploymentTypes(t)
+	dep := Deployment{Name: "web", Type: "stub", Workdir: t.TempDir(), Command: []string{"echo", "ok"}, Payload: map[string]any{"repo": "demo"}}
+	hook := &slowHooker{dep: dep, entered: make(chan struct{}), release: make(chan struct{})}
+	if err := Register(hook); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(Config{Listen: Listen{Prefix: DefaultPrefix}, Deployments: []Deployment{dep}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.ListenAndServe(addr)
+	}()
+	go func() {
+		for range 50 {
+			resp, err := http.Post("http://"+addr+"/webhooks/stub/", "", nil)
+			if err == nil {
+				resp.Body.Close()
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-hook.entered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook handler was not called")
+	}
+
+	srv.Close()
+	select {
+	case err := <-errC:
+		t.Fatalf("ListenAndServe() returned before the handler has finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(hook.release) // must not panic with send on closed channel.
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Errorf("ListenAndServe() error = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenAndServe() did not return after Close()")
+	}
+}
@@ -18,8 +18,10 @@ func (s *Server) resultsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// only the job output is served, the job metadata and anything else in
+	// the results directory is not public.
 	filename := path.Base(r.URL.Path)
-	if filename == "" {
+	if filename == "" || path.Ext(filename) != resultExt {
 		time.Sleep(stall)
 		http.NotFound(w, r)
 		return
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -17,7 +18,7 @@ func TestServer_resultsHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tempdir)
-	testfile, err := ioutil.TempFile(tempdir, "")
+	testfile, err := ioutil.TempFile(tempdir, "*"+resultExt)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -28,6 +29,10 @@ func TestServer_resultsHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 	testfile.Close()
+	metafile := strings.TrimSuffix(testfile.Name(), resultExt) + metaExt
+	if err := os.WriteFile(metafile, []byte(`{"id":"x"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
 
 	type fields struct {
 		cert       string
@@ -89,6 +94,16 @@ func TestServer_resultsHandler(t *testing.T) {
 			wantCode: http.StatusOK,
 			wantBody: testContents,
 		},
+		{
+			name:   "metadata is not served",
+			fields: fields{resultsDir: tempdir},
+			args: args{
+				httptest.NewRecorder(),
+				httptest.NewRequest(http.MethodGet, "/"+metafile, nil),
+			},
+			wantCode: http.StatusNotFound,
+			wantBody: "404 page not found\n",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
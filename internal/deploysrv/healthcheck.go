@@ -0,0 +1,218 @@
+package deploysrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+)
+
+const (
+	defHealthTimeout  = time.Minute
+	defHealthInterval = 5 * time.Second
+	// maxHealthBody is the maximum size of the HTTP response body, that is
+	// matched against the regular expression.
+	maxHealthBody = 1 << 20
+)
+
+// Healthcheck is the check, that is polled after the deployment command
+// succeeds.  The job succeeds only if the check passes within the timeout.
+// Exactly one of HTTP, TCP or Command must be set.
+type Healthcheck struct {
+	// HTTP is the HTTP check.
+	HTTP *HTTPCheck `yaml:"http,omitempty"`
+	// TCP is the address to connect to, i.e. "localhost:8080".
+	TCP string `yaml:"tcp,omitempty"`
+	// Command is the command, that must exit with zero code, it runs in
+	// the deployment workdir.
+	Command []string `yaml:"command,omitempty"`
+	// Timeout is the maximum time to wait for the check to pass, defaults
+	// to 1m.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Interval is the delay between the attempts, defaults to 5s.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Rollback runs the deployment on_failure command, if the check fails.
+	Rollback bool `yaml:"rollback,omitempty"`
+}
+
+// HTTPCheck is the HTTP health check.
+type HTTPCheck struct {
+	// URL is the URL to GET.
+	URL string `yaml:"url"`
+	// Status is the expected response status code, defaults to 200.
+	Status int `yaml:"status,omitempty"`
+	// Body is the regular expression, that the response body must match.
+	Body string `yaml:"body,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// init validates the health check and sets the defaults.
+func (hc *Healthcheck) init() error {
+	n := 0
+	if hc.HTTP != nil {
+		n++
+		if err := hc.HTTP.init(); err != nil {
+			return fmt.Errorf("http: %w", err)
+		}
+	}
+	if hc.TCP != "" {
+		n++
+		if _, _, err := net.SplitHostPort(hc.TCP); err != nil {
+			return fmt.Errorf("tcp: %w", err)
+		}
+	}
+	if len(hc.Command) > 0 {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of http, tcp or command must be set")
+	}
+	if hc.Timeout < 0 || hc.Interval < 0 {
+		return errors.New("negative values are not allowed")
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = defHealthTimeout
+	}
+	if hc.Interval == 0 {
+		hc.Interval = defHealthInterval
+	}
+	return nil
+}
+
+func (hc *HTTPCheck) init() error {
+	u, err := url.Parse(hc.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url: %q", hc.URL)
+	}
+	if hc.Status == 0 {
+		hc.Status = http.StatusOK
+	}
+	if hc.Body != "" {
+		if hc.re, err = regexp.Compile(hc.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns the human readable description of the check.
+func (hc *Healthcheck) String() string {
+	switch {
+	case hc.HTTP != nil:
+		return "http " + hc.HTTP.URL
+	case hc.TCP != "":
+		return "tcp " + hc.TCP
+	default:
+		return strings.Join(hc.Command, " ")
+	}
+}
+
+// probe runs the check once.
+func (hc *Healthcheck) probe(ctx context.Context, workdir string, t Trigger) error {
+	switch {
+	case hc.HTTP != nil:
+		return hc.HTTP.probe(ctx)
+	case hc.TCP != "":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", hc.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		sr := runStep(ctx, workdir, Step{Command: hc.Command}, t)
+		if sr.err != nil {
+			return fmt.Errorf("%w: %s", sr.err, bytes.TrimSpace(sr.output))
+		}
+		return nil
+	}
+}
+
+func (hc *HTTPCheck) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != hc.Status {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if hc.re != nil && !hc.re.Match(body) {
+		return fmt.Errorf("body does not match %q", hc.Body)
+	}
+	return nil
+}
+
+// healthResult is the result of the health check.
+type healthResult struct {
+	Passed   bool          `json:"passed"`
+	Attempts int           `json:"attempts"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	// Error is the error of the last attempt.
+	Error string `json:"error,omitempty"`
+}
+
+// checkHealth polls the deployment health check until it passes or the
+// check times out, and appends the attempts to the job output as a separate
+// section.  If the check fails, the job fails.
+func checkHealth(id uuid.UUID, d Deployment, t Trigger, r *run) {
+	hc := d.Healthcheck
+	dlog.Printf("%s> [%s] health check: %s", id, d.Name, hc)
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	var buf bytes.Buffer
+	writeOutput(&buf, r.output)
+	fmt.Fprintf(&buf, "==> healthcheck: %s\n", hc)
+
+	hr := healthResult{Started: time.Now()}
+	var err error
+	for {
+		hr.Attempts++
+		if err = hc.probe(ctx, d.Workdir, t); err == nil {
+			break
+		}
+		fmt.Fprintf(&buf, "attempt %d: %s\n", hr.Attempts, err)
+		if !sleepCtx(ctx, hc.Interval) {
+			err = fmt.Errorf("timed out after %s: %w", hc.Timeout, err)
+			break
+		}
+	}
+	hr.Duration = time.Since(hr.Started)
+	hr.Passed = err == nil
+	status := "passed"
+	if err != nil {
+		status = "failed"
+		hr.Error = err.Error()
+		dlog.Printf("%s> [%s] health check failed after %d attempts: %s", id, d.Name, hr.Attempts, err)
+		r.outcome = Outcome{Status: OutcomeFailure, ExitCode: -1}
+		r.err = fmt.Errorf("%s> health check failed: %w", id, err)
+	}
+	fmt.Fprintf(&buf, "<== healthcheck: %s after %d attempts in %s\n", status, hr.Attempts, hr.Duration.Round(time.Millisecond))
+	r.output = buf.Bytes()
+	r.health = &hr
+}
@@ -0,0 +1,168 @@
+package deploysrv
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHealthcheck_init(t *testing.T) {
+	tests := []struct {
+		name    string
+		hc      Healthcheck
+		want    Healthcheck
+		wantErr bool
+	}{
+		{"tcp defaults", Healthcheck{TCP: "localhost:80"}, Healthcheck{TCP: "localhost:80", Timeout: time.Minute, Interval: 5 * time.Second}, false},
+		{"command", Healthcheck{Command: []string{"true"}, Timeout: time.Second, Interval: time.Millisecond}, Healthcheck{Command: []string{"true"}, Timeout: time.Second, Interval: time.Millisecond}, false},
+		{"http", Healthcheck{HTTP: &HTTPCheck{URL: "http://localhost/health", Body: "^ok$"}}, Healthcheck{}, false},
+		{"none", Healthcheck{}, Healthcheck{}, true},
+		{"several", Healthcheck{TCP: "localhost:80", Command: []string{"true"}}, Healthcheck{}, true},
+		{"invalid tcp", Healthcheck{TCP: "localhost"}, Healthcheck{}, true},
+		{"invalid url", Healthcheck{HTTP: &HTTPCheck{URL: "localhost/health"}}, Healthcheck{}, true},
+		{"invalid regexp", Healthcheck{HTTP: &HTTPCheck{URL: "http://localhost/health", Body: "(ok"}}, Healthcheck{}, true},
+		{"negative", Healthcheck{TCP: "localhost:80", Interval: -time.Second}, Healthcheck{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.hc.init()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.hc.HTTP != nil {
+				if tt.hc.HTTP.Status != http.StatusOK || tt.hc.HTTP.re == nil {
+					t.Errorf("http check = %+v", tt.hc.HTTP)
+				}
+				return
+			}
+			if tt.hc.String() != tt.want.String() || tt.hc.Timeout != tt.want.Timeout || tt.hc.Interval != tt.want.Interval {
+				t.Errorf("init() = %+v, want %+v", tt.hc, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_runDeployment_healthcheck(t *testing.T) {
+	dir := t.TempDir()
+
+	// the service, that becomes healthy on the third request.
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{"status":"ok"}`)
+	}))
+	defer ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	rollback := &Step{Command: []string{"echo", "rolled back"}}
+	check := func(hc Healthcheck) *Healthcheck {
+		hc.Timeout, hc.Interval = 200*time.Millisecond, 10*time.Millisecond
+		if err := hc.init(); err != nil {
+			t.Fatal(err)
+		}
+		return &hc
+	}
+
+	tests := []struct {
+		name         string
+		hc           *Healthcheck
+		want         Outcome
+		wantAttempts int
+		wantRollback bool
+		wantOutput   []string
+	}{
+		{
+			"http passes",
+			check(Healthcheck{HTTP: &HTTPCheck{URL: ts.URL, Body: `"status":\s*"ok"`}}),
+			Outcome{Status: OutcomeSuccess},
+			3,
+			false,
+			[]string{"==> healthcheck: http " + ts.URL + "\nattempt 1: unexpected status: 503 Service Unavailable\n", "<== healthcheck: passed after 3 attempts in "},
+		},
+		{
+			"http body mismatch",
+			check(Healthcheck{HTTP: &HTTPCheck{URL: ts.URL, Body: "healthy"}}),
+			Outcome{Status: OutcomeFailure, ExitCode: -1},
+			0,
+			false,
+			[]string{`body does not match "healthy"`, "<== healthcheck: failed after "},
+		},
+		{
+			"tcp passes",
+			check(Healthcheck{TCP: l.Addr().String()}),
+			Outcome{Status: OutcomeSuccess},
+			1,
+			false,
+			nil,
+		},
+		{
+			"tcp fails with rollback",
+			check(Healthcheck{TCP: closed.Addr().String(), Rollback: true}),
+			Outcome{Status: OutcomeFailure, ExitCode: -1},
+			0,
+			true,
+			[]string{"<== healthcheck: failed after ", "==> on_failure\nrolled back\n"},
+		},
+		{
+			"command fails without rollback",
+			check(Healthcheck{Command: []string{"sh", "-c", "echo not ready; exit 1"}}),
+			Outcome{Status: OutcomeFailure, ExitCode: -1},
+			0,
+			false,
+			[]string{"attempt 1: exit status 1: not ready\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := Deployment{Name: "test", Workdir: dir, Command: []string{"echo", "deployed"}, OnFailure: rollback, Healthcheck: tt.hc}
+			var s Server
+			r := s.runDeployment(uuid.Must(uuid.NewUUID()), dep, Trigger{})
+			if r.outcome != tt.want {
+				t.Errorf("outcome = %+v, want %+v", r.outcome, tt.want)
+			}
+			if (r.err == nil) != (tt.want.Status == OutcomeSuccess) {
+				t.Errorf("error = %v", r.err)
+			}
+			if r.health == nil || r.health.Passed != (tt.want.Status == OutcomeSuccess) {
+				t.Fatalf("health = %+v", r.health)
+			}
+			if tt.wantAttempts > 0 && r.health.Attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", r.health.Attempts, tt.wantAttempts)
+			}
+			if (r.rollback != nil) != tt.wantRollback {
+				t.Errorf("rollback = %+v, want %v", r.rollback, tt.wantRollback)
+			}
+			if !strings.HasPrefix(string(r.output), "deployed\n==> healthcheck: ") {
+				t.Errorf("output does not start with the command output:\n%s", r.output)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(string(r.output), want) {
+					t.Errorf("output does not contain %q:\n%s", want, r.output)
+				}
+			}
+		})
+	}
+}
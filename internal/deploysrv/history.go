@@ -0,0 +1,162 @@
+package deploysrv
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+)
+
+// deployed is the name of the deployment history directory in the state
+// directory.
+const deployed = "deployed"
+
+// maxHistory is the maximum number of the successful deployments kept in the
+// history of each deployment.
+const maxHistory = 50
+
+// deployedVersion is the successful deployment, i.e. the tag or the digest
+// deployed, as described by the trigger variables.
+type deployedVersion struct {
+	// ID is the job id.
+	ID     uuid.UUID         `json:"id"`
+	Source string            `json:"source,omitempty"`
+	Vars   map[string]string `json:"vars,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+func newDeployedVersion(id uuid.UUID, t Trigger, at time.Time) deployedVersion {
+	return deployedVersion{ID: id, Source: t.Source, Vars: t.Vars, Time: at}
+}
+
+// trigger returns the trigger of the deployment.
+func (dv deployedVersion) trigger() Trigger {
+	return Trigger{Source: dv.Source, Vars: dv.Vars}
+}
+
+// env returns the environment variables of the rollback command, they
+// describe the last successful deployment.
+func (dv deployedVersion) env() map[string]string {
+	env := map[string]string{prevEnvPrefix + "ID": dv.ID.String()}
+	for _, kv := range dv.trigger().env(prevEnvPrefix) {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return env
+}
+
+// deployedStore keeps the history of the successful deployments of each
+// deployment, the most recent first.
+type deployedStore struct {
+	// dir is the directory, where the history is stored, if empty, it is
+	// kept in memory only.
+	dir string
+
+	mu      sync.Mutex
+	history map[string][]deployedVersion
+}
+
+func newDeployedStore(stateDir string) *deployedStore {
+	ds := &deployedStore{history: make(map[string][]deployedVersion)}
+	if stateDir != "" {
+		ds.dir = filepath.Join(stateDir, deployed)
+	}
+	return ds
+}
+
+// last returns the last successful deployment with the name.  It returns
+// false, if it's unknown.  It is safe to call on nil store.
+func (ds *deployedStore) last(name string) (deployedVersion, bool) {
+	list := ds.list(name)
+	if len(list) == 0 {
+		return deployedVersion{}, false
+	}
+	return list[0], true
+}
+
+// find returns the successful deployment with the job id.  It is safe to
+// call on nil store.
+func (ds *deployedStore) find(name string, id uuid.UUID) (deployedVersion, bool) {
+	for _, dv := range ds.list(name) {
+		if dv.ID == id {
+			return dv, true
+		}
+	}
+	return deployedVersion{}, false
+}
+
+// list returns the history of the deployment with the name, the most recent
+// first.  It is safe to call on nil store.
+func (ds *deployedStore) list(name string) []deployedVersion {
+	if ds == nil {
+		return []deployedVersion{}
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return append([]deployedVersion{}, ds.load(name)...)
+}
+
+// add records the successful deployment with the name, and persists the
+// history, if the state directory is set.  It is safe to call on nil store.
+func (ds *deployedStore) add(name string, dv deployedVersion) {
+	if ds == nil {
+		return
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	history := append([]deployedVersion{dv}, ds.load(name)...)
+	if len(history) > maxHistory {
+		history = history[:maxHistory]
+	}
+	ds.history[name] = history
+	if ds.dir == "" {
+		return
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		dlog.Printf("[%s] history: %s", name, err)
+		return
+	}
+	if err := os.MkdirAll(ds.dir, 0755); err != nil {
+		dlog.Printf("[%s] history: %s", name, err)
+		return
+	}
+	fname := ds.stateFile(name)
+	if err := os.WriteFile(fname+".tmp", data, 0644); err != nil {
+		dlog.Printf("[%s] history: %s", name, err)
+		return
+	}
+	if err := os.Rename(fname+".tmp", fname); err != nil {
+		dlog.Printf("[%s] history: %s", name, err)
+	}
+}
+
+// load returns the history of the deployment, loading it from the state
+// directory on the first call.  Caller must hold the lock.
+func (ds *deployedStore) load(name string) []deployedVersion {
+	if history, ok := ds.history[name]; ok || ds.dir == "" {
+		return history
+	}
+	var history []deployedVersion
+	data, err := os.ReadFile(ds.stateFile(name))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			dlog.Printf("[%s] history: %s", name, err)
+		}
+	} else if err := json.Unmarshal(data, &history); err != nil {
+		dlog.Printf("[%s] history: %s", name, err)
+	}
+	ds.history[name] = history
+	return history
+}
+
+func (ds *deployedStore) stateFile(name string) string {
+	return filepath.Join(ds.dir, name+".json")
+}
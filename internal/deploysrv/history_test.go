@@ -0,0 +1,148 @@
+package deploysrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDeployedStore(t *testing.T) {
+	dir := t.TempDir()
+	ds := newDeployedStore(dir)
+	var ids []uuid.UUID
+	for i := range maxHistory + 2 {
+		id := uuid.Must(uuid.NewUUID())
+		ids = append(ids, id)
+		ds.add("web", newDeployedVersion(id, Trigger{Source: "dockerhub", Vars: map[string]string{"tag": fmt.Sprintf("v%d", i)}}, time.Now().Round(time.Second)))
+	}
+
+	// the restarted server.
+	ds = newDeployedStore(dir)
+	history := ds.list("web")
+	if len(history) != maxHistory {
+		t.Fatalf("history length = %d, want %d", len(history), maxHistory)
+	}
+	if history[0].ID != ids[len(ids)-1] || history[maxHistory-1].ID != ids[2] {
+		t.Errorf("history is not the most recent first")
+	}
+	if last, ok := ds.last("web"); !ok || last.ID != ids[len(ids)-1] || last.Source != "dockerhub" {
+		t.Errorf("last() = %+v, %v", last, ok)
+	}
+	if _, ok := ds.find("web", ids[5]); !ok {
+		t.Error("find() didn't find the deployment in history")
+	}
+	if _, ok := ds.find("web", ids[0]); ok {
+		t.Error("find() found the deployment, that is out of history")
+	}
+	if got := ds.list("api"); got == nil || len(got) != 0 {
+		t.Errorf("list() of unknown deployment = %v, want empty", got)
+	}
+
+	var nilStore *deployedStore
+	nilStore.add("web", deployedVersion{ID: ids[0]})
+	if _, ok := nilStore.last("web"); ok {
+		t.Error("nil store last() returned true")
+	}
+}
+
+func TestDeployedVersion_env(t *testing.T) {
+	id := uuid.Must(uuid.NewUUID())
+	dv := deployedVersion{ID: id, Source: "dockerhub", Vars: map[string]string{"tag": "v1", "digest": "sha256:abc"}}
+	want := map[string]string{
+		"HUBDEPLOY_PREV_ID":     id.String(),
+		"HUBDEPLOY_PREV_SOURCE": "dockerhub",
+		"HUBDEPLOY_PREV_TAG":    "v1",
+		"HUBDEPLOY_PREV_DIGEST": "sha256:abc",
+	}
+	got := dv.env()
+	if len(got) != len(want) {
+		t.Fatalf("env() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("env()[%s] = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestServer_apiHistory_rollback(t *testing.T) {
+	dir := t.TempDir()
+	ca := genSignedCert(t, dir, "test-ca", nil)
+	ci := genSignedCert(t, dir, "ci-client", ca)
+
+	s := &Server{
+		jobs:        make(chan Job, 1),
+		deployments: []Deployment{{Name: "web", Type: "stub"}, {Name: "off", Type: "stub", Disabled: true}},
+		deployed:    newDeployedStore(""),
+	}
+	v1 := newDeployedVersion(uuid.Must(uuid.NewUUID()), Trigger{Source: "dockerhub", Vars: map[string]string{"tag": "v1", "digest": "sha256:111"}}, time.Now())
+	v2 := newDeployedVersion(uuid.Must(uuid.NewUUID()), Trigger{Source: "dockerhub", Vars: map[string]string{"tag": "v2", "digest": "sha256:222"}}, time.Now())
+	s.deployed.add("web", v1)
+	s.deployed.add("web", v2)
+	ts := newMTLSServer(t, s, ca)
+	client := newTestClient(t, ts, ci)
+
+	t.Run("history", func(t *testing.T) {
+		resp, err := client.Get(ts.URL + "/api/deployments/web/history")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		var history []deployedVersion
+		if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 || history[0].ID != v2.ID || history[1].Vars["digest"] != "sha256:111" {
+			t.Errorf("history = %+v", history)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+	}{
+		{"history unknown", http.MethodGet, "/api/deployments/nope/history", http.StatusNotFound},
+		{"history empty", http.MethodGet, "/api/deployments/off/history", http.StatusOK},
+		{"rollback unknown deployment", http.MethodPost, "/api/deployments/nope/rollback?to=" + v1.ID.String(), http.StatusNotFound},
+		{"rollback disabled", http.MethodPost, "/api/deployments/off/rollback?to=" + v1.ID.String(), http.StatusConflict},
+		{"rollback without to", http.MethodPost, "/api/deployments/web/rollback", http.StatusBadRequest},
+		{"rollback not in history", http.MethodPost, "/api/deployments/web/rollback?to=" + uuid.Must(uuid.NewUUID()).String(), http.StatusNotFound},
+		{"rollback", http.MethodPost, "/api/deployments/web/rollback?to=" + v1.ID.String(), http.StatusAccepted},
+		// the queue holds one job, and there's no dispatcher.
+		{"rollback queue full", http.MethodPost, "/api/deployments/web/rollback?to=" + v1.ID.String(), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+
+	select {
+	case j := <-s.jobs:
+		if j.Dep.Name != "web" || j.Trigger.Source != rollbackSource || j.Trigger.Vars["tag"] != "v1" || j.Trigger.Vars["digest"] != "sha256:111" {
+			t.Errorf("queued job = %+v, want rollback of web to v1", j)
+		}
+	default:
+		t.Error("rollback did not queue the job")
+	}
+}
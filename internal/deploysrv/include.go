@@ -0,0 +1,153 @@
+package deploysrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// loader loads the configuration files and merges them together.
+type loader struct {
+	c    Config
+	seen map[string]bool
+}
+
+// load loads the file or all YAML files in the directory.
+func (l *loader) load(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return l.loadFile(name)
+	}
+	files, err := configFiles(name)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := l.loadFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configFiles returns the sorted list of YAML files in the directory.
+func configFiles(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		m, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, m...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadFile loads a single file, merges it into the resulting config and
+// processes its includes.
+func (l *loader) loadFile(name string) error {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if l.seen[abs] {
+		return fmt.Errorf("%s: included more than once", name)
+	}
+	l.seen[abs] = true
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	c, err := readConfig(f)
+	f.Close()
+	if errors.Is(err, io.EOF) {
+		// empty or commented out file, i.e. a disabled drop-in.  The config
+		// that is empty as a whole is rejected by the validation.
+		c, err = Config{}, nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for i := range c.Deployments {
+		c.Deployments[i].Source = name
+	}
+	includes := c.Include
+	if err := l.c.merge(c); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(name), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %q: %w", name, pattern, err)
+		}
+		for _, m := range matches {
+			if err := l.load(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var errConflict = errors.New("conflicting value")
+
+// merge merges the src into c.  Lists are concatenated, nested structures
+// are merged field by field, other values are taken from src, if set, and
+// must not conflict with the values already set.
+func (c *Config) merge(src Config) error {
+	if err := mergeStruct(reflect.ValueOf(c).Elem(), reflect.ValueOf(src), ""); err != nil {
+		return err
+	}
+	c.addSecrets(src.secrets)
+	return nil
+}
+
+// mergeStruct merges the exported fields of the struct value src into dst.
+// prefix is the yaml path of the struct, used in the conflict errors.
+func mergeStruct(dst, src reflect.Value, prefix string) error {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Name == "Include" {
+			continue
+		}
+		name := prefix + yamlName(f)
+		d, s := dst.Field(i), src.Field(i)
+		switch {
+		case s.IsZero():
+		case f.Type.Kind() == reflect.Slice:
+			d.Set(reflect.AppendSlice(d, s))
+		case f.Type.Kind() == reflect.Struct:
+			if err := mergeStruct(d, s, name+"."); err != nil {
+				return err
+			}
+		case d.IsZero():
+			d.Set(s)
+		case !reflect.DeepEqual(d.Interface(), s.Interface()):
+			return fmt.Errorf("%w for %q", errConflict, name)
+		}
+	}
+	return nil
+}
+
+// yamlName returns the yaml name of the field.
+func yamlName(f reflect.StructField) string {
+	tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if tag == "" {
+		return f.Name
+	}
+	return tag
+}
@@ -0,0 +1,119 @@
+package deploysrv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadConfig_include(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"hubdeploy.yml": "results_dir: ./results\ninclude:\n  - conf.d/*.yml\ndeployments:\n  - name: main\n    type: dockerhub\n",
+		"conf.d/a.yml":  "deployments:\n  - name: a\n    type: dockerhub\n",
+		"conf.d/b.yml":  "results_dir: ./results\ndeployments:\n  - name: b\n    type: dockerhub\n",
+	})
+
+	cfg, err := LoadConfig(filepath.Join(dir, "hubdeploy.yml"))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.ResultsDir != "./results" {
+		t.Errorf("ResultsDir = %q", cfg.ResultsDir)
+	}
+	want := []struct{ name, source string }{
+		{"main", filepath.Join(dir, "hubdeploy.yml")},
+		{"a", filepath.Join(dir, "conf.d", "a.yml")},
+		{"b", filepath.Join(dir, "conf.d", "b.yml")},
+	}
+	if len(cfg.Deployments) != len(want) {
+		t.Fatalf("got %d deployments, want %d", len(cfg.Deployments), len(want))
+	}
+	for i, w := range want {
+		if d := cfg.Deployments[i]; d.Name != w.name || d.Source != w.source {
+			t.Errorf("Deployments[%d] = (%q, %q), want (%q, %q)", i, d.Name, d.Source, w.name, w.source)
+		}
+	}
+}
+
+func TestLoadConfig_directory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"10-web.yml":  "deployments:\n  - name: web\n    type: dockerhub\n",
+		"20-api.yaml": "deployments:\n  - name: web\n    type: dockerhub\n",
+		"README":      "not a config",
+	})
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if len(cfg.Deployments) != 2 {
+		t.Fatalf("got %d deployments, want 2", len(cfg.Deployments))
+	}
+	err = cfg.initNames()
+	if err == nil {
+		t.Fatal("initNames() error = nil, want duplicate name error")
+	}
+	if !strings.Contains(err.Error(), "20-api.yaml") || !strings.Contains(err.Error(), "10-web.yml") {
+		t.Errorf("duplicate error does not mention the source files: %v", err)
+	}
+}
+
+func TestLoadConfig_conflict(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yml": "server_url: https://a.example.test\n",
+		"b.yml": "server_url: https://b.example.test\n",
+	})
+	if _, err := LoadConfig(dir); !errors.Is(err, errConflict) {
+		t.Fatalf("LoadConfig() error = %v, want %v", err, errConflict)
+	}
+}
+
+func TestLoadConfig_mergeListen(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yml":     "listen:\n  host: 127.0.0.1\n",
+		"b.yml":     "listen:\n  port: \"8080\"\n  host: 127.0.0.1\n",
+		"c.yml":     "# disabled\n# listen:\n#   port: \"9090\"\n",
+		"empty.yml": "",
+	})
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if want := (Listen{Host: "127.0.0.1", Port: "8080"}); cfg.Listen != want {
+		t.Errorf("Listen = %+v, want %+v", cfg.Listen, want)
+	}
+
+	writeFiles(t, dir, map[string]string{"d.yml": "listen:\n  port: \"9090\"\n"})
+	if _, err := LoadConfig(dir); !errors.Is(err, errConflict) || !strings.Contains(err.Error(), "listen.port") {
+		t.Fatalf("LoadConfig() error = %v, want %v for listen.port", err, errConflict)
+	}
+}
+
+func TestLoadConfig_includeLoop(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yml": "include: [b.yml]\n",
+		"b.yml": "include: [a.yml]\n",
+	})
+	if _, err := LoadConfig(filepath.Join(dir, "a.yml")); err == nil {
+		t.Fatal("LoadConfig() error = nil, want include loop error")
+	}
+}
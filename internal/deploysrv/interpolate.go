@@ -0,0 +1,226 @@
+package deploysrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/token"
+
+	"github.com/rusq/dlog"
+)
+
+const (
+	filePrefix = "file:"
+	redacted   = "*****"
+	// secretTag is the YAML tag of the secret values, i.e.
+	// "password: !secret hunter2", they are redacted in the logs.
+	secretTag = "!secret"
+	// minSecretLen is the minimum length of the redacted secret value, the
+	// shorter ones would mangle the unrelated log output.
+	minSecretLen = 4
+)
+
+// reRef matches the variable references: ${VAR}, ${VAR:-default} and
+// ${file:/path/to/secret}.
+var reRef = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// reSecretVar matches the environment variable names, which values are
+// considered secret.
+var reSecretVar = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|KEY|CREDENTIALS?)$`)
+
+// interpolator expands the references in the configuration values,
+// remembering the secret values.
+type interpolator struct {
+	lookupEnv func(string) (string, bool)
+	readFile  func(string) ([]byte, error)
+
+	secrets []string
+}
+
+func newInterpolator() *interpolator {
+	return &interpolator{
+		lookupEnv: os.LookupEnv,
+		readFile:  os.ReadFile,
+	}
+}
+
+// expand expands the references in the scalar values of the parsed YAML
+// node, so that the expanded values are never parsed as YAML, and the
+// comments are left untouched.  The plain scalars keep the YAML type of the
+// expanded value, i.e. "port: ${PORT}" is a number.  The values tagged with
+// !secret are untagged and remembered as the secrets.  "$${" can be used to
+// get the literal "${".  It returns the expanded node and all unresolved
+// references as a single error.
+func (ip *interpolator) expand(node ast.Node) (ast.Node, error) {
+	var errs []error
+	node = ip.expandNode(node, &errs)
+	return node, errors.Join(errs...)
+}
+
+func (ip *interpolator) expandNode(node ast.Node, errs *[]error) ast.Node {
+	switch n := node.(type) {
+	case *ast.DocumentNode:
+		n.Body = ip.expandNode(n.Body, errs)
+	case *ast.MappingNode:
+		for _, mv := range n.Values {
+			ip.expandNode(mv, errs)
+		}
+	case *ast.MappingValueNode:
+		n.Value = ip.expandNode(n.Value, errs)
+	case *ast.SequenceNode:
+		for i, v := range n.Values {
+			n.Values[i] = ip.expandNode(v, errs)
+		}
+	case *ast.AnchorNode:
+		n.Value = ip.expandNode(n.Value, errs)
+	case *ast.TagNode:
+		n.Value = ip.expandNode(n.Value, errs)
+		if n.Start.Value != secretTag {
+			return n
+		}
+		if sn, ok := n.Value.(ast.ScalarNode); ok {
+			ip.addSecret(fmt.Sprint(sn.GetValue()))
+		}
+		return n.Value
+	case *ast.LiteralNode:
+		n.Value.Value = ip.expandString(n.Value.Value, n.Start.Position.Line, errs)
+	case *ast.StringNode:
+		val := ip.expandString(n.Value, n.Token.Position.Line, errs)
+		if val == n.Value {
+			return n
+		}
+		n.Value = val
+		if n.Token.Type == token.StringType {
+			return plainScalar(n)
+		}
+	}
+	return node
+}
+
+// expandString expands all references in the value on the line n.
+func (ip *interpolator) expandString(val string, n int, errs *[]error) string {
+	parts := strings.Split(val, "$${")
+	for i, part := range parts {
+		parts[i] = reRef.ReplaceAllStringFunc(part, func(ref string) string {
+			val, err := ip.resolve(ref[2 : len(ref)-1])
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("line %d: %s: %w", n, ref, err))
+				return ref
+			}
+			return val
+		})
+	}
+	return strings.Join(parts, "${")
+}
+
+// plainScalar returns the node of the expanded plain scalar with the type of
+// its value, i.e. number or boolean.  The value is never parsed as the YAML
+// structure.
+func plainScalar(n *ast.StringNode) ast.Node {
+	tk := token.New(n.Value, n.Value, n.Token.Position)
+	switch tk.Type {
+	case token.BoolType:
+		return ast.Bool(tk)
+	case token.IntegerType, token.BinaryIntegerType, token.OctetIntegerType, token.HexIntegerType:
+		return ast.Integer(tk)
+	case token.FloatType:
+		return ast.Float(tk)
+	case token.NullType:
+		return ast.Null(tk)
+	}
+	return n
+}
+
+// resolve resolves a single reference expression (without the "${" and "}").
+func (ip *interpolator) resolve(expr string) (string, error) {
+	if filename, ok := strings.CutPrefix(expr, filePrefix); ok {
+		if filename == "" {
+			return "", errors.New("empty file name")
+		}
+		data, err := ip.readFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file: %w", err)
+		}
+		val := strings.TrimRight(string(data), "\r\n")
+		ip.addSecret(val)
+		return val, nil
+	}
+
+	name, def, hasDefault := strings.Cut(expr, ":-")
+	if name == "" {
+		return "", errors.New("empty variable name")
+	}
+	val, ok := ip.lookupEnv(name)
+	if !ok || val == "" {
+		if !hasDefault {
+			return "", errors.New("unresolved variable")
+		}
+		val = def
+	}
+	if reSecretVar.MatchString(name) {
+		ip.addSecret(val)
+	}
+	return val, nil
+}
+
+func (ip *interpolator) addSecret(val string) {
+	if val == "" {
+		return
+	}
+	if len(val) < minSecretLen {
+		dlog.Printf("config: secret value is shorter than %d characters, it is not redacted in the logs", minSecretLen)
+		return
+	}
+	ip.secrets = append(ip.secrets, val)
+}
+
+// addSecrets adds the secret values to the config, keeping them unique and
+// sorted longest first, so that a secret containing another one is redacted
+// as a whole.
+func (c *Config) addSecrets(secrets []string) {
+	c.secrets = append(c.secrets, secrets...)
+	slices.SortFunc(c.secrets, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+	c.secrets = slices.Compact(c.secrets)
+}
+
+// Redact replaces all secret values of the config with asterisks: the ones
+// read from the secret files, the environment variables with the secret
+// names, and the values tagged with !secret.
+func (c *Config) Redact(s string) string {
+	for _, secret := range c.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+// RedactWriter returns the writer that redacts the secret values in
+// everything written to w.  It is intended to wrap the log output.
+func (c *Config) RedactWriter(w io.Writer) io.Writer {
+	if len(c.secrets) == 0 {
+		return w
+	}
+	return &redactWriter{w: w, c: c}
+}
+
+type redactWriter struct {
+	w io.Writer
+	c *Config
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, rw.c.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
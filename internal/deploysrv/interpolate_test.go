@@ -0,0 +1,138 @@
+package deploysrv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
+)
+
+func TestInterpolator_expand(t *testing.T) {
+	env := map[string]string{
+		"HOST":      "example.test",
+		"EMPTY":     "",
+		"HUB_TOKEN": "s3cr3t-token",
+	}
+	files := map[string]string{
+		"/run/secrets/key":  "file-secret\n",
+		"/run/secrets/pin":  "42\n",
+		"/run/secrets/yaml": "a: #b\n'\"c\n",
+	}
+	newIP := func() *interpolator {
+		return &interpolator{
+			lookupEnv: func(name string) (string, bool) {
+				v, ok := env[name]
+				return v, ok
+			},
+			readFile: func(name string) ([]byte, error) {
+				v, ok := files[name]
+				if !ok {
+					return nil, os.ErrNotExist
+				}
+				return []byte(v), nil
+			},
+		}
+	}
+	tests := []struct {
+		name        string
+		in          string
+		want        map[string]any
+		wantSecrets []string
+		wantErr     string
+	}{
+		{"no refs", "a: b\n", map[string]any{"a": "b"}, nil, ""},
+		{"env", "url: https://${HOST}/\n", map[string]any{"url": "https://example.test/"}, nil, ""},
+		{"default unset", "port: ${PORT:-9999}\n", map[string]any{"port": uint64(9999)}, nil, ""},
+		{"default empty", "x: ${EMPTY:-def}\n", map[string]any{"x": "def"}, nil, ""},
+		{"default not used", "x: ${HOST:-def}\n", map[string]any{"x": "example.test"}, nil, ""},
+		{"quoted keeps string", "x: \"${PORT:-9999}\"\n", map[string]any{"x": "9999"}, nil, ""},
+		{"plain bool", "x: ${ON:-true}\n", map[string]any{"x": true}, nil, ""},
+		{"secret env", "t: ${HUB_TOKEN}\n", map[string]any{"t": "s3cr3t-token"}, []string{"s3cr3t-token"}, ""},
+		{"file", "k: ${file:/run/secrets/key}\n", map[string]any{"k": "file-secret"}, []string{"file-secret"}, ""},
+		{"short file", "k: ${file:/run/secrets/pin}\n", map[string]any{"k": uint64(42)}, nil, ""},
+		{"yaml in file", "k: ${file:/run/secrets/yaml}\nx: y\n", map[string]any{"k": "a: #b\n'\"c", "x": "y"}, []string{"a: #b\n'\"c"}, ""},
+		{"secret tag", "password: !secret hunter\n", map[string]any{"password": "hunter"}, []string{"hunter"}, ""},
+		{"secret tag expanded", "url: !secret https://${HOST}/hook\n", map[string]any{"url": "https://example.test/hook"}, []string{"https://example.test/hook"}, ""},
+		{"nested", "p:\n  - h: ${HOST}\n    l: |\n      ${HOST}\n", map[string]any{"p": []any{map[string]any{"h": "example.test", "l": "example.test\n"}}}, nil, ""},
+		{"escaped", "x: $${HOST}\n", map[string]any{"x": "${HOST}"}, nil, ""},
+		{"comment", "# ${UNDEFINED}\nx: y # ${UNDEFINED}\n", map[string]any{"x": "y"}, nil, ""},
+		{"unresolved", "a: 1\nx: ${UNDEFINED}\n", nil, nil, "line 2: ${UNDEFINED}: unresolved variable"},
+		{"missing file", "x: ${file:/nope}\n", nil, nil, "line 1: ${file:/nope}: unable to read secret file"},
+		{"empty name", "x: ${}\n", nil, nil, "empty variable name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parser.ParseBytes([]byte(tt.in), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ip := newIP()
+			node, err := ip.expand(f.Docs[0].Body)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expand() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expand() unexpected error: %v", err)
+			}
+			var got map[string]any
+			if err := yaml.NodeToValue(node, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expand() = %#v, want %#v", got, tt.want)
+			}
+			if strings.Join(ip.secrets, ",") != strings.Join(tt.wantSecrets, ",") {
+				t.Errorf("secrets = %v, want %v", ip.secrets, tt.wantSecrets)
+			}
+		})
+	}
+}
+
+func TestReadConfig_interpolation(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(secret, []byte("very-secret-value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HD_TEST_URL", "https://hub.example.test")
+
+	cfg, err := readConfig(strings.NewReader("server_url: ${HD_TEST_URL}\nkey: ${file:" + secret + "}\n"))
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+	if cfg.ServerURL != "https://hub.example.test" {
+		t.Errorf("ServerURL = %q", cfg.ServerURL)
+	}
+	if cfg.Key != "very-secret-value" {
+		t.Errorf("Key = %q", cfg.Key)
+	}
+
+	var buf bytes.Buffer
+	w := cfg.RedactWriter(&buf)
+	if _, err := w.Write([]byte("key is very-secret-value\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "key is "+redacted+"\n" {
+		t.Errorf("redacted output = %q", got)
+	}
+}
+
+func TestConfig_Redact(t *testing.T) {
+	var c Config
+	c.addSecrets([]string{"token", "hunter2"})
+	c.addSecrets([]string{"token-admin", "token"})
+	if got, want := c.secrets, []string{"token-admin", "hunter2", "token"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("secrets = %v, want %v", got, want)
+	}
+	got := c.Redact("token-admin:hunter2 token")
+	if want := redacted + ":" + redacted + " " + redacted; got != want {
+		t.Errorf("Redact() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package deploysrv
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+)
+
+// metaExt is the extension of the job metadata file, that is saved next to
+// the job output in the results directory.  It is not served by the
+// results handler.
+const metaExt = ".json"
+
+// jobMeta is the job metadata.
+type jobMeta struct {
+	ID       uuid.UUID         `json:"id"`
+	Name     string            `json:"name"`
+	Source   string            `json:"source,omitempty"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	Started  time.Time         `json:"started"`
+	Duration time.Duration     `json:"duration"`
+	Outcome  Outcome           `json:"outcome"`
+	Error    string            `json:"error,omitempty"`
+	// Steps are the results of the pipeline steps.
+	Steps []stepResult `json:"steps,omitempty"`
+	// Healthcheck is the result of the health check, if it has run.
+	Healthcheck *healthResult `json:"healthcheck,omitempty"`
+	// Rollback is the result of the on_failure command, if it has run.
+	Rollback *stepResult `json:"rollback,omitempty"`
+	// Callback is the callback delivery to the source system, nil, if
+	// there's no callback.
+	Callback *callbackMeta `json:"callback,omitempty"`
+}
+
+// callbackMeta is the callback delivery status.
+type callbackMeta struct {
+	// Status is one of CallbackPending, CallbackDelivered or CallbackFailed.
+	Status   string            `json:"status"`
+	Attempts []CallbackAttempt `json:"attempts"`
+}
+
+func (s *Server) metaFile(id uuid.UUID) string {
+	return filepath.Join(s.resultsDir, id.String()+metaExt)
+}
+
+// updateMeta updates the job metadata with fn, if the results directory is
+// set.  If there's no metadata yet, fn is called with the empty one.
+func (s *Server) updateMeta(id uuid.UUID, fn func(*jobMeta)) {
+	if s.resultsDir == "" {
+		return
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	m, err := s.loadMeta(id)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		dlog.Printf("%s> job metadata: %s", id, err)
+		return
+	}
+	m.ID = id
+	fn(&m)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		dlog.Printf("%s> job metadata: %s", id, err)
+		return
+	}
+	name := s.metaFile(id)
+	if err := os.WriteFile(name+".tmp", data, 0600); err != nil {
+		dlog.Printf("%s> job metadata: %s", id, err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		dlog.Printf("%s> job metadata: %s", id, err)
+	}
+}
+
+// loadMeta loads the job metadata.
+func (s *Server) loadMeta(id uuid.UUID) (jobMeta, error) {
+	var m jobMeta
+	data, err := os.ReadFile(s.metaFile(id))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
@@ -0,0 +1,89 @@
+package deploysrv
+
+import (
+	"io"
+	"net"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Listener defaults.
+const (
+	DefaultHost   = "127.0.0.1"
+	DefaultPort   = "9999"
+	DefaultPrefix = "/"
+)
+
+// Listen is the listener configuration.
+type Listen struct {
+	// Host is the host or IP address to bind to.
+	Host string `yaml:"host,omitempty"`
+	// Port is the port to listen on.
+	Port string `yaml:"port,omitempty"`
+	// Prefix is the API path prefix.
+	Prefix string `yaml:"prefix,omitempty"`
+	// Log is the log file or device, "-" for STDERR.  If empty, the log is
+	// written to the file named after the executable.
+	Log string `yaml:"log,omitempty"`
+}
+
+// Addr returns the listen address.
+func (l Listen) Addr() string {
+	return net.JoinHostPort(l.Host, l.Port)
+}
+
+// Overrides are the settings that take precedence over the config file, i.e.
+// environment variables or command line flags.  Empty values are ignored.
+type Overrides struct {
+	Listen
+	// Cert is the TLS certificate path.
+	Cert string
+	// Key is the TLS key path.
+	Key string
+}
+
+// ApplyOverrides applies the overrides in order, so that the latter take
+// precedence over the former, i.e. ApplyOverrides(env, flags) results in
+// flag over env over file.  Unset listener values are then set to defaults.
+func (c *Config) ApplyOverrides(oo ...Overrides) {
+	for _, o := range oo {
+		set(&c.Listen.Host, o.Host)
+		set(&c.Listen.Port, o.Port)
+		set(&c.Listen.Prefix, o.Prefix)
+		set(&c.Listen.Log, o.Log)
+		set(&c.Cert, o.Cert)
+		set(&c.Key, o.Key)
+	}
+	c.setDefaults()
+}
+
+// setDefaults sets the default values for the unset listener values.
+func (c *Config) setDefaults() {
+	def(&c.Listen.Host, DefaultHost)
+	def(&c.Listen.Port, DefaultPort)
+	def(&c.Listen.Prefix, DefaultPrefix)
+}
+
+// set sets the dst to val, if val is not empty.
+func set(dst *string, val string) {
+	if val != "" {
+		*dst = val
+	}
+}
+
+// def sets the dst to val, if dst is empty.
+func def(dst *string, val string) {
+	if *dst == "" {
+		*dst = val
+	}
+}
+
+// Print writes the configuration as YAML to w with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, c.Redact(string(data)))
+	return err
+}
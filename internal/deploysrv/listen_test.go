@@ -0,0 +1,83 @@
+package deploysrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfig_ApplyOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  Listen
+		env   Overrides
+		flags Overrides
+		want  Listen
+	}{
+		{
+			"defaults",
+			Listen{},
+			Overrides{},
+			Overrides{},
+			Listen{Host: DefaultHost, Port: DefaultPort, Prefix: DefaultPrefix},
+		},
+		{
+			"file",
+			Listen{Host: "0.0.0.0", Port: "8080", Prefix: "/api", Log: "-"},
+			Overrides{},
+			Overrides{},
+			Listen{Host: "0.0.0.0", Port: "8080", Prefix: "/api", Log: "-"},
+		},
+		{
+			"env over file",
+			Listen{Host: "0.0.0.0", Port: "8080"},
+			Overrides{Listen: Listen{Port: "8081"}},
+			Overrides{},
+			Listen{Host: "0.0.0.0", Port: "8081", Prefix: DefaultPrefix},
+		},
+		{
+			"flag over env",
+			Listen{Host: "0.0.0.0", Port: "8080"},
+			Overrides{Listen: Listen{Port: "8081", Prefix: "/env"}},
+			Overrides{Listen: Listen{Port: "8082"}},
+			Listen{Host: "0.0.0.0", Port: "8082", Prefix: "/env"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Listen: tt.file}
+			c.ApplyOverrides(tt.env, tt.flags)
+			if c.Listen != tt.want {
+				t.Errorf("Listen = %+v, want %+v", c.Listen, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_ApplyOverrides_cert(t *testing.T) {
+	c := &Config{Cert: "file.crt", Key: "file.key"}
+	c.ApplyOverrides(Overrides{Cert: "flag.crt"})
+	if c.Cert != "flag.crt" || c.Key != "file.key" {
+		t.Errorf("Cert, Key = %q, %q, want %q, %q", c.Cert, c.Key, "flag.crt", "file.key")
+	}
+}
+
+func TestConfig_Print(t *testing.T) {
+	c := &Config{
+		Key:     "very-secret-value",
+		Listen:  Listen{Host: "0.0.0.0", Port: "9999"},
+		secrets: []string{"very-secret-value"},
+	}
+	var buf strings.Builder
+	if err := c.Print(&buf); err != nil {
+		t.Fatalf("Print() error = %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "very-secret-value") {
+		t.Errorf("Print() output contains the secret:\n%s", out)
+	}
+	for _, want := range []string{"host: 0.0.0.0", `port: "9999"`, "key: " + redacted} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Print() output does not contain %q:\n%s", want, out)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package deploysrv
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -48,3 +49,14 @@ func logMiddleware(next http.Handler) http.Handler {
 func getIP(r *http.Request) string {
 	return r.RemoteAddr // for now
 }
+
+// audit writes the audit log record for the request, including the client
+// certificate subject, if any.
+func audit(r *http.Request, format string, a ...any) {
+	id, _ := reqIDFromContext(r.Context())
+	subject := clientSubject(r)
+	if subject == "" {
+		subject = "-"
+	}
+	dlog.Printf("[%s] AUDIT %s %s subject=%q ip=%s: %s", id, r.Method, r.URL.Path, subject, getIP(r), fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,439 @@
+package deploysrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+)
+
+// Notification events.
+const (
+	// EventStarted is the deployment start.  It is sent only to the
+	// destinations that subscribe to it explicitly.
+	EventStarted = "started"
+	// EventSuccess is the successful deployment.
+	EventSuccess = "success"
+	// EventFailure is the failed deployment.
+	EventFailure = "failure"
+	// EventRecovery is the successful deployment after a failed one.  It is
+	// sent to the destinations subscribed to either success or recovery.
+	EventRecovery = "recovery"
+)
+
+const (
+	// notify is the name of the spool directory in the state directory.
+	notify = "notify"
+
+	defNotifyRetries = 3
+	defNotifyQueueSz = 100
+	notifyTimeout    = 30 * time.Second
+)
+
+// notifyBackoff is the delay before the first retry, it doubles with each
+// attempt.
+var notifyBackoff = 2 * time.Second
+
+var notifierTypes = map[string]NotifierFactory{}
+
+// Notifier delivers the deployment result notifications to a destination.
+type Notifier interface {
+	// Notify must deliver the notification.  It may be called again with
+	// the same notification, if it returns an error.
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotifierFactory creates the Notifier from the destination payload.
+type NotifierFactory func(payload any) (Notifier, error)
+
+// RegisterNotifier registers the notifier type.  It must be called before
+// New.
+func RegisterNotifier(typ string, f NotifierFactory) error {
+	if typ == "" || f == nil {
+		return errors.New("programming error:  notifier is empty")
+	}
+	notifierTypes[typ] = f
+	return nil
+}
+
+// Notification is the deployment result notification.
+type Notification struct {
+	ID uuid.UUID
+	// Name is the name of the deployment.
+	Name string
+	// Event is one of the EventStarted, EventSuccess, EventFailure or
+	// EventRecovery, it is set by the server.
+	Event string
+	// Error is the deployment error, if it failed.
+	Error error
+	// Output is the deployment output.
+	Output []byte
+	// ResultsURL is the URL of the deployment results, if enabled.
+	ResultsURL string
+	// Trigger is the trigger of the job.
+	Trigger Trigger
+	// Duration is how long the deployment took.
+	Duration time.Duration
+	// Time is when the deployment has finished, or started, for the
+	// EventStarted.
+	Time time.Time
+}
+
+// Destination is the notification destination configuration.
+type Destination struct {
+	// Name is the unique name of the destination, used in logs.
+	Name string `yaml:"name"`
+	// Type is the notifier type, i.e. slack.
+	Type string `yaml:"type"`
+	// On is the list of events to notify on: started, success, failure and
+	// recovery.  If empty, notifies on failure and recovery.
+	On []string `yaml:"on,omitempty"`
+	// Deployments is the list of deployment names to notify about, if empty,
+	// notifies about all deployments.
+	Deployments []string `yaml:"deployments,omitempty"`
+	// Retries is the number of delivery attempts, defaults to 3.
+	Retries int `yaml:"retries,omitempty"`
+	// Backoff is the delay before the first retry, it doubles with each
+	// attempt.  Defaults to 2s.
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+	// Payload is the configuration of the notifier type.
+	Payload any `yaml:"payload"`
+}
+
+// validate validates the destination and sets the defaults.
+func (d *Destination) validate() error {
+	if d.Name == "" {
+		return errors.New("name is not set")
+	}
+	// the name is used as the spool directory name.
+	if !reName.MatchString(d.Name) {
+		return fmt.Errorf("invalid name %q", d.Name)
+	}
+	if len(d.On) == 0 {
+		d.On = []string{EventFailure, EventRecovery}
+	}
+	for _, ev := range d.On {
+		switch ev {
+		case EventStarted, EventSuccess, EventFailure, EventRecovery:
+		default:
+			return fmt.Errorf("unknown event: %q", ev)
+		}
+	}
+	if d.Retries < 0 {
+		return fmt.Errorf("invalid retries: %d", d.Retries)
+	}
+	if d.Retries == 0 {
+		d.Retries = defNotifyRetries
+	}
+	if d.Backoff < 0 {
+		return fmt.Errorf("invalid backoff: %s", d.Backoff)
+	}
+	if d.Backoff == 0 {
+		d.Backoff = notifyBackoff
+	}
+	return nil
+}
+
+// wants reports whether the destination is subscribed to the notification.
+func (d *Destination) wants(n Notification) bool {
+	if len(d.Deployments) > 0 && !slices.Contains(d.Deployments, n.Name) {
+		return false
+	}
+	if slices.Contains(d.On, n.Event) {
+		return true
+	}
+	// recovery is a success as well.
+	return n.Event == EventRecovery && slices.Contains(d.On, EventSuccess)
+}
+
+// notifier fans out the notifications to the destinations.  Each destination
+// has its own queue and the delivery goroutine, so that the slow one doesn't
+// delay the others.
+type notifier struct {
+	dests []*destination
+
+	mu     sync.Mutex
+	failed map[string]bool // deployment name -> the last run failed
+}
+
+type destination struct {
+	cfg Destination
+	n   Notifier
+	// dir is the spool directory of the pending deliveries, if empty, the
+	// deliveries are not persisted.
+	dir   string
+	queue chan *delivery
+}
+
+// delivery is the pending delivery of the notification.
+type delivery struct {
+	n Notification
+	// attempts is the number of the failed delivery attempts.
+	attempts int
+}
+
+// spooled is the pending delivery, persisted in the spool directory.
+type spooled struct {
+	ID         uuid.UUID     `json:"id"`
+	Name       string        `json:"name"`
+	Event      string        `json:"event"`
+	Error      string        `json:"error,omitempty"`
+	Output     []byte        `json:"output,omitempty"`
+	ResultsURL string        `json:"results_url,omitempty"`
+	Trigger    Trigger       `json:"trigger"`
+	Duration   time.Duration `json:"duration"`
+	Time       time.Time     `json:"time"`
+	Attempts   int           `json:"attempts"`
+}
+
+// newNotifier creates the notifiers for the destinations.  Invalid
+// destinations are skipped.  If the stateDir is set, the pending deliveries
+// are persisted in it, and the ones left from the previous run are
+// redelivered.  It returns nil, if there are no valid destinations.
+func newNotifier(dests []Destination, stateDir string) *notifier {
+	nt := &notifier{failed: make(map[string]bool)}
+	seen := make(map[string]bool, len(dests))
+	for i, d := range dests {
+		if err := d.validate(); err != nil {
+			dlog.Printf("notification #%d %q: %s, skipping", i+1, d.Name, err)
+			continue
+		}
+		if seen[d.Name] {
+			dlog.Printf("notification #%d: duplicate name %q, skipping", i+1, d.Name)
+			continue
+		}
+		f, ok := notifierTypes[d.Type]
+		if !ok {
+			dlog.Printf("notification %q: unregistered notifier type %q, skipping", d.Name, d.Type)
+			continue
+		}
+		n, err := f(d.Payload)
+		if err != nil {
+			dlog.Printf("notification %q: unable to create %q notifier: %s, skipping", d.Name, d.Type, err)
+			continue
+		}
+		seen[d.Name] = true
+		dst := &destination{cfg: d, n: n, queue: make(chan *delivery, defNotifyQueueSz)}
+		if stateDir != "" {
+			dst.dir = filepath.Join(stateDir, notify, d.Name)
+		}
+		pending, err := dst.restore()
+		if err != nil {
+			dlog.Printf("notification %q: unable to restore pending deliveries: %s", d.Name, err)
+		} else if len(pending) > 0 {
+			dlog.Printf("notification %q: %d pending deliveries restored", d.Name, len(pending))
+		}
+		go dst.deliver(pending)
+		nt.dests = append(nt.dests, dst)
+	}
+	if len(nt.dests) == 0 {
+		return nil
+	}
+	return nt
+}
+
+// event returns the notification event of the deployment result, and
+// remembers the outcome for the recovery detection.
+func (nt *notifier) event(name string, err error) string {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	wasFailed := nt.failed[name]
+	nt.failed[name] = err != nil
+	switch {
+	case err != nil:
+		return EventFailure
+	case wasFailed:
+		return EventRecovery
+	default:
+		return EventSuccess
+	}
+}
+
+// started queues the deployment start notification.
+func (nt *notifier) started(n Notification) {
+	if nt == nil {
+		return
+	}
+	n.Event = EventStarted
+	nt.enqueue(n)
+}
+
+// notify sets the notification event of the deployment result, and queues
+// the notification.
+func (nt *notifier) notify(n Notification) {
+	if nt == nil {
+		return
+	}
+	n.Event = nt.event(n.Name, n.Error)
+	nt.enqueue(n)
+}
+
+// enqueue queues the notification for all subscribed destinations.  It never
+// blocks, if the destination queue is full, the notification is dropped.
+func (nt *notifier) enqueue(n Notification) {
+	for _, d := range nt.dests {
+		if !d.cfg.wants(n) {
+			continue
+		}
+		dl := &delivery{n: n}
+		d.save(dl)
+		select {
+		case d.queue <- dl:
+		default:
+			dlog.Printf("%s> notification %q: queue is full, dropping %s notification", n.ID, d.cfg.Name, n.Event)
+			d.remove(dl)
+		}
+	}
+}
+
+// deliver delivers the pending deliveries, and then the queued ones.
+func (d *destination) deliver(pending []*delivery) {
+	for _, dl := range pending {
+		d.process(dl)
+	}
+	for dl := range d.queue {
+		d.process(dl)
+	}
+}
+
+// process sends the notification, and removes the delivery from the spool,
+// whatever the outcome.
+func (d *destination) process(dl *delivery) {
+	if err := d.send(dl); err != nil {
+		dlog.Printf("%s> notification %q: giving up after %d attempts: %s", dl.n.ID, d.cfg.Name, dl.attempts, err)
+	}
+	d.remove(dl)
+}
+
+// send sends the notification, retrying with the exponential backoff.  The
+// failed attempts are persisted, so that the delivery resumes where it has
+// left off after the restart.
+func (d *destination) send(dl *delivery) error {
+	err := errors.New("no attempts left")
+	delay := d.cfg.Backoff
+	for i := 1; i < dl.attempts; i++ {
+		delay *= 2
+	}
+	for dl.attempts < d.cfg.Retries {
+		if dl.attempts > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		err = d.n.Notify(ctx, dl.n)
+		cancel()
+		if err == nil {
+			dlog.Debugf("%s> notification %q: %s notification delivered", dl.n.ID, d.cfg.Name, dl.n.Event)
+			return nil
+		}
+		dl.attempts++
+		dlog.Printf("%s> notification %q: attempt %d/%d: %s", dl.n.ID, d.cfg.Name, dl.attempts, d.cfg.Retries, err)
+		d.save(dl)
+	}
+	return err
+}
+
+// spoolFile returns the spool file name of the delivery.
+func (d *destination) spoolFile(dl *delivery) string {
+	return filepath.Join(d.dir, dl.n.ID.String()+"-"+dl.n.Event+".json")
+}
+
+// save persists the delivery in the spool directory, if it's set.
+func (d *destination) save(dl *delivery) {
+	if d.dir == "" {
+		return
+	}
+	n := dl.n
+	sp := spooled{
+		ID:         n.ID,
+		Name:       n.Name,
+		Event:      n.Event,
+		Output:     n.Output,
+		ResultsURL: n.ResultsURL,
+		Trigger:    n.Trigger,
+		Duration:   n.Duration,
+		Time:       n.Time,
+		Attempts:   dl.attempts,
+	}
+	if n.Error != nil {
+		sp.Error = n.Error.Error()
+	}
+	data, err := json.Marshal(sp)
+	if err != nil {
+		dlog.Printf("%s> notification %q: %s", n.ID, d.cfg.Name, err)
+		return
+	}
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		dlog.Printf("%s> notification %q: %s", n.ID, d.cfg.Name, err)
+		return
+	}
+	name := d.spoolFile(dl)
+	if err := os.WriteFile(name+".tmp", data, 0600); err != nil {
+		dlog.Printf("%s> notification %q: %s", n.ID, d.cfg.Name, err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		dlog.Printf("%s> notification %q: %s", n.ID, d.cfg.Name, err)
+	}
+}
+
+// remove removes the delivery from the spool directory.
+func (d *destination) remove(dl *delivery) {
+	if d.dir == "" {
+		return
+	}
+	if err := os.Remove(d.spoolFile(dl)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		dlog.Printf("%s> notification %q: %s", dl.n.ID, d.cfg.Name, err)
+	}
+}
+
+// restore returns the pending deliveries from the spool directory, oldest
+// first.
+func (d *destination) restore() ([]*delivery, error) {
+	if d.dir == "" {
+		return nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var pending []*delivery
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var sp spooled
+		if err := json.Unmarshal(data, &sp); err != nil {
+			dlog.Printf("notification %q: %s: %s, skipping", d.cfg.Name, filepath.Base(name), err)
+			continue
+		}
+		n := Notification{
+			ID:         sp.ID,
+			Name:       sp.Name,
+			Event:      sp.Event,
+			Output:     sp.Output,
+			ResultsURL: sp.ResultsURL,
+			Trigger:    sp.Trigger,
+			Duration:   sp.Duration,
+			Time:       sp.Time,
+		}
+		if sp.Error != "" {
+			n.Error = errors.New(sp.Error)
+		}
+		pending = append(pending, &delivery{n: n, attempts: sp.Attempts})
+	}
+	slices.SortStableFunc(pending, func(a, b *delivery) int {
+		return a.n.Time.Compare(b.n.Time)
+	})
+	return pending, nil
+}
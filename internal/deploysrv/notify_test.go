@@ -0,0 +1,219 @@
+package deploysrv
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// stubNotifier fails the first failN deliveries, and records the delivered
+// notifications.
+type stubNotifier struct {
+	mu        sync.Mutex
+	failN     int
+	attempts  int
+	delivered chan Notification
+}
+
+func (s *stubNotifier) Notify(_ context.Context, n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.attempts <= s.failN {
+		return errors.New("destination down")
+	}
+	s.delivered <- n
+	return nil
+}
+
+func withNotifierTypes(t *testing.T, stubs map[string]*stubNotifier) {
+	t.Helper()
+	old, oldBackoff := notifierTypes, notifyBackoff
+	notifierTypes = make(map[string]NotifierFactory)
+	notifyBackoff = time.Millisecond
+	t.Cleanup(func() {
+		notifierTypes, notifyBackoff = old, oldBackoff
+	})
+	RegisterNotifier("stub", func(payload any) (Notifier, error) {
+		name, _ := payload.(string)
+		n, ok := stubs[name]
+		if !ok {
+			return nil, errors.New("no such stub")
+		}
+		return n, nil
+	})
+}
+
+func TestDestination_wants(t *testing.T) {
+	tests := []struct {
+		name string
+		dest Destination
+		n    Notification
+		want bool
+	}{
+		{"default failure", Destination{}, Notification{Event: EventFailure}, true},
+		{"default recovery", Destination{}, Notification{Event: EventRecovery}, true},
+		{"default success", Destination{}, Notification{Event: EventSuccess}, false},
+		{"success includes recovery", Destination{On: []string{EventSuccess}}, Notification{Event: EventRecovery}, true},
+		{"recovery only", Destination{On: []string{EventRecovery}}, Notification{Event: EventSuccess}, false},
+		{"deployment filter", Destination{Deployments: []string{"web"}}, Notification{Name: "api", Event: EventFailure}, false},
+		{"deployment match", Destination{Deployments: []string{"web"}}, Notification{Name: "web", Event: EventFailure}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dest.Name = "test"
+			if err := tt.dest.validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.dest.wants(tt.n); got != tt.want {
+				t.Errorf("wants() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	stubs := map[string]*stubNotifier{"ok": {}}
+	withNotifierTypes(t, stubs)
+
+	tests := []struct {
+		name      string
+		dests     []Destination
+		wantDests int
+	}{
+		{"none", nil, 0},
+		{"valid", []Destination{{Name: "a", Type: "stub", Payload: "ok"}}, 1},
+		{"unknown type", []Destination{{Name: "a", Type: "pager", Payload: "ok"}}, 0},
+		{"factory error", []Destination{{Name: "a", Type: "stub", Payload: "missing"}}, 0},
+		{"no name", []Destination{{Type: "stub", Payload: "ok"}}, 0},
+		{"path in name", []Destination{{Name: "../a", Type: "stub", Payload: "ok"}}, 0},
+		{"dot dot name", []Destination{{Name: "..", Type: "stub", Payload: "ok"}}, 0},
+		{"unknown event", []Destination{{Name: "a", Type: "stub", On: []string{"deployed"}, Payload: "ok"}}, 0},
+		{"duplicate", []Destination{{Name: "a", Type: "stub", Payload: "ok"}, {Name: "a", Type: "stub", Payload: "ok"}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int
+			if nt := newNotifier(tt.dests, ""); nt != nil {
+				got = len(nt.dests)
+			}
+			if got != tt.wantDests {
+				t.Errorf("destinations = %d, want %d", got, tt.wantDests)
+			}
+		})
+	}
+}
+
+func TestNotifier_notify(t *testing.T) {
+	stubs := map[string]*stubNotifier{
+		"all":   {delivered: make(chan Notification, 10)},
+		"flaky": {delivered: make(chan Notification, 10), failN: 2},
+	}
+	withNotifierTypes(t, stubs)
+
+	nt := newNotifier([]Destination{
+		{Name: "everything", Type: "stub", On: []string{EventStarted, EventSuccess, EventFailure}, Payload: "all"},
+		{Name: "alerts", Type: "stub", Retries: 3, Payload: "flaky"},
+	}, "")
+	if nt == nil {
+		t.Fatal("notifier is nil")
+	}
+
+	errDeploy := errors.New("exit status 1")
+	nt.started(Notification{Name: "web"})
+	for _, err := range []error{nil, errDeploy, nil, nil} {
+		nt.notify(Notification{Name: "web", Error: err})
+	}
+
+	wantEvents := func(name string, ch chan Notification, want ...string) {
+		t.Helper()
+		for i, w := range want {
+			select {
+			case n := <-ch:
+				if n.Event != w {
+					t.Errorf("%s: notification[%d] event = %q, want %q", name, i, n.Event, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timed out waiting for notification[%d]", name, i)
+			}
+		}
+		select {
+		case n := <-ch:
+			t.Errorf("%s: unexpected notification %+v", name, n)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	wantEvents("everything", stubs["all"].delivered, EventStarted, EventSuccess, EventFailure, EventRecovery, EventSuccess)
+	// the failure is delivered on the third attempt.
+	wantEvents("alerts", stubs["flaky"].delivered, EventFailure, EventRecovery)
+}
+
+func TestDestination_send_givesUp(t *testing.T) {
+	stub := &stubNotifier{failN: 10}
+	withNotifierTypes(t, map[string]*stubNotifier{"down": stub})
+
+	d := &destination{cfg: Destination{Name: "down", Retries: 3}, n: stub}
+	if err := d.send(&delivery{n: Notification{Event: EventFailure}}); err == nil {
+		t.Fatal("send() expected error")
+	}
+	if stub.attempts != 3 {
+		t.Errorf("attempts = %d, want 3", stub.attempts)
+	}
+}
+
+func TestNotifier_spool(t *testing.T) {
+	stub := &stubNotifier{failN: 2, delivered: make(chan Notification, 1)}
+	withNotifierTypes(t, map[string]*stubNotifier{"flaky": stub})
+	stateDir := t.TempDir()
+
+	// the delivery that has failed twice before the restart.
+	d := &destination{
+		cfg: Destination{Name: "hooks", Retries: 3},
+		dir: filepath.Join(stateDir, notify, "hooks"),
+	}
+	n := Notification{
+		ID:      uuid.Must(uuid.NewUUID()),
+		Name:    "web",
+		Event:   EventFailure,
+		Error:   errors.New("exit status 1"),
+		Output:  []byte("boom\n"),
+		Trigger: Trigger{Source: "dockerhub", Vars: map[string]string{"tag": "v1"}},
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	d.save(&delivery{n: n, attempts: 2})
+	stub.attempts = 2
+
+	nt := newNotifier([]Destination{{Name: "hooks", Type: "stub", Retries: 3, Payload: "flaky"}}, stateDir)
+	if nt == nil {
+		t.Fatal("notifier is nil")
+	}
+	select {
+	case got := <-stub.delivered:
+		if got.ID != n.ID || got.Event != n.Event || got.Error.Error() != n.Error.Error() ||
+			string(got.Output) != string(n.Output) || got.Trigger.Vars["tag"] != "v1" || !got.Time.Equal(n.Time) {
+			t.Errorf("restored notification = %+v, want %+v", got, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the restored notification")
+	}
+	// the spool file is removed after the delivery.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(d.dir, "*"))
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spool files are not removed: %v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stub.attempts != 3 {
+		t.Errorf("attempts = %d, want 3", stub.attempts)
+	}
+}
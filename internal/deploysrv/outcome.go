@@ -0,0 +1,59 @@
+package deploysrv
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// Outcome statuses.
+const (
+	// OutcomeSuccess is the command that exited with zero code.
+	OutcomeSuccess = "success"
+	// OutcomeFailure is the command that exited with non-zero code, or was
+	// killed by a signal, or the deployment, that failed the health check.
+	OutcomeFailure = "failure"
+	// OutcomeError is the deployment that couldn't run, i.e. the workdir is
+	// missing or the command is not found.
+	OutcomeError = "error"
+	// OutcomeTimeout is the command that was killed after the deployment
+	// timeout.
+	OutcomeTimeout = "timeout"
+)
+
+// Outcome is the outcome of the deployment.
+type Outcome struct {
+	// Status is one of OutcomeSuccess, OutcomeFailure, OutcomeError or
+	// OutcomeTimeout.
+	Status string `json:"status"`
+	// ExitCode is the exit code of the command, or -1, if it hasn't exited,
+	// was killed by a signal, or the health check has failed.
+	ExitCode int `json:"exit_code"`
+}
+
+// newOutcome classifies the result of the command run with the context ctx.
+func newOutcome(ctx context.Context, err error) Outcome {
+	if err == nil {
+		return Outcome{Status: OutcomeSuccess}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return Outcome{Status: OutcomeTimeout, ExitCode: -1}
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return Outcome{Status: OutcomeFailure, ExitCode: ee.ExitCode()}
+	}
+	return Outcome{Status: OutcomeError, ExitCode: -1}
+}
+
+// Status returns the outcome status of the job.  If the outcome is not set,
+// it is derived from the Error.
+func (d CallbackData) Status() string {
+	if d.Outcome.Status != "" {
+		return d.Outcome.Status
+	}
+	if d.Error != nil {
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
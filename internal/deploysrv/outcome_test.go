@@ -0,0 +1,80 @@
+package deploysrv
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestServer_runDeployment_outcome(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		dep     Deployment
+		want    Outcome
+		wantErr bool
+	}{
+		{"success", Deployment{Workdir: dir, Command: []string{"true"}}, Outcome{Status: OutcomeSuccess}, false},
+		{"failure", Deployment{Workdir: dir, Command: []string{"sh", "-c", "exit 3"}}, Outcome{Status: OutcomeFailure, ExitCode: 3}, true},
+		{"killed by signal", Deployment{Workdir: dir, Command: []string{"sh", "-c", "kill -KILL $$"}}, Outcome{Status: OutcomeFailure, ExitCode: -1}, true},
+		{"missing workdir", Deployment{Workdir: filepath.Join(dir, "nope"), Command: []string{"true"}}, Outcome{Status: OutcomeError, ExitCode: -1}, true},
+		{"missing command", Deployment{Workdir: dir, Command: []string{"./no-such-command"}}, Outcome{Status: OutcomeError, ExitCode: -1}, true},
+		{"timeout", Deployment{Workdir: dir, Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}, Outcome{Status: OutcomeTimeout, ExitCode: -1}, true},
+		{"within timeout", Deployment{Workdir: dir, Command: []string{"true"}, Timeout: 5 * time.Second}, Outcome{Status: OutcomeSuccess}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dep.Name = "test"
+			var s Server
+			r := s.runDeployment(uuid.Must(uuid.NewUUID()), tt.dep, Trigger{})
+			if (r.err != nil) != tt.wantErr {
+				t.Fatalf("runDeployment() error = %v, wantErr %v", r.err, tt.wantErr)
+			}
+			if r.outcome != tt.want {
+				t.Errorf("runDeployment() outcome = %+v, want %+v", r.outcome, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_runDeployment_errorOutput(t *testing.T) {
+	var s Server
+	r := s.runDeployment(uuid.Must(uuid.NewUUID()), Deployment{
+		Name:    "test",
+		Workdir: t.TempDir(),
+		Command: []string{"sh", "-c", "echo password=hunter2; exit 1"},
+	}, Trigger{})
+	if r.err == nil {
+		t.Fatal("runDeployment() error = nil, want error")
+	}
+	if strings.Contains(r.err.Error(), "hunter2") {
+		t.Errorf("error contains the output: %q", r.err)
+	}
+	if !strings.Contains(string(r.output), "hunter2") {
+		t.Errorf("output = %q, want the command output", r.output)
+	}
+}
+
+func TestCallbackData_Status(t *testing.T) {
+	errDeploy := errors.New("exit status 1")
+	tests := []struct {
+		name string
+		data CallbackData
+		want string
+	}{
+		{"outcome", CallbackData{Outcome: Outcome{Status: OutcomeTimeout}, Error: errDeploy}, OutcomeTimeout},
+		{"no outcome, ok", CallbackData{}, OutcomeSuccess},
+		{"no outcome, error", CallbackData{Error: errDeploy}, OutcomeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.data.Status(); got != tt.want {
+				t.Errorf("Status() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package deploysrv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+)
+
+const (
+	// onFailure is the name of the rollback step in the results.
+	onFailure = "on_failure"
+	// prevEnvPrefix is the prefix of the environment variables with the
+	// trigger variables of the last successful deployment.
+	prevEnvPrefix = envPrefix + "PREV_"
+	// defOnFailureTimeout is the timeout of the on_failure command, if
+	// neither it, nor the deployment has one.
+	defOnFailureTimeout = 10 * time.Minute
+)
+
+// rollback runs the on_failure command of the failed deployment, and appends
+// its output to the job output as a separate section.  The command gets the
+// trigger variables of the failed job, as usual, and the ones of the last
+// successful deployment with HUBDEPLOY_PREV_ prefix, if it's known.  The
+// deployment timeout may have already expired, so the command is limited by
+// its own timeout, or, if it's not set, gets the fresh deployment timeout, or
+// defOnFailureTimeout, if the deployment has none.
+func (s *Server) rollback(id uuid.UUID, d Deployment, t Trigger, r *run) {
+	st := *d.OnFailure
+	if st.Name == "" {
+		st.Name = onFailure
+	}
+	if st.Timeout == 0 {
+		st.Timeout = d.Timeout
+		if st.Timeout == 0 {
+			st.Timeout = defOnFailureTimeout
+		}
+	}
+	st.Env = make(map[string]string, len(d.OnFailure.Env))
+	if prev, ok := s.deployed.last(d.Name); ok {
+		dlog.Printf("%s> [%s] running %s, last successful deployment: %s", id, d.Name, onFailure, prev.ID)
+		for k, v := range prev.env() {
+			st.Env[k] = v
+		}
+	} else {
+		dlog.Printf("%s> [%s] running %s, last successful deployment is unknown", id, d.Name, onFailure)
+	}
+	for k, v := range d.OnFailure.Env {
+		st.Env[k] = v
+	}
+
+	sr := runStep(context.Background(), d.Workdir, st, t)
+	sr.Name = st.Name
+	if sr.err != nil {
+		dlog.Printf("%s> [%s] %s failed: %s", id, d.Name, onFailure, sr.err)
+	}
+
+	var buf bytes.Buffer
+	writeOutput(&buf, r.output)
+	fmt.Fprintf(&buf, "==> %s\n", sr.Name)
+	writeOutput(&buf, sr.output)
+	fmt.Fprintf(&buf, "<== %s: %s in %s\n", sr.Name, stepStatus(sr.Outcome), sr.Duration.Round(time.Millisecond))
+	r.output = buf.Bytes()
+	r.rollback = &sr
+}
@@ -0,0 +1,115 @@
+package deploysrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestServer_runDeployment_onFailure(t *testing.T) {
+	dir := t.TempDir()
+	prevID := uuid.Must(uuid.NewUUID())
+	rollback := &Step{Command: []string{"sh", "-c", "echo rolling back from $HUBDEPLOY_TAG to $HUBDEPLOY_PREV_TAG $HUBDEPLOY_PREV_ID; exit $RB_EXIT"}, Env: map[string]string{"RB_EXIT": "0"}}
+
+	tests := []struct {
+		name         string
+		dep          Deployment
+		prev         bool
+		wantRollback string
+		wantOutput   []string
+	}{
+		{
+			"failure",
+			Deployment{Command: []string{"sh", "-c", "echo pulling; exit 1"}, OnFailure: rollback},
+			true,
+			OutcomeSuccess,
+			[]string{"pulling\n==> on_failure\nrolling back from v2 to v1 " + prevID.String() + "\n<== on_failure: success in "},
+		},
+		{
+			"timeout",
+			Deployment{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond, OnFailure: rollback},
+			true,
+			OutcomeSuccess,
+			[]string{"rolling back from v2 to v1"},
+		},
+		{
+			"unknown previous",
+			Deployment{Command: []string{"false"}, OnFailure: rollback},
+			false,
+			OutcomeSuccess,
+			[]string{"==> on_failure\nrolling back from v2 to\n"},
+		},
+		{
+			"rollback fails",
+			Deployment{Command: []string{"false"}, OnFailure: &Step{Name: "restore", Command: rollback.Command, Env: map[string]string{"RB_EXIT": "4"}}},
+			true,
+			OutcomeFailure,
+			[]string{"==> restore\n", "<== restore: failure (exit code 4) in "},
+		},
+		{
+			"rollback times out",
+			Deployment{Command: []string{"false"}, Timeout: 100 * time.Millisecond, OnFailure: &Step{Command: []string{"sleep", "5"}}},
+			true,
+			OutcomeTimeout,
+			[]string{"==> on_failure\n"},
+		},
+		{
+			"success",
+			Deployment{Command: []string{"echo", "ok"}, OnFailure: rollback},
+			true,
+			"",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dep.Name, tt.dep.Workdir = "test", dir
+			s := Server{deployed: newDeployedStore("")}
+			if tt.prev {
+				s.deployed.add("test", deployedVersion{ID: prevID, Vars: map[string]string{"tag": "v1"}})
+			}
+			r := s.runDeployment(uuid.Must(uuid.NewUUID()), tt.dep, Trigger{Vars: map[string]string{"tag": "v2"}})
+			if tt.wantRollback == "" {
+				if r.rollback != nil || strings.Contains(string(r.output), "on_failure") {
+					t.Errorf("rollback has run: %+v\n%s", r.rollback, r.output)
+				}
+				return
+			}
+			if r.err == nil || r.outcome.Status == OutcomeSuccess {
+				t.Errorf("outcome = %+v, error = %v, want the deployment failure", r.outcome, r.err)
+			}
+			if r.rollback == nil || r.rollback.Status != tt.wantRollback {
+				t.Fatalf("rollback = %+v, want %s", r.rollback, tt.wantRollback)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(string(r.output), want) {
+					t.Errorf("output does not contain %q:\n%s", want, r.output)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_dispatcher_history(t *testing.T) {
+	dir := t.TempDir()
+	s := Server{deployed: newDeployedStore("")}
+	results := make(chan result, 2)
+	jobs := make(chan Job, 2)
+	var done []error
+	jobs <- Job{Dep: Deployment{Name: "web", Workdir: dir, Command: []string{"true"}}, Trigger: Trigger{Vars: map[string]string{"tag": "v1"}}, Done: func(err error) { done = append(done, err) }}
+	jobs <- Job{Dep: Deployment{Name: "web", Workdir: dir, Command: []string{"false"}}, Trigger: Trigger{Vars: map[string]string{"tag": "v2"}}, Done: func(err error) { done = append(done, err) }}
+	close(jobs)
+	s.dispatcher(results, jobs)
+
+	if len(done) != 2 || done[0] != nil || done[1] == nil {
+		t.Errorf("Done() called with %v, want [<nil> error]", done)
+	}
+
+	good := <-results
+	history := s.deployed.list("web")
+	if len(history) != 1 || history[0].ID != good.id || history[0].Vars["tag"] != "v1" {
+		t.Errorf("history = %+v, want job %s with tag v1", history, good.id)
+	}
+}
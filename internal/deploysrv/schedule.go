@@ -0,0 +1,291 @@
+package deploysrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rusq/dlog"
+)
+
+// schedule is the trigger source of the scheduled jobs.
+const schedule = "schedule"
+
+// Missed run policies.
+const (
+	// MissedSkip skips the runs, that were missed while the server was down
+	// or suspended.
+	MissedSkip = "skip"
+	// MissedCatchUp runs the deployment once, if any runs were missed.
+	MissedCatchUp = "catch-up"
+)
+
+// missedGrace is how late the run may start before it's considered missed.
+const missedGrace = time.Minute
+
+// Schedule is the deployment schedule.
+type Schedule struct {
+	// Cron is the cron expression, i.e. "30 3 * * *", or a descriptor, i.e.
+	// "@daily".
+	Cron string `yaml:"cron"`
+	// Timezone is the IANA time zone name of the cron expression, i.e.
+	// "Europe/London", defaults to the local time zone.
+	Timezone string `yaml:"timezone,omitempty"`
+	// Missed is the missed runs policy: "skip" (default) or "catch-up".  The
+	// last run time is persisted only if the state directory is set,
+	// otherwise the runs missed while the server was down are not detected.
+	Missed string `yaml:"missed,omitempty"`
+
+	spec *cronSpec
+	loc  *time.Location
+}
+
+// init parses and validates the schedule.
+func (sc *Schedule) init() error {
+	var err error
+	if sc.spec, err = parseCron(sc.Cron); err != nil {
+		return err
+	}
+	// LoadLocation returns UTC for the empty name.
+	sc.loc = time.Local
+	if sc.Timezone != "" {
+		if sc.loc, err = time.LoadLocation(sc.Timezone); err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+	}
+	switch sc.Missed {
+	case "":
+		sc.Missed = MissedSkip
+	case MissedSkip, MissedCatchUp:
+	default:
+		return fmt.Errorf("schedule: invalid missed runs policy: %q", sc.Missed)
+	}
+	return nil
+}
+
+// next returns the next run time after t.
+func (sc *Schedule) next(t time.Time) (time.Time, error) {
+	return sc.spec.next(t.In(sc.loc))
+}
+
+// scheduler pushes the jobs of the scheduled deployments.
+type scheduler struct {
+	// dir is the directory, where the last run times are stored, if empty,
+	// they are not persisted.
+	dir     string
+	entries []*schedEntry
+
+	// now and after are replaced in tests.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+type schedEntry struct {
+	dep Deployment
+
+	mu   sync.Mutex
+	next time.Time
+	last time.Time
+}
+
+// scheduleInfo is the API representation of the schedule.
+type scheduleInfo struct {
+	Name     string     `json:"name"`
+	Cron     string     `json:"cron"`
+	Timezone string     `json:"timezone"`
+	Missed   string     `json:"missed"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+}
+
+// newScheduler returns the scheduler for the enabled deployments with a
+// schedule, or nil, if there are none.
+func newScheduler(deps []Deployment, stateDir string) *scheduler {
+	sc := &scheduler{now: time.Now, after: time.After}
+	if stateDir != "" {
+		sc.dir = filepath.Join(stateDir, schedule)
+	}
+	for _, d := range deps {
+		if d.Disabled || d.Schedule == nil {
+			continue
+		}
+		e := &schedEntry{dep: d}
+		last, err := sc.loadLast(d.Name)
+		if err != nil {
+			dlog.Printf("[%s] schedule: %s", d.Name, err)
+		}
+		e.last = last
+		sc.entries = append(sc.entries, e)
+	}
+	if len(sc.entries) == 0 {
+		return nil
+	}
+	return sc
+}
+
+// run runs the schedules until the context is cancelled.
+func (sc *scheduler) run(ctx context.Context, jobs chan<- Job) {
+	var wg sync.WaitGroup
+	for _, e := range sc.entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.runEntry(ctx, e, jobs)
+		}()
+	}
+	wg.Wait()
+}
+
+// runEntry waits for the next run time of the entry and queues the job.
+func (sc *scheduler) runEntry(ctx context.Context, e *schedEntry, jobs chan<- Job) {
+	sched := e.dep.Schedule
+	dlog.Printf("[%s] scheduled %q (%s), missed runs policy: %s", e.dep.Name, sched.Cron, sched.loc, sched.Missed)
+
+	e.mu.Lock()
+	prev := e.last
+	e.mu.Unlock()
+	if sched.Missed == MissedCatchUp && !prev.IsZero() {
+		if due, err := sched.next(prev); err == nil && !due.After(sc.now()) {
+			dlog.Printf("[%s] missed the run at %s, catching up", e.dep.Name, due)
+			if !sc.fire(ctx, e, jobs, due, true) {
+				return
+			}
+			prev = due
+		}
+	}
+
+	for {
+		// the wall clock may be slightly behind the timer, never schedule
+		// the same run twice.
+		from := sc.now()
+		if from.Before(prev) {
+			from = prev
+		}
+		next, err := sched.next(from)
+		if err != nil {
+			dlog.Printf("[%s] %s", e.dep.Name, err)
+			return
+		}
+		e.mu.Lock()
+		e.next = next
+		e.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.after(next.Sub(sc.now())):
+		}
+		prev = next
+
+		late := sc.now().Sub(next) > missedGrace
+		if late && sched.Missed == MissedSkip {
+			dlog.Printf("[%s] missed the run at %s, skipping", e.dep.Name, next)
+			sc.setLast(e, next)
+			continue
+		}
+		if !sc.fire(ctx, e, jobs, next, late) {
+			return
+		}
+	}
+}
+
+// fire queues the job for the run scheduled at the given time, and records
+// the run.  It returns false, if the context was cancelled.
+func (sc *scheduler) fire(ctx context.Context, e *schedEntry, jobs chan<- Job, at time.Time, catchUp bool) bool {
+	dlog.Printf("[%s] scheduled run at %s, queueing deployment", e.dep.Name, at)
+	vars := map[string]string{"scheduled": at.Format(time.RFC3339)}
+	if catchUp {
+		vars["catch_up"] = "true"
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case jobs <- Job{Dep: e.dep, Trigger: Trigger{Source: schedule, Vars: vars}}:
+	}
+	sc.setLast(e, at)
+	return true
+}
+
+// setLast records the last run time, and persists it, if the state
+// directory is set.
+func (sc *scheduler) setLast(e *schedEntry, t time.Time) {
+	e.mu.Lock()
+	e.last = t
+	e.mu.Unlock()
+	if sc.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(sc.dir, 0755); err != nil {
+		dlog.Printf("[%s] schedule: %s", e.dep.Name, err)
+		return
+	}
+	name := sc.stateFile(e.dep.Name)
+	if err := os.WriteFile(name+".tmp", []byte(t.Format(time.RFC3339)+"\n"), 0644); err != nil {
+		dlog.Printf("[%s] schedule: %s", e.dep.Name, err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		dlog.Printf("[%s] schedule: %s", e.dep.Name, err)
+	}
+}
+
+// loadLast returns the persisted last run time of the deployment, or zero
+// time, if it's unknown.
+func (sc *scheduler) loadLast(name string) (time.Time, error) {
+	if sc.dir == "" {
+		return time.Time{}, nil
+	}
+	data, err := os.ReadFile(sc.stateFile(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+}
+
+func (sc *scheduler) stateFile(name string) string {
+	return filepath.Join(sc.dir, name+".last")
+}
+
+// list returns the schedules sorted by the next run time.
+func (sc *scheduler) list() []scheduleInfo {
+	if sc == nil {
+		return []scheduleInfo{}
+	}
+	list := make([]scheduleInfo, 0, len(sc.entries))
+	for _, e := range sc.entries {
+		sched := e.dep.Schedule
+		si := scheduleInfo{
+			Name:     e.dep.Name,
+			Cron:     sched.Cron,
+			Timezone: sched.loc.String(),
+			Missed:   sched.Missed,
+		}
+		e.mu.Lock()
+		if !e.next.IsZero() {
+			next := e.next
+			si.NextRun = &next
+		}
+		if !e.last.IsZero() {
+			last := e.last.In(sched.loc)
+			si.LastRun = &last
+		}
+		e.mu.Unlock()
+		list = append(list, si)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].NextRun == nil || list[j].NextRun == nil {
+			return list[i].NextRun != nil
+		}
+		return list[i].NextRun.Before(*list[j].NextRun)
+	})
+	return list
+}
@@ -0,0 +1,250 @@
+package deploysrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is the clock, that jumps to the requested time, when the
+// scheduler waits, plus the lag on the first wait.
+type fakeClock struct {
+	mu  sync.Mutex
+	t   time.Time
+	lag time.Duration
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d + c.lag)
+	c.lag = 0
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+// collect runs the scheduler until n jobs are received.
+func collect(t *testing.T, sc *scheduler, n int) []Job {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan Job)
+	done := make(chan struct{})
+	go func() {
+		sc.run(ctx, jobs)
+		close(done)
+	}()
+	var got []Job
+	for len(got) < n {
+		select {
+		case j := <-jobs:
+			got = append(got, j)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out, got %d jobs, want %d", len(got), n)
+		}
+	}
+	cancel()
+	<-done
+	return got
+}
+
+func TestSchedule_init(t *testing.T) {
+	tests := []struct {
+		name    string
+		sched   Schedule
+		wantErr bool
+	}{
+		{"valid", Schedule{Cron: "@daily", Timezone: "Europe/London", Missed: MissedCatchUp}, false},
+		{"default missed", Schedule{Cron: "0 3 * * *"}, false},
+		{"bad cron", Schedule{Cron: "0 3 * *"}, true},
+		{"bad timezone", Schedule{Cron: "0 3 * * *", Timezone: "Mars/Olympus"}, true},
+		{"bad missed", Schedule{Cron: "0 3 * * *", Missed: "retry"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.sched.init(); (err != nil) != tt.wantErr {
+				t.Fatalf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchedule_init_localTimezone(t *testing.T) {
+	sc := Schedule{Cron: "0 3 * * *"}
+	if err := sc.init(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.loc != time.Local {
+		t.Errorf("location = %s, want the local time zone", sc.loc)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	next, err := sc.next(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 5, 2, 3, 0, 0, 0, time.Local); !next.Equal(want) {
+		t.Errorf("next() = %s, want %s", next, want)
+	}
+}
+
+func TestScheduler_run(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		sched       Schedule
+		now         time.Time
+		lag         time.Duration // of the first run
+		lastRun     string        // persisted before the start
+		want        []string      // scheduled times of the jobs
+		wantCatchUp []bool
+		wantLastRun string // persisted after the jobs
+	}{
+		{
+			name:        "runs on time",
+			sched:       Schedule{Cron: "0 * * * *", Timezone: "UTC"},
+			now:         start,
+			want:        []string{"2024-01-01T13:00:00Z", "2024-01-01T14:00:00Z"},
+			wantCatchUp: []bool{false, false},
+			wantLastRun: "2024-01-01T14:00:00Z",
+		},
+		{
+			name:        "late run is skipped",
+			sched:       Schedule{Cron: "0 * * * *", Timezone: "UTC"},
+			now:         start,
+			lag:         2 * missedGrace,
+			want:        []string{"2024-01-01T14:00:00Z"},
+			wantCatchUp: []bool{false},
+		},
+		{
+			name:        "late run is caught up",
+			sched:       Schedule{Cron: "0 * * * *", Timezone: "UTC", Missed: MissedCatchUp},
+			now:         start,
+			lag:         2 * missedGrace,
+			want:        []string{"2024-01-01T13:00:00Z"},
+			wantCatchUp: []bool{true},
+		},
+		{
+			// missed runs at 10:00, 11:00 and 12:00 are caught up once.
+			name:        "catch up after restart",
+			sched:       Schedule{Cron: "0 * * * *", Timezone: "UTC", Missed: MissedCatchUp},
+			now:         start.Add(30 * time.Minute),
+			lastRun:     "2024-01-01T09:00:00Z",
+			want:        []string{"2024-01-01T10:00:00Z", "2024-01-01T13:00:00Z"},
+			wantCatchUp: []bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.lastRun != "" {
+				if err := os.MkdirAll(filepath.Join(dir, schedule), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, schedule, "nightly.last"), []byte(tt.lastRun+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sched := tt.sched
+			if err := sched.init(); err != nil {
+				t.Fatal(err)
+			}
+			sc := newScheduler([]Deployment{
+				{Name: "nightly", Schedule: &sched},
+				{Name: "off", Disabled: true, Schedule: &sched},
+				{Name: "webhook"},
+			}, dir)
+			if sc == nil || len(sc.entries) != 1 {
+				t.Fatalf("unexpected scheduler: %+v", sc)
+			}
+			clock := &fakeClock{t: tt.now, lag: tt.lag}
+			sc.now, sc.after = clock.now, clock.after
+
+			jobs := collect(t, sc, len(tt.want))
+			for i, want := range tt.want {
+				if jobs[i].Trigger.Source != schedule || jobs[i].Trigger.Vars["scheduled"] != want {
+					t.Errorf("job[%d] trigger = %+v, want scheduled %s", i, jobs[i].Trigger, want)
+				}
+				if _, catchUp := jobs[i].Trigger.Vars["catch_up"]; catchUp != tt.wantCatchUp[i] {
+					t.Errorf("job[%d] catch up = %v, want %v", i, catchUp, tt.wantCatchUp[i])
+				}
+			}
+			if tt.wantLastRun == "" {
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(dir, schedule, "nightly.last"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(data)) != tt.wantLastRun {
+				t.Errorf("last run = %q, want %q", data, tt.wantLastRun)
+			}
+		})
+	}
+}
+
+func TestServer_apiSchedule(t *testing.T) {
+	t.Run("no schedules", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		new(Server).apiSchedule(w, httptest.NewRequest(http.MethodGet, "/api/schedule", nil))
+		if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+			t.Errorf("body = %s, want []", got)
+		}
+	})
+	t.Run("next run", func(t *testing.T) {
+		sched := Schedule{Cron: "0 3 * * *", Timezone: "Europe/London"}
+		if err := sched.init(); err != nil {
+			t.Fatal(err)
+		}
+		sc := newScheduler([]Deployment{{Name: "nightly", Schedule: &sched}}, "")
+		sc.entries[0].next = time.Date(2024, 7, 1, 3, 0, 0, 0, sc.entries[0].dep.Schedule.loc)
+		w := httptest.NewRecorder()
+		(&Server{sched: sc}).apiSchedule(w, httptest.NewRequest(http.MethodGet, "/api/schedule", nil))
+
+		var got []map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{"name": "nightly", "cron": "0 3 * * *", "timezone": "Europe/London", "missed": MissedSkip, "next_run": "2024-07-01T03:00:00+01:00"}
+		if len(got) != 1 || len(got[0]) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for k, v := range want {
+			if got[0][k] != v {
+				t.Errorf("%s = %v, want %v", k, got[0][k], v)
+			}
+		}
+	})
+}
+
+func TestDeployment_initOrDisable_schedule(t *testing.T) {
+	tests := []struct {
+		name         string
+		dep          Deployment
+		wantDisabled bool
+	}{
+		{"schedule only", Deployment{Name: "a", Workdir: ".", Schedule: &Schedule{Cron: "@daily"}}, false},
+		{"invalid schedule", Deployment{Name: "b", Workdir: ".", Schedule: &Schedule{Cron: "daily"}}, true},
+		{"no type and no schedule", Deployment{Name: "c", Workdir: ".", Payload: "x"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dep.initOrDisable()
+			if tt.dep.Disabled != tt.wantDisabled {
+				t.Errorf("Disabled = %v, want %v", tt.dep.Disabled, tt.wantDisabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package deploysrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/dlog"
+)
+
+// stepSkipped is the status of the pipeline step, that didn't run, because
+// the previous one has failed.
+const stepSkipped = "skipped"
+
+// Step is the step of the deployment pipeline.
+type Step struct {
+	// Name is the step name, shown in the results, defaults to "step N".
+	Name string `yaml:"name,omitempty"`
+	// Command is the command to run.
+	Command []string `yaml:"command"`
+	// Workdir overrides the deployment workdir, the relative path is
+	// resolved against the deployment workdir.
+	Workdir string `yaml:"work_dir,omitempty"`
+	// Env are the additional environment variables of the command.
+	Env map[string]string `yaml:"env,omitempty"`
+	// Timeout is the maximum run time of the step, if zero, the step is
+	// limited only by the deployment timeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// ContinueOnError allows the pipeline to continue, if the step fails.
+	ContinueOnError bool `yaml:"continue_on_error,omitempty"`
+}
+
+// name returns the name of the i-th step.
+func (st *Step) name(i int) string {
+	if st.Name != "" {
+		return st.Name
+	}
+	return fmt.Sprintf("step %d", i+1)
+}
+
+// dir returns the working directory of the step.
+func (st *Step) dir(workdir string) string {
+	switch {
+	case st.Workdir == "":
+		return workdir
+	case filepath.IsAbs(st.Workdir):
+		return st.Workdir
+	default:
+		return filepath.Join(workdir, st.Workdir)
+	}
+}
+
+// env returns the step environment variables sorted by name.
+func (st *Step) env() []string {
+	env := make([]string, 0, len(st.Env))
+	for k, v := range st.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// initSteps validates the pipeline steps.
+func (m *Deployment) initSteps() error {
+	if len(m.Steps) == 0 {
+		return nil
+	}
+	if len(m.Command) > 0 {
+		return errors.New("command and steps are mutually exclusive")
+	}
+	for i := range m.Steps {
+		if err := m.Steps[i].validate(m.Workdir); err != nil {
+			return fmt.Errorf("%s: %w", m.Steps[i].name(i), err)
+		}
+	}
+	return nil
+}
+
+// validate validates the step, that runs in the deployment workdir.
+func (st *Step) validate(workdir string) error {
+	if len(st.Command) == 0 {
+		return errors.New("no command")
+	}
+	if st.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: %s", st.Timeout)
+	}
+	if fi, err := os.Stat(st.dir(workdir)); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", st.dir(workdir))
+	}
+	return nil
+}
+
+// stepResult is the result of the pipeline step.
+type stepResult struct {
+	Name string `json:"name"`
+	// Outcome is the outcome of the step, or stepSkipped status, if it
+	// didn't run.
+	Outcome
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+
+	output []byte
+	err    error
+}
+
+// runStep runs the step command in the workdir.
+func runStep(ctx context.Context, workdir string, st Step, t Trigger) stepResult {
+	if st.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.Timeout)
+		defer cancel()
+	}
+	command, args := head(st.Command...)
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = st.dir(workdir)
+	cmd.Env = append(append(os.Environ(), t.Env()...), st.env()...)
+	// don't wait forever for the children, that hold the output open.
+	cmd.WaitDelay = waitDelay
+
+	sr := stepResult{Started: time.Now()}
+	sr.output, sr.err = cmd.CombinedOutput()
+	sr.Duration = time.Since(sr.Started)
+	sr.Outcome = newOutcome(ctx, sr.err)
+	if sr.Outcome.Status == OutcomeTimeout {
+		sr.err = fmt.Errorf("timed out after %s", sr.Duration.Round(time.Millisecond))
+	}
+	if sr.err != nil {
+		sr.Error = sr.err.Error()
+	}
+	return sr
+}
+
+// runPipeline runs the deployment steps in order, and returns the combined
+// output with a section per step.  The pipeline stops at the first failed
+// step, unless it's allowed to continue on error, or when the deployment
+// times out.
+func runPipeline(ctx context.Context, id uuid.UUID, d Deployment, t Trigger) run {
+	var (
+		r   = run{outcome: Outcome{Status: OutcomeSuccess}}
+		buf bytes.Buffer
+		n   = len(d.Steps)
+	)
+	for i, st := range d.Steps {
+		name := st.name(i)
+		if r.err != nil {
+			r.steps = append(r.steps, stepResult{Name: name, Outcome: Outcome{Status: stepSkipped}})
+			fmt.Fprintf(&buf, "==> [%d/%d] %s: skipped\n\n", i+1, n, name)
+			continue
+		}
+		dlog.Printf("%s> [%s] step %d/%d %q", id, d.Name, i+1, n, name)
+		fmt.Fprintf(&buf, "==> [%d/%d] %s\n", i+1, n, name)
+		sr := runStep(ctx, d.Workdir, st, t)
+		sr.Name = name
+		r.steps = append(r.steps, sr)
+		writeOutput(&buf, sr.output)
+		fmt.Fprintf(&buf, "<== [%d/%d] %s: %s in %s\n\n", i+1, n, name, stepStatus(sr.Outcome), sr.Duration.Round(time.Millisecond))
+
+		switch {
+		case sr.err == nil:
+		case st.ContinueOnError && ctx.Err() == nil:
+			dlog.Printf("%s> [%s] step %q failed, continuing: %s", id, d.Name, name, sr.err)
+		default:
+			r.outcome = sr.Outcome
+			if ctx.Err() != nil {
+				r.outcome = Outcome{Status: OutcomeTimeout, ExitCode: -1}
+			}
+			r.err = fmt.Errorf("%s> step %d/%d %q: %s failed with %w", id, i+1, n, name, st.Command[0], sr.err)
+		}
+	}
+	r.output = buf.Bytes()
+	return r
+}
+
+// writeOutput writes the command output to buf, terminating it with a
+// newline, if it's missing.
+func writeOutput(buf *bytes.Buffer, output []byte) {
+	buf.Write(output)
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+}
+
+// stepStatus returns the human readable step outcome.
+func stepStatus(o Outcome) string {
+	if o.Status == OutcomeFailure {
+		return fmt.Sprintf("%s (exit code %d)", o.Status, o.ExitCode)
+	}
+	return o.Status
+}
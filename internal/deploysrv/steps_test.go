@@ -0,0 +1,131 @@
+package deploysrv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDeployment_initSteps(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		dep     Deployment
+		wantErr bool
+	}{
+		{"no steps", Deployment{Command: []string{"true"}}, false},
+		{"valid", Deployment{Steps: []Step{{Command: []string{"true"}}, {Command: []string{"true"}, Workdir: "sub", Timeout: time.Second}}}, false},
+		{"absolute workdir", Deployment{Steps: []Step{{Command: []string{"true"}, Workdir: dir}}}, false},
+		{"command and steps", Deployment{Command: []string{"true"}, Steps: []Step{{Command: []string{"true"}}}}, true},
+		{"no command", Deployment{Steps: []Step{{Name: "empty"}}}, true},
+		{"negative timeout", Deployment{Steps: []Step{{Command: []string{"true"}, Timeout: -time.Second}}}, true},
+		{"missing workdir", Deployment{Steps: []Step{{Command: []string{"true"}, Workdir: "nope"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dep.Workdir = dir
+			if err := tt.dep.initSteps(); (err != nil) != tt.wantErr {
+				t.Errorf("initSteps() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_runDeployment_steps(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sh := func(script string) []string { return []string{"sh", "-c", script} }
+	statuses := func(steps []stepResult) string {
+		var ss []string
+		for _, s := range steps {
+			ss = append(ss, s.Status)
+		}
+		return strings.Join(ss, ",")
+	}
+
+	tests := []struct {
+		name         string
+		dep          Deployment
+		want         Outcome
+		wantStatuses string
+		wantOutput   []string
+	}{
+		{
+			"all succeed",
+			Deployment{Steps: []Step{
+				{Name: "pull", Command: sh("echo pulling $HUBDEPLOY_TAG $COMPOSE_FILE"), Env: map[string]string{"COMPOSE_FILE": "prod.yml"}},
+				{Name: "where", Command: sh("basename $(pwd)"), Workdir: "sub"},
+			}},
+			Outcome{Status: OutcomeSuccess},
+			"success,success",
+			[]string{"==> [1/2] pull\npulling v1 prod.yml\n<== [1/2] pull: success in ", "==> [2/2] where\nsub\n<== [2/2] where: success in "},
+		},
+		{
+			"continue on error",
+			Deployment{Steps: []Step{
+				{Name: "prune", Command: sh("exit 1"), ContinueOnError: true},
+				{Command: sh("echo up")},
+			}},
+			Outcome{Status: OutcomeSuccess},
+			"failure,success",
+			[]string{"<== [1/2] prune: failure (exit code 1) in ", "==> [2/2] step 2\nup\n"},
+		},
+		{
+			"stops on failure",
+			Deployment{Steps: []Step{
+				{Name: "migrate", Command: sh("echo oops; exit 2")},
+				{Name: "up", Command: sh("echo up")},
+			}},
+			Outcome{Status: OutcomeFailure, ExitCode: 2},
+			"failure,skipped",
+			[]string{"<== [1/2] migrate: failure (exit code 2) in ", "==> [2/2] up: skipped\n"},
+		},
+		{
+			"step timeout",
+			Deployment{Steps: []Step{{Name: "slow", Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}}},
+			Outcome{Status: OutcomeTimeout, ExitCode: -1},
+			"timeout",
+			[]string{"<== [1/1] slow: timeout in "},
+		},
+		{
+			"deployment timeout",
+			Deployment{Timeout: 50 * time.Millisecond, Steps: []Step{
+				{Name: "slow", Command: []string{"sleep", "5"}, ContinueOnError: true},
+				{Name: "up", Command: sh("echo up")},
+			}},
+			Outcome{Status: OutcomeTimeout, ExitCode: -1},
+			"timeout,skipped",
+			[]string{"==> [2/2] up: skipped\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dep.Name, tt.dep.Workdir = "test", dir
+			var s Server
+			r := s.runDeployment(uuid.Must(uuid.NewUUID()), tt.dep, Trigger{Vars: map[string]string{"tag": "v1"}})
+			if r.outcome != tt.want {
+				t.Errorf("outcome = %+v, want %+v", r.outcome, tt.want)
+			}
+			if (r.err != nil) != (tt.want.Status != OutcomeSuccess) {
+				t.Errorf("error = %v", r.err)
+			}
+			if got := statuses(r.steps); got != tt.wantStatuses {
+				t.Errorf("step statuses = %q, want %q", got, tt.wantStatuses)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(string(r.output), want) {
+					t.Errorf("output does not contain %q:\n%s", want, r.output)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package deploysrv
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// ACME challenge types.
+const (
+	ChallengeTLSALPN = "tls-alpn-01"
+	ChallengeHTTP    = "http-01"
+)
+
+const (
+	defACMECacheDir = "acme-cache"
+	defACMEHTTPAddr = ":80"
+)
+
+// ACME is the automatic certificate management configuration.
+type ACME struct {
+	// Domains is the list of domains to obtain the certificates for.
+	Domains []string `yaml:"domains"`
+	// Email is the optional contact email for the ACME account.
+	Email string `yaml:"email,omitempty"`
+	// DirectoryURL is the ACME directory URL, if empty, Let's Encrypt
+	// production directory is used.
+	DirectoryURL string `yaml:"directory_url,omitempty"`
+	// CACert is the optional PEM file with the root certificates to trust
+	// when talking to the ACME server, i.e. a local test CA.
+	CACert string `yaml:"ca_cert,omitempty"`
+	// CacheDir is the directory where certificates and the account key are
+	// stored.
+	CacheDir string `yaml:"cache_dir,omitempty"`
+	// Challenge is the challenge type, either "tls-alpn-01" (default) or
+	// "http-01".
+	Challenge string `yaml:"challenge,omitempty"`
+	// HTTPAddr is the address of the HTTP-01 challenge listener.
+	HTTPAddr string `yaml:"http_addr,omitempty"`
+}
+
+func (a *ACME) validate() error {
+	if len(a.Domains) == 0 {
+		return errors.New("acme: no domains")
+	}
+	switch a.Challenge {
+	case "", ChallengeTLSALPN, ChallengeHTTP:
+	default:
+		return fmt.Errorf("acme: unsupported challenge type %q", a.Challenge)
+	}
+	return nil
+}
+
+// manager returns the autocert manager for the configuration.
+func (a *ACME) manager() (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: a.DirectoryURL}
+	if a.CACert != "" {
+		pool, err := shared.LoadCertPool(a.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: tr}
+	}
+	cacheDir := a.CacheDir
+	if cacheDir == "" {
+		cacheDir = defACMECacheDir
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(a.Domains...),
+		Email:      a.Email,
+		Client:     client,
+	}, nil
+}
+
+// certGetter is the signature of [tls.Config.GetCertificate].
+type certGetter func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// tlsConfig returns the TLS configuration for the listener, or nil, if TLS is
+// not configured.  The second return value is the optional HTTP-01 challenge
+// handler, that must be served on plain HTTP.
+func (s *Server) tlsConfig() (*tls.Config, http.Handler, error) {
+	cfg, challenge, err := s.serverTLSConfig()
+	if err != nil || s.clientCA == "" {
+		return cfg, challenge, err
+	}
+	if cfg == nil {
+		return nil, nil, errors.New("client_ca requires TLS to be configured")
+	}
+	pool, err := shared.LoadCertPool(s.clientCA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client_ca: %w", err)
+	}
+	// client certificates are verified if presented, the per-route policy
+	// decides if they are required, see [requireClientCert].
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, challenge, nil
+}
+
+// serverTLSConfig returns the TLS configuration with the server certificates.
+func (s *Server) serverTLSConfig() (*tls.Config, http.Handler, error) {
+	var static certGetter
+	if s.cert != "" && s.privkey != "" {
+		r, err := newCertReloader(s.cert, s.privkey)
+		if err != nil {
+			return nil, nil, err
+		}
+		static = r.GetCertificate
+	}
+	if s.acme == nil {
+		if static == nil {
+			return nil, nil, nil
+		}
+		return &tls.Config{GetCertificate: static}, nil, nil
+	}
+
+	m, err := s.acme.manager()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := m.TLSConfig()
+	cfg.GetCertificate = withFallback(m.GetCertificate, static)
+	var challenge http.Handler
+	if s.acme.Challenge == ChallengeHTTP {
+		challenge = m.HTTPHandler(nil)
+	}
+	return cfg, challenge, nil
+}
+
+const (
+	// acmeRetryBackoff is the initial delay before the next certificate
+	// request after the failed one, while the fallback certificate is used.
+	acmeRetryBackoff = time.Minute
+	// acmeMaxRetryBackoff is the maximum delay between the certificate
+	// requests.
+	acmeMaxRetryBackoff = time.Hour
+)
+
+// withFallback returns the certGetter that returns the fallback certificate
+// if the primary fails.  TLS-ALPN challenge requests are never served with
+// the fallback.  After the failure, the fallback is used for the server name
+// without calling the primary, until the backoff expires, so that each
+// handshake doesn't retry the certificate issuance.
+func withFallback(primary, fallback certGetter) certGetter {
+	if fallback == nil {
+		return primary
+	}
+	return newFallbackGetter(primary, fallback).GetCertificate
+}
+
+// fallbackGetter is the certGetter with the fallback, see [withFallback].
+type fallbackGetter struct {
+	primary  certGetter
+	fallback certGetter
+
+	mu     sync.Mutex
+	failed map[string]acmeFailure // by server name
+	now    func() time.Time
+}
+
+func newFallbackGetter(primary, fallback certGetter) *fallbackGetter {
+	return &fallbackGetter{primary: primary, fallback: fallback, failed: make(map[string]acmeFailure), now: time.Now}
+}
+
+// acmeFailure is the failed certificate request.
+type acmeFailure struct {
+	retry   time.Time
+	backoff time.Duration
+}
+
+func (fg *fallbackGetter) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return fg.primary(hello)
+	}
+	fg.mu.Lock()
+	f, failed := fg.failed[hello.ServerName]
+	fg.mu.Unlock()
+	if failed && fg.now().Before(f.retry) {
+		return fg.fallback(hello)
+	}
+
+	cert, err := fg.primary(hello)
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	if err == nil {
+		delete(fg.failed, hello.ServerName)
+		return cert, nil
+	}
+	f.backoff = min(max(f.backoff*2, acmeRetryBackoff), acmeMaxRetryBackoff)
+	f.retry = fg.now().Add(f.backoff)
+	fg.failed[hello.ServerName] = f
+	dlog.Printf("acme: unable to get certificate for %q, using the static certificate, next attempt in %s: %s", hello.ServerName, f.backoff, err)
+	return fg.fallback(hello)
+}
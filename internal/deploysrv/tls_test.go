@@ -0,0 +1,409 @@
+package deploysrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/acme"
+)
+
+// genCert generates a self-signed certificate for the common name cn, writes
+// it to dir and returns the certificate and key file names.
+func genCert(t *testing.T, dir, cn string) (string, string) {
+	t.Helper()
+	c := genSignedCert(t, dir, cn, nil)
+	return c.certFile, c.keyFile
+}
+
+// testCert is the generated test certificate.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// genSignedCert generates a certificate for the common name cn, signed by
+// parent, or self-signed, if parent is nil, and writes it to dir.
+func genSignedCert(t *testing.T, dir, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         parent == nil,
+
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, certFile: certFile, keyFile: keyFile}
+}
+
+func TestWithFallback(t *testing.T) {
+	primaryCert, fallbackCert := new(tls.Certificate), new(tls.Certificate)
+	failing := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, errors.New("acme down") }
+	working := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return primaryCert, nil }
+	fallback := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return fallbackCert, nil }
+
+	tests := []struct {
+		name     string
+		primary  certGetter
+		fallback certGetter
+		hello    *tls.ClientHelloInfo
+		want     *tls.Certificate
+		wantErr  bool
+	}{
+		{"primary ok", working, fallback, &tls.ClientHelloInfo{}, primaryCert, false},
+		{"primary fails", failing, fallback, &tls.ClientHelloInfo{}, fallbackCert, false},
+		{"no fallback", failing, nil, &tls.ClientHelloInfo{}, nil, true},
+		{"alpn challenge", failing, fallback, &tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withFallback(tt.primary, tt.fallback)(tt.hello)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got certificate %p, want %p", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_tlsConfig_acme(t *testing.T) {
+	// local ACME server stand-in, that records the requests and fails them
+	// all, so that the static certificate is used.
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	acmeSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer acmeSrv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: acmeSrv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := genCert(t, dir, "hubdeploy.test")
+
+	s := &Server{
+		cert:    certFile,
+		privkey: keyFile,
+		acme: &ACME{
+			Domains:      []string{"hubdeploy.test"},
+			DirectoryURL: acmeSrv.URL + "/directory",
+			CACert:       caFile,
+			CacheDir:     filepath.Join(dir, "cache"),
+			Challenge:    ChallengeHTTP,
+		},
+	}
+	cfg, challenge, err := s.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig() error = %v", err)
+	}
+	if challenge == nil {
+		t.Error("http-01 challenge handler is nil")
+	}
+	cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "hubdeploy.test"})
+	if err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "hubdeploy.test" {
+		t.Errorf("got certificate for %q, want the static one", leaf.Subject.CommonName)
+	}
+
+	mu.Lock()
+	n := len(paths)
+	if n == 0 || paths[0] != "/directory" {
+		t.Errorf("ACME server requests = %v, want the directory to be requested", paths)
+	}
+	mu.Unlock()
+
+	// the failure is cached, the next handshake doesn't retry the issuance.
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "hubdeploy.test"}); err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != n {
+		t.Errorf("ACME server requests after the failure = %v, want none", paths[n:])
+	}
+}
+
+func TestServer_tlsConfig_static(t *testing.T) {
+	if cfg, _, err := (&Server{}).tlsConfig(); err != nil || cfg != nil {
+		t.Fatalf("tlsConfig() = %v, %v, want nil, nil", cfg, err)
+	}
+	certFile, keyFile := genCert(t, t.TempDir(), "static.test")
+	cfg, challenge, err := (&Server{cert: certFile, privkey: keyFile}).tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig() error = %v", err)
+	}
+	if challenge != nil {
+		t.Error("unexpected challenge handler")
+	}
+	if cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{}); err != nil || cert == nil {
+		t.Errorf("GetCertificate() = %v, %v", cert, err)
+	}
+}
+
+// newACMEStub starts the minimal ACME server, that has all the orders
+// authorized, and issues the certificates signed by ca.  JWS signatures are
+// not verified.  It returns the server and the number of the issued
+// certificates.
+func newACMEStub(t *testing.T, ca *testCert) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var (
+		ts     *httptest.Server
+		issued atomic.Int32
+		mu     sync.Mutex
+		certs  = make(map[string][]byte) // PEM by the order id
+	)
+	// payload returns the JWS payload of the request.
+	payload := func(r *http.Request, v any) error {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			return err
+		}
+		data, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+		if err != nil || v == nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+	order := func(w http.ResponseWriter, code int, id, status string) {
+		w.Header().Set("Location", ts.URL+"/order/"+id)
+		o := map[string]any{
+			"status":         status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": "hubdeploy.test"}},
+			"authorizations": []string{},
+			"finalize":       ts.URL + "/finalize/" + id,
+		}
+		if status == acme.StatusValid {
+			o["certificate"] = ts.URL + "/cert/" + id
+		}
+		writeJSON(w, code, o)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   ts.URL + "/nonce",
+			"newAccount": ts.URL + "/account",
+			"newOrder":   ts.URL + "/order",
+			"revokeCert": ts.URL + "/revoke",
+			"keyChange":  ts.URL + "/key-change",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", ts.URL+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": acme.StatusValid})
+	})
+	mux.HandleFunc("POST /order", func(w http.ResponseWriter, r *http.Request) {
+		order(w, http.StatusCreated, uuid.NewString(), acme.StatusReady)
+	})
+	mux.HandleFunc("POST /finalize/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		if err := payload(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		crt, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id := r.PathValue("id")
+		mu.Lock()
+		certs[id] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+		mu.Unlock()
+		issued.Add(1)
+		order(w, http.StatusOK, id, acme.StatusValid)
+	})
+	mux.HandleFunc("POST /cert/{id}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		chain, ok := certs[r.PathValue("id")]
+		mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(chain)
+	})
+	ts = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", uuid.NewString())
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &issued
+}
+
+func TestServer_tlsConfig_acmeIssue(t *testing.T) {
+	dir := t.TempDir()
+	ca := genSignedCert(t, dir, "acme-stub-ca", nil)
+	acmeSrv, issued := newACMEStub(t, ca)
+	caFile := filepath.Join(dir, "acme-server.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: acmeSrv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		acme: &ACME{
+			Domains:      []string{"hubdeploy.test"},
+			DirectoryURL: acmeSrv.URL + "/directory",
+			CACert:       caFile,
+			CacheDir:     filepath.Join(dir, "cache"),
+		},
+	}
+	cfg, _, err := s.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig() error = %v", err)
+	}
+	for range 2 {
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "hubdeploy.test"})
+		if err != nil {
+			t.Fatalf("GetCertificate() error = %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := leaf.CheckSignatureFrom(ca.cert); err != nil || leaf.Subject.CommonName != "hubdeploy.test" {
+			t.Fatalf("got certificate for %q issued by %q, want the one issued by ACME server: %v", leaf.Subject.CommonName, leaf.Issuer.CommonName, err)
+		}
+	}
+	if n := issued.Load(); n != 1 {
+		t.Errorf("issued %d certificates, want 1", n)
+	}
+}
+
+func TestFallbackGetter_backoff(t *testing.T) {
+	var (
+		calls   int
+		fail    = true
+		primary = new(tls.Certificate)
+		static  = new(tls.Certificate)
+		now     = time.Now()
+	)
+	fg := newFallbackGetter(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		calls++
+		if fail {
+			return nil, errors.New("acme down")
+		}
+		return primary, nil
+	}, func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return static, nil })
+	fg.now = func() time.Time { return now }
+	hello := &tls.ClientHelloInfo{ServerName: "hubdeploy.test"}
+
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		fail      bool
+		want      *tls.Certificate
+		wantCalls int
+	}{
+		{"fails", 0, true, static, 1},
+		{"within backoff", 30 * time.Second, true, static, 1},
+		{"retry fails", 31 * time.Second, true, static, 2},
+		{"backoff doubled", time.Minute + time.Second, true, static, 2},
+		{"retry succeeds", time.Minute, false, primary, 3},
+		{"reset", 0, false, primary, 4},
+	}
+	for _, st := range steps {
+		now = now.Add(st.advance)
+		fail = st.fail
+		got, err := fg.GetCertificate(hello)
+		if err != nil {
+			t.Fatalf("%s: GetCertificate() error = %v", st.name, err)
+		}
+		if got != st.want || calls != st.wantCalls {
+			t.Errorf("%s: got primary %v, calls %d, want primary %v, calls %d", st.name, got == primary, calls, st.want == primary, st.wantCalls)
+		}
+	}
+}
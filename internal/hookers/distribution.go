@@ -0,0 +1,49 @@
+package hookers
+
+import "time"
+
+// Docker Registry v2 (distribution) notification types, see
+// https://distribution.github.io/distribution/about/notifications/
+
+// distAction is the action of the push event.
+const distPush = "push"
+
+// distEnvelope is the notification envelope.
+type distEnvelope struct {
+	Events []distEvent `json:"events"`
+}
+
+// distEvent is a single registry event.
+type distEvent struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    struct {
+		MediaType  string `json:"mediaType"`
+		Digest     string `json:"digest"`
+		Size       int64  `json:"size"`
+		Repository string `json:"repository"`
+		URL        string `json:"url"`
+		Tag        string `json:"tag"`
+	} `json:"target"`
+	Request struct {
+		Host      string `json:"host"`
+		Method    string `json:"method"`
+		UserAgent string `json:"useragent"`
+	} `json:"request"`
+	Actor struct {
+		Name string `json:"name"`
+	} `json:"actor"`
+}
+
+// tagPushes returns the tag push events.  Pushes of blobs and manifests by
+// digest only are skipped.
+func (e *distEnvelope) tagPushes() []distEvent {
+	var pushes []distEvent
+	for _, ev := range e.Events {
+		if ev.Action == distPush && ev.Target.Tag != "" {
+			pushes = append(pushes, ev)
+		}
+	}
+	return pushes
+}
@@ -1,11 +1,11 @@
 package hookers
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -15,16 +15,31 @@ import (
 	"github.com/rusq/dlog"
 )
 
+// Commit status states, shared by Docker Hub, GitHub and Gitea.
 const (
 	ssuccess = "success"
 	sfailure = "failure"
 	serror   = "error"
 )
 
+// commitState maps the deployment outcome to the commit status state: the
+// command, that has run and failed or timed out, is the failure, and the one,
+// that couldn't run, is the error.
+func commitState(data deploysrv.CallbackData) string {
+	switch data.Status() {
+	case deploysrv.OutcomeSuccess:
+		return ssuccess
+	case deploysrv.OutcomeFailure, deploysrv.OutcomeTimeout:
+		return sfailure
+	default:
+		return serror
+	}
+}
+
 const DTDockerHub = "dockerhub"
 
 type DockerHub struct {
-	mapping map[string]map[string]deploysrv.Deployment // deployment = mapping[repo][tag]
+	mapping tagMapping
 }
 
 // Generated by https://quicktype.io
@@ -87,24 +102,56 @@ func (d *DockerHub) Register(dep deploysrv.Deployment) error {
 	return nil
 }
 
-const any = "*"
+// anyTag is the tag pattern, that matches any tag.
+const anyTag = "*"
 
-func (d *DockerHub) add(dc *docker, dep deploysrv.Deployment) {
-	if d.mapping == nil {
-		d.mapping = make(map[string]map[string]deploysrv.Deployment)
+var (
+	errNoRepo = errors.New("no deployment for this repository")
+	errNoTag  = errors.New("no deployment for this tag")
+)
+
+// tagMapping maps the repository and tag to the deployment:
+// deployment = mapping[repo][tag].  Deployment without tags handles any tag
+// of the repository.
+type tagMapping map[string]map[string]deploysrv.Deployment
+
+func (m *tagMapping) add(repo string, tags []string, dep deploysrv.Deployment) {
+	if *m == nil {
+		*m = make(tagMapping)
 	}
-	if d.mapping[dc.RepoName] == nil {
-		d.mapping[dc.RepoName] = make(map[string]deploysrv.Deployment)
+	if (*m)[repo] == nil {
+		(*m)[repo] = make(map[string]deploysrv.Deployment)
 	}
-	if len(dc.Tags) == 0 {
-		d.mapping[dc.RepoName][any] = dep
+	if len(tags) == 0 {
+		(*m)[repo][anyTag] = dep
 	}
-	for _, tag := range dc.Tags {
-		d.mapping[dc.RepoName][tag] = dep
+	for _, tag := range tags {
+		(*m)[repo][tag] = dep
 	}
 }
 
-func (d *DockerHub) tryUnmarshal(I interface{}) (*docker, error) {
+// lookup returns the deployment for the repository and tag.  It returns
+// errNoRepo or errNoTag, if there's no deployment.
+func (m tagMapping) lookup(repo, tag string) (deploysrv.Deployment, error) {
+	tagsDP, ok := m[repo]
+	if !ok {
+		return deploysrv.Deployment{}, errNoRepo
+	}
+	dp, ok := tagsDP[anyTag]
+	if !ok {
+		dp, ok = tagsDP[tag]
+		if !ok {
+			return deploysrv.Deployment{}, errNoTag
+		}
+	}
+	return dp, nil
+}
+
+func (d *DockerHub) add(dc *docker, dep deploysrv.Deployment) {
+	d.mapping.add(dc.RepoName, dc.Tags, dep)
+}
+
+func (d *DockerHub) tryUnmarshal(I any) (*docker, error) {
 	encoded, err := yaml.Marshal(I)
 	if err != nil {
 		return nil, err
@@ -127,30 +174,36 @@ func (d *DockerHub) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
 			return
 		}
 
-		tagsDP, ok := d.mapping[wh.Repository.RepoName]
-		if !ok {
-			dlog.Printf("no deployment for repository: %q", wh.Repository.RepoName)
-			http.Error(w, "no deployment for this repository", http.StatusNotFound)
-			return
-		}
-
-		dp, ok := tagsDP[any]
-		if !ok {
-			dp, ok = tagsDP[wh.PushData.Tag]
-			if !ok {
+		dp, err := d.mapping.lookup(wh.Repository.RepoName, wh.PushData.Tag)
+		if err != nil {
+			if errors.Is(err, errNoRepo) {
+				dlog.Printf("no deployment for repository: %q", wh.Repository.RepoName)
+			} else {
 				dlog.Printf("[%s] no deployment for tag: %q", wh.Repository.RepoName, wh.PushData.Tag)
-				http.Error(w, "no deployment for this tag", http.StatusNotFound)
-				return
 			}
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
 		}
 
 		if dp.Disabled {
-			dlog.Printf("[%s] deployment for tag: %q is disabled", wh.Repository.RepoName, wh.PushData.Tag)
+			dlog.Printf("[%s] deployment %q for tag: %q is disabled", wh.Repository.RepoName, dp.Name, wh.PushData.Tag)
 			http.Error(w, "deployment for this tag is disabled", http.StatusNotFound)
 			return
 		}
 
-		j <- deploysrv.Job{Dep: dp, CallbackURL: wh.CallbackURL}
+		dlog.Printf("[%s] tag %q pushed by %q, queueing deployment %q", wh.Repository.RepoName, wh.PushData.Tag, wh.PushData.Pusher, dp.Name)
+		j <- deploysrv.Job{
+			Dep:         dp,
+			CallbackURL: wh.CallbackURL,
+			Trigger: deploysrv.Trigger{
+				Source: DTDockerHub,
+				Vars: map[string]string{
+					"repo":   wh.Repository.RepoName,
+					"tag":    wh.PushData.Tag,
+					"pusher": wh.PushData.Pusher,
+				},
+			},
+		}
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(http.StatusText(http.StatusOK)))
@@ -158,15 +211,24 @@ func (d *DockerHub) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
 }
 
 func (d *DockerHub) Callback(data deploysrv.CallbackData) error {
-	state := ssuccess
+	return d.CallbackContext(context.Background(), data)
+}
+
+// CallbackContext posts the results to the Docker Hub callback URL, the
+// request is cancelled when the context is done.
+func (d *DockerHub) CallbackContext(ctx context.Context, data deploysrv.CallbackData) error {
+	if data.CallbackURL == "" {
+		// not triggered by the webhook, nothing to report to.
+		return nil
+	}
+	state := commitState(data)
 	descr := data.Description
 	if data.Error != nil {
-		state = serror
 		descr = data.Error.Error()
 	}
 	cb := callback{
 		State:       state,
-		Description: fmt.Sprintf("[%s]: %s", data.ID, descr),
+		Description: fmt.Sprintf("%s [%s]: %s", data.Name, data.ID, descr),
 		Context:     data.Context,
 		TargetURL:   data.ResultsURL,
 	}
@@ -175,21 +237,11 @@ func (d *DockerHub) Callback(data deploysrv.CallbackData) error {
 		return err
 	}
 	// post the results
-	dlog.Printf("%s> posting results to %s", data.ID, data.CallbackURL)
+	dlog.Printf("%s> [%s] posting results to %s", data.ID, data.Name, data.CallbackURL)
 	dlog.Debugf("%s> data: %s", data.ID, string(b))
-	resp, err := http.Post(data.CallbackURL, "application/json", bytes.NewReader(b))
-	if err != nil {
+	if err := postJSON(ctx, data.CallbackURL, b, nil); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid status code: %d", resp.StatusCode)
-	}
 	dlog.Printf("%s> post ok", data.ID)
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		dlog.Printf("%s> error reading body: %s", data.ID, err)
-	}
-	dlog.Debugf("%s> body: %s", data.ID, string(body))
 	return nil
 }
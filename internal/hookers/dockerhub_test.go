@@ -1,15 +1,19 @@
 package hookers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"github.com/google/uuid"
 
 	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
 )
 
 var dockerValid = `---
@@ -102,3 +106,70 @@ func TestDockerHub_Callback(t *testing.T) {
 		})
 	}
 }
+
+func TestDockerHub_CallbackContext_cancelled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d := &DockerHub{}
+	err := d.CallbackContext(ctx, deploysrv.CallbackData{
+		ID:          uuid.Must(uuid.NewUUID()),
+		CallbackURL: srv.URL,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("CallbackContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDockerHub_CallbackContext_rejected(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	d := &DockerHub{}
+	err := d.CallbackContext(context.Background(), deploysrv.CallbackData{
+		ID:          uuid.Must(uuid.NewUUID()),
+		CallbackURL: srv.URL,
+	})
+	var se *shared.StatusError
+	if !errors.As(err, &se) || se.Code != http.StatusBadRequest || se.Temporary() {
+		t.Fatalf("CallbackContext() error = %#v, want the permanent status error", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d attempts, want 1", calls)
+	}
+}
+
+func TestCommitState(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   deploysrv.CallbackData
+		want   string
+		wantGL string
+	}{
+		{"success", deploysrv.CallbackData{Outcome: deploysrv.Outcome{Status: deploysrv.OutcomeSuccess}}, ssuccess, glStateSuccess},
+		{"failure", deploysrv.CallbackData{Outcome: deploysrv.Outcome{Status: deploysrv.OutcomeFailure, ExitCode: 1}, Error: errTest}, sfailure, glStateFailed},
+		{"timeout", deploysrv.CallbackData{Outcome: deploysrv.Outcome{Status: deploysrv.OutcomeTimeout, ExitCode: -1}, Error: errTest}, sfailure, glStateFailed},
+		{"error", deploysrv.CallbackData{Outcome: deploysrv.Outcome{Status: deploysrv.OutcomeError, ExitCode: -1}, Error: errTest}, serror, glStateFailed},
+		{"no outcome", deploysrv.CallbackData{Error: errTest}, serror, glStateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commitState(tt.data); got != tt.want {
+				t.Errorf("commitState() = %q, want %q", got, tt.want)
+			}
+			if got := glState(tt.data); got != tt.wantGL {
+				t.Errorf("glState() = %q, want %q", got, tt.wantGL)
+			}
+		})
+	}
+}
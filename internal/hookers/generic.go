@@ -0,0 +1,346 @@
+package hookers
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// DTGeneric is the generic JSON webhook deployment type, for the sources that
+// don't have a dedicated hooker (Jenkins, Drone, custom scripts).  The
+// authentication, match conditions and trigger variables are declared in the
+// deployment payload.
+const DTGeneric = "generic"
+
+const (
+	defGenericTokenHeader = "X-Hubdeploy-Token"
+	defGenericSigHeader   = "X-Hubdeploy-Signature"
+	defGenericAlgorithm   = "sha256"
+)
+
+// hmacAlgorithms are the supported HMAC hash algorithms.
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// reVarName is the trigger variable name, it becomes a part of the
+// environment variable name.
+var reVarName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Generic handles the generic JSON webhooks.  The webhook may be sent either
+// to /webhooks/generic/, in which case all generic deployments are
+// considered, or to /webhooks/generic/<name>, to target the single
+// deployment.
+type Generic struct {
+	deps []genericDep
+}
+
+type genericDep struct {
+	dep   deploysrv.Deployment
+	cfg   generic
+	hash  func() hash.Hash
+	conds []condition
+	vars  map[string]jsonPath
+}
+
+// generic is the deployment payload configuration.
+type generic struct {
+	// Auth is the webhook authentication.
+	Auth genericAuth `yaml:"auth"`
+	// Match are the conditions, that all must be true for the deployment to
+	// run.  If empty, any authenticated request triggers the deployment.
+	Match []genericMatch `yaml:"match,omitempty"`
+	// Vars maps the trigger variable names to JSONPath expressions, i.e.
+	// "tag: $.build.tag".  Missing values are set to an empty string.
+	Vars map[string]string `yaml:"vars,omitempty"`
+}
+
+// genericAuth is the authentication configuration, either the Token or the
+// HMAC Secret must be set.
+type genericAuth struct {
+	// Header is the request header with the token or signature, defaults to
+	// X-Hubdeploy-Token for the token, and X-Hubdeploy-Signature for HMAC.
+	Header string `yaml:"header,omitempty"`
+	// Prefix is stripped from the header value, i.e. "Bearer " or
+	// "sha256=".
+	Prefix string `yaml:"prefix,omitempty"`
+	// Token is the shared token, that is sent in the header as is.
+	Token string `yaml:"token,omitempty"`
+	// Secret is the HMAC secret, the header should contain the hex encoded
+	// HMAC of the request body.
+	Secret string `yaml:"secret,omitempty"`
+	// Algorithm is the HMAC hash algorithm: sha1, sha256 (default) or
+	// sha512.
+	Algorithm string `yaml:"algorithm,omitempty"`
+}
+
+// genericMatch is the match condition on the value at Path.  If several
+// operators are set, all of them must match.
+type genericMatch struct {
+	// Path is the JSONPath expression, i.e. $.build.status.
+	Path string `yaml:"path"`
+	// Exists checks the presence (or absence, if false) of the value.
+	Exists *bool `yaml:"exists,omitempty"`
+	// Equals is the exact value.
+	Equals *string `yaml:"equals,omitempty"`
+	// In is the list of allowed values.
+	In []string `yaml:"in,omitempty"`
+	// Glob is the glob pattern (see [path.Match]).
+	Glob string `yaml:"glob,omitempty"`
+	// Regex is the regular expression.
+	Regex string `yaml:"regex,omitempty"`
+}
+
+// condition is the compiled match condition.
+type condition struct {
+	genericMatch
+	path jsonPath
+	re   *regexp.Regexp
+}
+
+func (*Generic) Type() string {
+	return DTGeneric
+}
+
+func (g *Generic) Register(dep deploysrv.Deployment) error {
+	var cfg generic
+	if err := shared.UnmarshalPayload(dep.Payload, &cfg); err != nil {
+		return err
+	}
+	gd, err := newGenericDep(dep, cfg)
+	if err != nil {
+		return fmt.Errorf("generic: %w", err)
+	}
+	g.deps = append(g.deps, gd)
+	return nil
+}
+
+// newGenericDep validates the configuration and compiles the paths and
+// conditions.
+func newGenericDep(dep deploysrv.Deployment, cfg generic) (genericDep, error) {
+	gd := genericDep{dep: dep, vars: make(map[string]jsonPath, len(cfg.Vars))}
+
+	a := &cfg.Auth
+	switch {
+	case a.Token != "" && a.Secret != "":
+		return gd, errors.New("auth: token and secret are mutually exclusive")
+	case a.Token != "":
+		if a.Algorithm != "" {
+			return gd, errors.New("auth: algorithm is only used with secret")
+		}
+		if a.Header == "" {
+			a.Header = defGenericTokenHeader
+		}
+	case a.Secret != "":
+		if a.Algorithm == "" {
+			a.Algorithm = defGenericAlgorithm
+		}
+		var ok bool
+		if gd.hash, ok = hmacAlgorithms[a.Algorithm]; !ok {
+			return gd, fmt.Errorf("auth: unsupported algorithm: %q", a.Algorithm)
+		}
+		if a.Header == "" {
+			a.Header = defGenericSigHeader
+		}
+	default:
+		return gd, errors.New("auth: token or secret must be set")
+	}
+
+	for _, m := range cfg.Match {
+		c := condition{genericMatch: m}
+		var err error
+		if c.path, err = parseJSONPath(m.Path); err != nil {
+			return gd, err
+		}
+		if m.Exists == nil && m.Equals == nil && len(m.In) == 0 && m.Glob == "" && m.Regex == "" {
+			return gd, fmt.Errorf("match %q: no operator", m.Path)
+		}
+		if m.Glob != "" {
+			if err := validPatterns([]string{m.Glob}); err != nil {
+				return gd, fmt.Errorf("match %q: %w", m.Path, err)
+			}
+		}
+		if m.Regex != "" {
+			if c.re, err = regexp.Compile(m.Regex); err != nil {
+				return gd, fmt.Errorf("match %q: %w", m.Path, err)
+			}
+		}
+		gd.conds = append(gd.conds, c)
+	}
+
+	for name, expr := range cfg.Vars {
+		if !reVarName.MatchString(name) {
+			return gd, fmt.Errorf("invalid variable name: %q", name)
+		}
+		p, err := parseJSONPath(expr)
+		if err != nil {
+			return gd, err
+		}
+		gd.vars[name] = p
+	}
+	gd.cfg = cfg
+	return gd, nil
+}
+
+func (g *Generic) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			dlog.Printf("generic: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		target := targetName(r.URL.Path)
+
+		var authed []genericDep
+		for _, gd := range g.deps {
+			if target != "" && gd.dep.Name != target {
+				continue
+			}
+			if gd.authenticated(r.Header, body) {
+				authed = append(authed, gd)
+			}
+		}
+		if len(authed) == 0 {
+			dlog.Printf("generic: 401 request not authenticated (target: %q)", target)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc any
+		if err := dec.Decode(&doc); err != nil {
+			dlog.Printf("generic: 400 invalid body: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		var queued int
+		for _, gd := range authed {
+			if !gd.matches(doc) {
+				continue
+			}
+			if gd.dep.Disabled {
+				dlog.Printf("generic: [%s] deployment is disabled", gd.dep.Name)
+				continue
+			}
+			vars := gd.extract(doc)
+			dlog.Printf("generic: [%s] conditions matched, queueing deployment, vars: %v", gd.dep.Name, vars)
+			j <- deploysrv.Job{
+				Dep:     gd.dep,
+				Trigger: deploysrv.Trigger{Source: DTGeneric, Vars: vars},
+			}
+			queued++
+		}
+		// the request is valid, it just doesn't satisfy the conditions, the
+		// sender should not treat it as a failure.
+		if queued == 0 {
+			dlog.Printf("generic: no deployments matched (target: %q)", target)
+			w.Write([]byte("no matching deployments"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	}
+}
+
+// targetName returns the deployment name from the request path
+// /webhooks/generic/<name>, or an empty string, if it's not set.
+func targetName(urlPath string) string {
+	const sep = "/webhooks/" + DTGeneric + "/"
+	i := strings.LastIndex(urlPath, sep)
+	if i == -1 {
+		return ""
+	}
+	return strings.Trim(urlPath[i+len(sep):], "/")
+}
+
+// authenticated reports whether the request headers contain the valid token
+// or the HMAC signature of the body.
+func (gd *genericDep) authenticated(h http.Header, body []byte) bool {
+	a := gd.cfg.Auth
+	val, ok := strings.CutPrefix(h.Get(a.Header), a.Prefix)
+	if !ok || val == "" {
+		return false
+	}
+	if a.Token != "" {
+		return subtle.ConstantTimeCompare([]byte(a.Token), []byte(val)) == 1
+	}
+	return validHMAC(gd.hash, a.Secret, body, strings.ToLower(val))
+}
+
+// matches reports whether the document satisfies all conditions.
+func (gd *genericDep) matches(doc any) bool {
+	for _, c := range gd.conds {
+		if !c.match(doc) {
+			dlog.Debugf("generic: [%s] condition on %q not satisfied", gd.dep.Name, c.Path)
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether the value at the condition path satisfies all the
+// condition operators.
+func (c *condition) match(doc any) bool {
+	v, found := c.path.lookup(doc)
+	if c.Exists != nil && *c.Exists != found {
+		return false
+	}
+	if c.Equals == nil && len(c.In) == 0 && c.Glob == "" && c.re == nil {
+		return true // only the existence check.
+	}
+	if !found {
+		return false
+	}
+	s := jsonString(v)
+	if c.Equals != nil && *c.Equals != s {
+		return false
+	}
+	if len(c.In) > 0 && !slices.Contains(c.In, s) {
+		return false
+	}
+	if c.Glob != "" {
+		if ok, err := path.Match(c.Glob, s); err != nil || !ok {
+			return false
+		}
+	}
+	if c.re != nil && !c.re.MatchString(s) {
+		return false
+	}
+	return true
+}
+
+// extract returns the trigger variables extracted from the document.
+func (gd *genericDep) extract(doc any) map[string]string {
+	vars := make(map[string]string, len(gd.vars))
+	for name, p := range gd.vars {
+		v, _ := p.lookup(doc)
+		vars[name] = jsonString(v)
+	}
+	return vars
+}
+
+// Callback does nothing, generic webhook senders don't accept any results.
+func (*Generic) Callback(deploysrv.CallbackData) error {
+	return nil
+}
@@ -0,0 +1,249 @@
+package hookers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+var genericValid = []string{`---
+name: jenkins
+type: generic
+payload:
+  auth:
+    header: Authorization
+    prefix: "Bearer "
+    token: j-token
+  match:
+    - path: $.build.phase
+      equals: FINALIZED
+    - path: $.build.status
+      in: [SUCCESS, UNSTABLE]
+    - path: $.build.parameters["image.tag"]
+      glob: "v*"
+  vars:
+    tag: $.build.parameters["image.tag"]
+    number: $.build.number
+    missing: $.nope
+`, `---
+name: drone
+type: generic
+payload:
+  auth:
+    header: X-Signature
+    prefix: "sha1="
+    secret: d-secret
+    algorithm: sha1
+  match:
+    - path: $.repo.slug
+      regex: ^acme/
+    - path: $.commits[0].id
+      exists: true
+  vars:
+    repo: $.repo.slug
+    sha: $.commits[0].id
+`}
+
+func hmacSHA1(secret, body string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestGeneric_Register(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{"token", "payload:\n  auth: {token: x}\n", false},
+		{"hmac", "payload:\n  auth: {secret: x, algorithm: sha512}\n", false},
+		{"no auth", "payload:\n  vars: {tag: $.tag}\n", true},
+		{"token and secret", "payload:\n  auth: {token: x, secret: y}\n", true},
+		{"bad algorithm", "payload:\n  auth: {secret: x, algorithm: md5}\n", true},
+		{"bad path", "payload:\n  auth: {token: x}\n  vars: {tag: tag}\n", true},
+		{"bad var name", "payload:\n  auth: {token: x}\n  vars: {1tag: $.tag}\n", true},
+		{"no operator", "payload:\n  auth: {token: x}\n  match: [{path: $.tag}]\n", true},
+		{"bad regex", "payload:\n  auth: {token: x}\n  match: [{path: $.tag, regex: '('}]\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := new(Generic).Register(mustDeployment(t, tt.src)); (err != nil) != tt.wantErr {
+				t.Errorf("Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGeneric_Handler(t *testing.T) {
+	const (
+		jenkinsOK = `{"build":{"phase":"FINALIZED","status":"SUCCESS","number":42,"parameters":{"image.tag":"v1.2"}}}`
+		droneOK   = `{"repo":{"slug":"acme/web"},"commits":[{"id":"` + testSHA + `"}]}`
+	)
+	tests := []struct {
+		name     string
+		target   string
+		body     string
+		headers  map[string]string
+		wantCode int
+		wantDep  string
+		wantVars map[string]string
+	}{
+		{
+			name:     "token",
+			body:     jenkinsOK,
+			headers:  map[string]string{"Authorization": "Bearer j-token"},
+			wantCode: http.StatusOK,
+			wantDep:  "jenkins",
+			wantVars: map[string]string{"tag": "v1.2", "number": "42", "missing": ""},
+		},
+		{
+			name:     "invalid token",
+			body:     jenkinsOK,
+			headers:  map[string]string{"Authorization": "Bearer wrong"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "conditions not satisfied",
+			body:     `{"build":{"phase":"FINALIZED","status":"FAILURE","parameters":{"image.tag":"v1.2"}}}`,
+			headers:  map[string]string{"Authorization": "Bearer j-token"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "hmac",
+			body:     droneOK,
+			headers:  map[string]string{"X-Signature": "sha1=" + hmacSHA1("d-secret", droneOK)},
+			wantCode: http.StatusOK,
+			wantDep:  "drone",
+			wantVars: map[string]string{"repo": "acme/web", "sha": testSHA},
+		},
+		{
+			name:     "invalid hmac",
+			body:     droneOK,
+			headers:  map[string]string{"X-Signature": "sha1=" + hmacSHA1("wrong", droneOK)},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "exists not satisfied",
+			body:     `{"repo":{"slug":"acme/web"},"commits":[]}`,
+			headers:  map[string]string{"X-Signature": "sha1=" + hmacSHA1("d-secret", `{"repo":{"slug":"acme/web"},"commits":[]}`)},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "targeted deployment",
+			target:   "jenkins",
+			body:     jenkinsOK,
+			headers:  map[string]string{"Authorization": "Bearer j-token"},
+			wantCode: http.StatusOK,
+			wantDep:  "jenkins",
+			wantVars: map[string]string{"tag": "v1.2", "number": "42", "missing": ""},
+		},
+		{
+			name:     "other deployment credentials",
+			target:   "drone",
+			body:     jenkinsOK,
+			headers:  map[string]string{"Authorization": "Bearer j-token"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "invalid json",
+			body:     `{`,
+			headers:  map[string]string{"Authorization": "Bearer j-token"},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := new(Generic)
+			mustRegister(t, g, genericValid...)
+			jobs := make(chan deploysrv.Job, 10)
+
+			r := httptest.NewRequest(http.MethodPost, "/webhooks/generic/"+tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			g.Handler(jobs)(w, r)
+			close(jobs)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.wantCode, w.Body.String())
+			}
+			j, ok := <-jobs
+			if ok != (tt.wantDep != "") {
+				t.Fatalf("job queued = %v, want %v", ok, tt.wantDep != "")
+			}
+			if !ok {
+				return
+			}
+			if _, more := <-jobs; more {
+				t.Fatal("more than one job queued")
+			}
+			if j.Dep.Name != tt.wantDep || j.Trigger.Source != DTGeneric {
+				t.Errorf("deployment, source = %q, %q", j.Dep.Name, j.Trigger.Source)
+			}
+			if len(j.Trigger.Vars) != len(tt.wantVars) {
+				t.Errorf("vars = %v, want %v", j.Trigger.Vars, tt.wantVars)
+			}
+			for k, v := range tt.wantVars {
+				if j.Trigger.Vars[k] != v {
+					t.Errorf("var %q = %q, want %q", k, j.Trigger.Vars[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	var doc any
+	dec := json.NewDecoder(strings.NewReader(`{"a":{"b":[{"c":"x"},{"d":true}],"e.f":1.50,"g":null,"h":{"i":1}}}`))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path      string
+		want      string
+		wantFound bool
+		wantErr   bool
+	}{
+		{"$.a.b[0].c", "x", true, false},
+		{"$.a.b[1].d", "true", true, false},
+		{`$.a["e.f"]`, "1.50", true, false},
+		{"$.a['g']", "", true, false},
+		{"$.a.h", `{"i":1}`, true, false},
+		{"$.a.b[2]", "", false, false},
+		{"$.a.b.c", "", false, false},
+		{"$.a.x", "", false, false},
+		{"$", "", true, false},
+		{"a.b", "", false, true},
+		{"$.a..b", "", false, true},
+		{"$.a[x]", "", false, true},
+		{"$.a[0", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			p, err := parseJSONPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJSONPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			v, found := p.lookup(doc)
+			if found != tt.wantFound {
+				t.Fatalf("found = %v, want %v", found, tt.wantFound)
+			}
+			if tt.path != "$" && jsonString(v) != tt.want {
+				t.Errorf("value = %q, want %q", jsonString(v), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package hookers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// DTGitea is the Gitea deployment type, it's also used for Forgejo, which
+// sends the same webhooks.
+const DTGitea = "gitea"
+
+// gtStatusDescSz is the maximum length of the commit status description.
+const gtStatusDescSz = 255
+
+// Gitea event types.
+const (
+	gtPush    = "push"
+	gtRelease = "release"
+	gtPackage = "package"
+)
+
+// Gitea handles the Gitea and Forgejo webhooks.
+type Gitea struct {
+	deps []giteaDep
+}
+
+type giteaDep = hookDep[giteaConfig]
+
+// Payloads, see https://docs.gitea.com/usage/webhooks
+
+type giteaPush struct {
+	Ref        string          `json:"ref"`
+	Before     string          `json:"before"`
+	After      string          `json:"after"`
+	CompareURL string          `json:"compare_url"`
+	Repository giteaRepository `json:"repository"`
+	Pusher     giteaUser       `json:"pusher"`
+	Sender     giteaUser       `json:"sender"`
+}
+
+type giteaRelease struct {
+	Action     string          `json:"action"`
+	Release    giteaReleaseObj `json:"release"`
+	Repository giteaRepository `json:"repository"`
+	Sender     giteaUser       `json:"sender"`
+}
+
+type giteaReleaseObj struct {
+	ID              int64  `json:"id"`
+	TagName         string `json:"tag_name"`
+	TargetCommitish string `json:"target_commitish"`
+	Name            string `json:"name"`
+	Draft           bool   `json:"draft"`
+	Prerelease      bool   `json:"prerelease"`
+}
+
+type giteaPackage struct {
+	Action     string          `json:"action"`
+	Package    giteaPackageObj `json:"package"`
+	Repository giteaRepository `json:"repository"`
+	Sender     giteaUser       `json:"sender"`
+}
+
+type giteaPackageObj struct {
+	ID      int64     `json:"id"`
+	Owner   giteaUser `json:"owner"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Version string    `json:"version"`
+	HTMLURL string    `json:"html_url"`
+}
+
+type giteaRepository struct {
+	ID       int64     `json:"id"`
+	Owner    giteaUser `json:"owner"`
+	Name     string    `json:"name"`
+	FullName string    `json:"full_name"`
+	Private  bool      `json:"private"`
+	HTMLURL  string    `json:"html_url"`
+}
+
+type giteaUser struct {
+	ID       int64  `json:"id"`
+	Login    string `json:"login"`
+	Username string `json:"username"`
+}
+
+type giteaStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// giteaConfig is the deployment payload configuration.
+type giteaConfig struct {
+	// Repository is the full repository name, i.e. "owner/repo".  Package
+	// events are matched by the repository owner.
+	Repository string `yaml:"repository"`
+	// Secret is the webhook secret.
+	Secret string `yaml:"secret"`
+	// Events is the list of events that trigger the deployment, default is
+	// push.
+	Events []string `yaml:"events,omitempty"`
+	// Refs are the ref patterns for the push event.
+	Refs []string `yaml:"refs,omitempty"`
+	// Tags are the release tag patterns.
+	Tags []string `yaml:"tags,omitempty"`
+	// Packages are the package name patterns.
+	Packages []string `yaml:"packages,omitempty"`
+	// Versions are the package version patterns.
+	Versions []string `yaml:"versions,omitempty"`
+	// Status is the commit status reporting configuration, if not set, no
+	// status is reported.
+	Status *giteaStatusConfig `yaml:"status,omitempty"`
+}
+
+type giteaStatusConfig struct {
+	// Token is the API access token.
+	Token string `yaml:"token"`
+	// URL is the Gitea server base URL, i.e. https://gitea.example.com.
+	URL string `yaml:"url"`
+	// Context is the status context, default is "hubdeploy/<name>".
+	Context string `yaml:"context,omitempty"`
+}
+
+// gtTrigger is the normalised event.
+type gtTrigger struct {
+	event   string
+	repo    string
+	owner   string
+	ref     string
+	tag     string
+	pkg     string
+	version string
+	sha     string
+	sender  string
+}
+
+func (*Gitea) Type() string {
+	return DTGitea
+}
+
+func (g *Gitea) Register(dep deploysrv.Deployment) error {
+	var cfg giteaConfig
+	if err := shared.UnmarshalPayload(dep.Payload, &cfg); err != nil {
+		return err
+	}
+	if !strings.Contains(cfg.Repository, "/") {
+		return fmt.Errorf("gitea: invalid repository %q, want owner/repo", cfg.Repository)
+	}
+	if cfg.Secret == "" {
+		return errors.New("gitea: secret is not set")
+	}
+	if len(cfg.Events) == 0 {
+		cfg.Events = []string{gtPush}
+	}
+	for _, ev := range cfg.Events {
+		switch ev {
+		case gtPush, gtRelease, gtPackage:
+		default:
+			return fmt.Errorf("gitea: unsupported event %q", ev)
+		}
+	}
+	for _, pp := range [][]string{cfg.Refs, cfg.Tags, cfg.Packages, cfg.Versions} {
+		if err := validPatterns(pp); err != nil {
+			return fmt.Errorf("gitea: %w", err)
+		}
+	}
+	if cfg.Status != nil {
+		if cfg.Status.Token == "" || cfg.Status.URL == "" {
+			return errors.New("gitea: status token and url must be set")
+		}
+		if cfg.Status.Context == "" {
+			cfg.Status.Context = "hubdeploy/" + dep.Name
+		}
+	}
+	g.deps = append(g.deps, giteaDep{dep: dep, cfg: cfg})
+	return nil
+}
+
+func (g *Gitea) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			dlog.Printf("gitea: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		event := r.Header.Get("X-Gitea-Event")
+		trg, ok, err := parseGitea(event, body)
+		if err != nil {
+			dlog.Printf("gitea: 400 invalid body: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// unknown repository gets the same response as the invalid
+		// signature, so that the configured repositories can't be
+		// enumerated.
+		var candidates []giteaDep
+		for _, gd := range g.deps {
+			if gd.cfg.owns(trg) {
+				candidates = append(candidates, gd)
+			}
+		}
+		sig := r.Header.Get("X-Gitea-Signature")
+		var verified []giteaDep
+		for _, gd := range candidates {
+			if validHMAC(sha256.New, gd.cfg.Secret, body, sig) {
+				verified = append(verified, gd)
+			}
+		}
+		if len(verified) == 0 {
+			if len(candidates) == 0 {
+				dlog.Printf("gitea: no deployment for repository: %q", trg.repo)
+			} else {
+				dlog.Printf("gitea: [%s] invalid signature", trg.repo)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !ok {
+			dlog.Printf("gitea: [%s] ignoring %q event", trg.repo, event)
+			w.Write([]byte("ignored"))
+			return
+		}
+
+		var queued int
+		for _, gd := range verified {
+			if !gd.cfg.matches(trg) {
+				continue
+			}
+			if gd.dep.Disabled {
+				dlog.Printf("gitea: [%s] deployment %q is disabled", trg.repo, gd.dep.Name)
+				continue
+			}
+			dlog.Printf("gitea: [%s] %s event by %q, queueing deployment %q", trg.repo, trg.event, trg.sender, gd.dep.Name)
+			j <- deploysrv.Job{
+				Dep:         gd.dep,
+				CallbackURL: gd.cfg.statusURL(trg),
+				Trigger:     deploysrv.Trigger{Source: DTGitea, Vars: trg.vars()},
+			}
+			queued++
+		}
+		if queued == 0 {
+			dlog.Printf("gitea: [%s] no deployment for %s event", trg.repo, trg.event)
+			http.Error(w, "no deployment for this event", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	}
+}
+
+// parseGitea parses the event body.  It returns false if the event should be
+// ignored, i.e. release is not published, or event type is not supported.
+func parseGitea(event string, body []byte) (gtTrigger, bool, error) {
+	t := gtTrigger{event: event}
+	switch event {
+	case gtPush:
+		var p giteaPush
+		if err := json.Unmarshal(body, &p); err != nil {
+			return t, false, err
+		}
+		t.repo, t.owner, t.sender = p.Repository.FullName, p.Repository.Owner.Login, p.Pusher.Login
+		t.ref, t.sha = p.Ref, p.After
+		if tag, ok := strings.CutPrefix(p.Ref, "refs/tags/"); ok {
+			t.tag = tag
+		}
+		return t, true, nil
+	case gtRelease:
+		var p giteaRelease
+		if err := json.Unmarshal(body, &p); err != nil {
+			return t, false, err
+		}
+		t.repo, t.owner, t.sender = p.Repository.FullName, p.Repository.Owner.Login, p.Sender.Login
+		t.tag, t.ref = p.Release.TagName, "refs/tags/"+p.Release.TagName
+		if reSHA.MatchString(p.Release.TargetCommitish) {
+			t.sha = p.Release.TargetCommitish
+		}
+		return t, p.Action == "published" && !p.Release.Draft, nil
+	case gtPackage:
+		var p giteaPackage
+		if err := json.Unmarshal(body, &p); err != nil {
+			return t, false, err
+		}
+		t.repo, t.owner, t.sender = p.Repository.FullName, p.Package.Owner.Login, p.Sender.Login
+		t.pkg, t.version = p.Package.Name, p.Package.Version
+		t.tag = p.Package.Version
+		return t, p.Action == "created", nil
+	default:
+		// still need the repository to authenticate the request.
+		var p giteaPush
+		if err := json.Unmarshal(body, &p); err != nil {
+			return t, false, err
+		}
+		t.repo, t.owner = p.Repository.FullName, p.Repository.Owner.Login
+		return t, false, nil
+	}
+}
+
+// owns reports whether the event belongs to the configured repository.
+func (c *giteaConfig) owns(t gtTrigger) bool {
+	if t.repo != "" && strings.EqualFold(c.Repository, t.repo) {
+		return true
+	}
+	// package events may not be linked to the repository.
+	owner, _, _ := strings.Cut(c.Repository, "/")
+	return t.event == gtPackage && t.repo == "" && strings.EqualFold(owner, t.owner)
+}
+
+// matches reports whether the deployment configuration matches the event.
+func (c *giteaConfig) matches(t gtTrigger) bool {
+	if !slices.Contains(c.Events, t.event) {
+		return false
+	}
+	switch t.event {
+	case gtPush:
+		return matchAny(c.Refs, t.ref)
+	case gtRelease:
+		return matchAny(c.Tags, t.tag)
+	case gtPackage:
+		return matchAny(c.Packages, t.pkg) && matchAny(c.Versions, t.version)
+	}
+	return false
+}
+
+// statusURL returns the commit status URL, or an empty string, if the status
+// reporting is not configured or there's no commit SHA.
+func (c *giteaConfig) statusURL(t gtTrigger) string {
+	if c.Status == nil || t.sha == "" {
+		return ""
+	}
+	return strings.TrimRight(c.Status.URL, "/") + "/api/v1/repos/" + c.Repository + "/statuses/" + t.sha
+}
+
+// vars returns the trigger variables.
+func (t gtTrigger) vars() map[string]string {
+	return triggerVars(map[string]string{
+		"repo":   t.repo,
+		"event":  t.event,
+		"sender": t.sender,
+	}, map[string]string{
+		"ref":     t.ref,
+		"tag":     t.tag,
+		"sha":     t.sha,
+		"package": t.pkg,
+		"version": t.version,
+	})
+}
+
+// Callback reports the result as the commit status.
+func (g *Gitea) Callback(data deploysrv.CallbackData) error {
+	return g.CallbackContext(context.Background(), data)
+}
+
+// CallbackContext reports the result as the commit status, the request is
+// cancelled with the context.
+func (g *Gitea) CallbackContext(ctx context.Context, data deploysrv.CallbackData) error {
+	if data.CallbackURL == "" {
+		return nil
+	}
+	gd, ok := byName(g.deps, data.Name)
+	if !ok || gd.cfg.Status == nil {
+		return fmt.Errorf("gitea: no status configuration for deployment %q", data.Name)
+	}
+	state := commitState(data)
+	descr := data.Description
+	if data.Error != nil {
+		descr = data.Error.Error()
+	}
+	b, err := json.Marshal(giteaStatus{
+		State:       state,
+		TargetURL:   data.ResultsURL,
+		Description: shared.Truncate(fmt.Sprintf("[%s]: %s", data.ID, descr), gtStatusDescSz),
+		Context:     gd.cfg.Status.Context,
+	})
+	if err != nil {
+		return err
+	}
+	dlog.Printf("%s> [%s] posting commit status to %s", data.ID, data.Name, data.CallbackURL)
+	return postJSON(ctx, data.CallbackURL, b, map[string]string{"Authorization": "token " + gd.cfg.Status.Token})
+}
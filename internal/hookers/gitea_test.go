@@ -0,0 +1,242 @@
+package hookers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/google/uuid"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+var giteaValid = `---
+name: gitea-web
+type: gitea
+payload:
+  repository: rusq/web
+  secret: s3cr3t
+  events: [push, release, package]
+  refs: [refs/heads/main]
+  tags: ["v*"]
+  packages: [web]
+  status:
+    token: gt-token
+    url: https://gitea.example.test
+`
+
+var giteaInvalid = `---
+type: gitea
+payload:
+  repository: web
+  secret: s3cr3t
+`
+
+var giteaDepValid, giteaDepInvalid deploysrv.Deployment
+
+func init() {
+	if err := yaml.Unmarshal([]byte(giteaValid), &giteaDepValid); err != nil {
+		panic(err)
+	}
+	if err := yaml.Unmarshal([]byte(giteaInvalid), &giteaDepInvalid); err != nil {
+		panic(err)
+	}
+}
+
+func TestGitea_Register(t *testing.T) {
+	type fields struct {
+		deps []giteaDep
+	}
+	type args struct {
+		dep deploysrv.Deployment
+	}
+	tests := []struct {
+		name    string
+		fields  fields
+		args    args
+		wantErr bool
+	}{
+		{"valid", fields{}, args{giteaDepValid}, false},
+		{"invalid repository", fields{}, args{giteaDepInvalid}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Gitea{
+				deps: tt.fields.deps,
+			}
+			if err := g.Register(tt.args.dep); (err != nil) != tt.wantErr {
+				t.Errorf("Gitea.Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGitea_Handler(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    string
+		body     string
+		secret   string
+		wantCode int
+		wantJob  bool
+		wantVars map[string]string
+	}{
+		{
+			name:     "push to main",
+			event:    "push",
+			body:     `{"ref":"refs/heads/main","after":"` + testSHA + `","repository":{"full_name":"rusq/web","owner":{"login":"rusq"}},"pusher":{"login":"dev"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+			wantJob:  true,
+			wantVars: map[string]string{"repo": "rusq/web", "ref": "refs/heads/main", "sha": testSHA, "event": "push", "sender": "dev"},
+		},
+		{
+			name:     "push to branch",
+			event:    "push",
+			body:     `{"ref":"refs/heads/dev","repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid signature",
+			event:    "push",
+			body:     `{"ref":"refs/heads/main","repository":{"full_name":"rusq/web"}}`,
+			secret:   "wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown repository",
+			event:    "push",
+			body:     `{"ref":"refs/heads/main","repository":{"full_name":"rusq/other"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "release published",
+			event:    "release",
+			body:     `{"action":"published","release":{"tag_name":"v1.0.0","target_commitish":"main"},"repository":{"full_name":"rusq/web"},"sender":{"login":"dev"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+			wantJob:  true,
+			wantVars: map[string]string{"repo": "rusq/web", "ref": "refs/tags/v1.0.0", "tag": "v1.0.0", "event": "release", "sender": "dev"},
+		},
+		{
+			name:     "release updated is ignored",
+			event:    "release",
+			body:     `{"action":"updated","release":{"tag_name":"v1.0.0"},"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "package without repository",
+			event:    "package",
+			body:     `{"action":"created","package":{"name":"web","version":"1.2","owner":{"login":"rusq"}},"sender":{"login":"ci"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+			wantJob:  true,
+			wantVars: map[string]string{"repo": "", "package": "web", "version": "1.2", "tag": "1.2", "event": "package", "sender": "ci"},
+		},
+		{
+			name:     "unsupported event",
+			event:    "issues",
+			body:     `{"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Gitea{}
+			if err := g.Register(giteaDepValid); err != nil {
+				t.Fatal(err)
+			}
+			jobs := make(chan deploysrv.Job, 1)
+
+			r := httptest.NewRequest(http.MethodPost, "/webhooks/gitea/", strings.NewReader(tt.body))
+			r.Header.Set("X-Gitea-Event", tt.event)
+			r.Header.Set("X-Gitea-Signature", hmacSHA256(tt.secret, tt.body))
+			w := httptest.NewRecorder()
+			g.Handler(jobs)(w, r)
+			close(jobs)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.wantCode, w.Body.String())
+			}
+			j, ok := <-jobs
+			if ok != tt.wantJob {
+				t.Fatalf("job queued = %v, want %v", ok, tt.wantJob)
+			}
+			if !ok {
+				return
+			}
+			if len(j.Trigger.Vars) != len(tt.wantVars) {
+				t.Errorf("vars = %v, want %v", j.Trigger.Vars, tt.wantVars)
+			}
+			for k, v := range tt.wantVars {
+				if j.Trigger.Vars[k] != v {
+					t.Errorf("var %q = %q, want %q", k, j.Trigger.Vars[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestGitea_Callback(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		wantErr    bool
+	}{
+		{name: "ok", statusCode: http.StatusCreated},
+		{name: "bad status", statusCode: http.StatusBadGateway, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got     giteaStatus
+				gotAuth string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer r.Body.Close()
+				gotAuth = r.Header.Get("Authorization")
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Fatalf("decode callback body: %v", err)
+				}
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer srv.Close()
+
+			g := &Gitea{}
+			if err := g.Register(giteaDepValid); err != nil {
+				t.Fatal(err)
+			}
+			err := g.Callback(deploysrv.CallbackData{
+				ID:          uuid.Must(uuid.NewUUID()),
+				Name:        "gitea-web",
+				CallbackURL: srv.URL + "/api/v1/repos/rusq/web/statuses/" + testSHA,
+				Description: "deployed OK",
+				ResultsURL:  "https://example.test/results/id.txt",
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Callback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if gotAuth != "token gt-token" {
+				t.Fatalf("authorization = %q, want %q", gotAuth, "token gt-token")
+			}
+			if got.Context != "hubdeploy/gitea-web" {
+				t.Fatalf("status context = %q, want %q", got.Context, "hubdeploy/gitea-web")
+			}
+			if got.TargetURL != "https://example.test/results/id.txt" {
+				t.Fatalf("status target_url = %q, want %q", got.TargetURL, "https://example.test/results/id.txt")
+			}
+			if got.State != ssuccess {
+				t.Fatalf("status state = %q, want %q", got.State, ssuccess)
+			}
+		})
+	}
+}
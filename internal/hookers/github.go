@@ -0,0 +1,406 @@
+package hookers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+const DTGitHub = "github"
+
+// GitHub event types.
+const (
+	ghPush        = "push"
+	ghRelease     = "release"
+	ghPackage     = "package"
+	ghWorkflowRun = "workflow_run"
+	ghPing        = "ping"
+)
+
+const (
+	defGitHubAPI   = "https://api.github.com"
+	ghStatusDescSz = 140
+)
+
+var reSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// zeroSHA is the commit SHA of the deleted ref in the push events.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// GitHub handles the GitHub webhooks.
+type GitHub struct {
+	deps []githubDep
+}
+
+type githubDep = hookDep[githubConfig]
+
+// githubConfig is the GitHub deployment payload configuration.
+type githubConfig struct {
+	// Repository is the full repository name, i.e. "rusq/hubdeploy".
+	Repository string `yaml:"repository"`
+	// Secret is the webhook secret.
+	Secret string `yaml:"secret"`
+	// Events is the list of events that trigger the deployment, default is
+	// push.
+	Events []string `yaml:"events,omitempty"`
+	// Refs are the ref patterns for the push and workflow_run events, i.e.
+	// "refs/heads/main" or "refs/tags/v*".
+	Refs []string `yaml:"refs,omitempty"`
+	// Tags are the release tag patterns.
+	Tags []string `yaml:"tags,omitempty"`
+	// Packages are the package name patterns.
+	Packages []string `yaml:"packages,omitempty"`
+	// Versions are the package version patterns.
+	Versions []string `yaml:"versions,omitempty"`
+	// Workflows are the workflow name patterns for the workflow_run event.
+	Workflows []string `yaml:"workflows,omitempty"`
+	// Status is the commit status reporting configuration, if not set, no
+	// status is reported.
+	Status *githubStatus `yaml:"status,omitempty"`
+}
+
+type githubStatus struct {
+	// Token is the API token with the commit status write permission.
+	Token string `yaml:"token"`
+	// APIURL is the API base URL, default is https://api.github.com.
+	APIURL string `yaml:"api_url,omitempty"`
+	// Context is the status context, default is "hubdeploy/<name>".
+	Context string `yaml:"context,omitempty"`
+}
+
+// ghEvent is the union of the fields of the supported events.
+type ghEvent struct {
+	Action string `json:"action"`
+	Ref    string `json:"ref"`
+	After  string `json:"after"`
+	// Deleted is set for the push events, that delete the ref.
+	Deleted    bool `json:"deleted"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	Release *struct {
+		TagName         string `json:"tag_name"`
+		TargetCommitish string `json:"target_commitish"`
+	} `json:"release"`
+	Package *struct {
+		Name           string `json:"name"`
+		PackageVersion struct {
+			Version           string `json:"version"`
+			TargetOID         string `json:"target_oid"`
+			ContainerMetadata struct {
+				Tag struct {
+					Name   string `json:"name"`
+					Digest string `json:"digest"`
+				} `json:"tag"`
+			} `json:"container_metadata"`
+		} `json:"package_version"`
+	} `json:"package"`
+	WorkflowRun *struct {
+		Name       string `json:"name"`
+		HeadBranch string `json:"head_branch"`
+		HeadSHA    string `json:"head_sha"`
+		Status     string `json:"status"`
+		Conclusion string `json:"conclusion"`
+	} `json:"workflow_run"`
+}
+
+// ghTrigger is the normalised event.
+type ghTrigger struct {
+	event    string
+	repo     string
+	ref      string
+	tag      string
+	pkg      string
+	version  string
+	workflow string
+	sha      string
+	digest   string
+	sender   string
+}
+
+type ghStatusReq struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+func (*GitHub) Type() string {
+	return DTGitHub
+}
+
+func (g *GitHub) Register(dep deploysrv.Deployment) error {
+	var cfg githubConfig
+	if err := shared.UnmarshalPayload(dep.Payload, &cfg); err != nil {
+		return err
+	}
+	if cfg.Repository == "" {
+		return errors.New("github: repository is not set")
+	}
+	if cfg.Secret == "" {
+		return errors.New("github: secret is not set")
+	}
+	if len(cfg.Events) == 0 {
+		cfg.Events = []string{ghPush}
+	}
+	for _, ev := range cfg.Events {
+		switch ev {
+		case ghPush, ghRelease, ghPackage, ghWorkflowRun:
+		default:
+			return fmt.Errorf("github: unsupported event %q", ev)
+		}
+	}
+	for _, pp := range [][]string{cfg.Refs, cfg.Tags, cfg.Packages, cfg.Versions, cfg.Workflows} {
+		if err := validPatterns(pp); err != nil {
+			return fmt.Errorf("github: %w", err)
+		}
+	}
+	if cfg.Status != nil {
+		if cfg.Status.Token == "" {
+			return errors.New("github: status token is not set")
+		}
+		if cfg.Status.APIURL == "" {
+			cfg.Status.APIURL = defGitHubAPI
+		}
+		if cfg.Status.Context == "" {
+			cfg.Status.Context = "hubdeploy/" + dep.Name
+		}
+	}
+	g.deps = append(g.deps, githubDep{dep: dep, cfg: cfg})
+	return nil
+}
+
+func (g *GitHub) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			dlog.Printf("github: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var ev ghEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			dlog.Printf("github: 400 invalid body: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// unknown repository gets the same response as the invalid
+		// signature, so that the configured repositories can't be
+		// enumerated.
+		candidates := g.byRepo(ev.Repository.FullName)
+		sig, _ := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		var verified []githubDep
+		for _, gd := range candidates {
+			if validHMAC(sha256.New, gd.cfg.Secret, body, sig) {
+				verified = append(verified, gd)
+			}
+		}
+		if len(verified) == 0 {
+			if len(candidates) == 0 {
+				dlog.Printf("github: no deployment for repository: %q", ev.Repository.FullName)
+			} else {
+				dlog.Printf("github: [%s] invalid signature", ev.Repository.FullName)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		event := r.Header.Get("X-GitHub-Event")
+		if event == ghPing {
+			w.Write([]byte("pong"))
+			return
+		}
+		trg, ok := ev.normalise(event)
+		if !ok {
+			dlog.Printf("github: [%s] ignoring %q event, action %q", ev.Repository.FullName, event, ev.Action)
+			w.Write([]byte("ignored"))
+			return
+		}
+
+		var queued int
+		for _, gd := range verified {
+			if !gd.cfg.matches(trg) {
+				continue
+			}
+			if gd.dep.Disabled {
+				dlog.Printf("github: [%s] deployment %q is disabled", trg.repo, gd.dep.Name)
+				continue
+			}
+			dlog.Printf("github: [%s] %s event by %q, queueing deployment %q", trg.repo, trg.event, trg.sender, gd.dep.Name)
+			j <- deploysrv.Job{
+				Dep:         gd.dep,
+				CallbackURL: gd.cfg.statusURL(trg),
+				Trigger:     deploysrv.Trigger{Source: DTGitHub, Vars: trg.vars()},
+			}
+			queued++
+		}
+		if queued == 0 {
+			dlog.Printf("github: [%s] no deployment for %s event", trg.repo, trg.event)
+			http.Error(w, "no deployment for this event", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	}
+}
+
+// byRepo returns the deployments for the repository.
+func (g *GitHub) byRepo(repo string) []githubDep {
+	var deps []githubDep
+	for _, gd := range g.deps {
+		if strings.EqualFold(gd.cfg.Repository, repo) {
+			deps = append(deps, gd)
+		}
+	}
+	return deps
+}
+
+// normalise returns the normalised event.  It returns false, if the event
+// should be ignored, i.e. the release is not published or the workflow run
+// hasn't succeeded.
+func (ev *ghEvent) normalise(event string) (ghTrigger, bool) {
+	t := ghTrigger{
+		event:  event,
+		repo:   ev.Repository.FullName,
+		sender: ev.Sender.Login,
+	}
+	switch event {
+	case ghPush:
+		if ev.Deleted {
+			return t, false
+		}
+		t.ref, t.sha = ev.Ref, ev.After
+		if tag, ok := strings.CutPrefix(ev.Ref, "refs/tags/"); ok {
+			t.tag = tag
+		}
+	case ghRelease:
+		if ev.Release == nil || ev.Action != "published" {
+			return t, false
+		}
+		t.tag = ev.Release.TagName
+		t.ref = "refs/tags/" + ev.Release.TagName
+		t.sha = ev.Release.TargetCommitish
+	case ghPackage:
+		if ev.Package == nil || ev.Action != "published" {
+			return t, false
+		}
+		pv := ev.Package.PackageVersion
+		t.pkg = ev.Package.Name
+		t.version = pv.Version
+		t.tag = pv.ContainerMetadata.Tag.Name
+		t.digest = pv.ContainerMetadata.Tag.Digest
+		if t.tag == "" {
+			t.tag = pv.Version
+		}
+		t.sha = pv.TargetOID
+	case ghWorkflowRun:
+		if ev.WorkflowRun == nil || ev.Action != "completed" || ev.WorkflowRun.Conclusion != "success" {
+			return t, false
+		}
+		t.workflow = ev.WorkflowRun.Name
+		t.ref = "refs/heads/" + ev.WorkflowRun.HeadBranch
+		t.sha = ev.WorkflowRun.HeadSHA
+	default:
+		return t, false
+	}
+	if !reSHA.MatchString(t.sha) {
+		// i.e. release target_commitish is a branch name.
+		t.sha = ""
+	}
+	return t, true
+}
+
+// matches reports whether the deployment configuration matches the event.
+func (c *githubConfig) matches(t ghTrigger) bool {
+	if !slices.Contains(c.Events, t.event) {
+		return false
+	}
+	switch t.event {
+	case ghPush:
+		return matchAny(c.Refs, t.ref)
+	case ghRelease:
+		return matchAny(c.Tags, t.tag)
+	case ghPackage:
+		return matchAny(c.Packages, t.pkg) && (matchAny(c.Versions, t.version) || matchAny(c.Versions, t.tag))
+	case ghWorkflowRun:
+		return matchAny(c.Workflows, t.workflow) && matchAny(c.Refs, t.ref)
+	}
+	return false
+}
+
+// statusURL returns the commit status URL for the event, or an empty string,
+// if the status reporting is not configured or there's no commit SHA.
+func (c *githubConfig) statusURL(t ghTrigger) string {
+	if c.Status == nil || t.sha == "" {
+		return ""
+	}
+	return strings.TrimRight(c.Status.APIURL, "/") + "/repos/" + t.repo + "/statuses/" + t.sha
+}
+
+// vars returns the trigger variables.
+func (t ghTrigger) vars() map[string]string {
+	return triggerVars(map[string]string{
+		"repo":   t.repo,
+		"event":  t.event,
+		"sender": t.sender,
+	}, map[string]string{
+		"ref":      t.ref,
+		"tag":      t.tag,
+		"sha":      t.sha,
+		"package":  t.pkg,
+		"version":  t.version,
+		"workflow": t.workflow,
+		"digest":   t.digest,
+	})
+}
+
+// Callback reports the result as the commit status.
+func (g *GitHub) Callback(data deploysrv.CallbackData) error {
+	return g.CallbackContext(context.Background(), data)
+}
+
+// CallbackContext reports the result as the commit status, the request is
+// cancelled with the context.
+func (g *GitHub) CallbackContext(ctx context.Context, data deploysrv.CallbackData) error {
+	if data.CallbackURL == "" {
+		return nil
+	}
+	gd, ok := byName(g.deps, data.Name)
+	if !ok || gd.cfg.Status == nil {
+		return fmt.Errorf("github: no status configuration for deployment %q", data.Name)
+	}
+	state := commitState(data)
+	descr := data.Description
+	if data.Error != nil {
+		descr = data.Error.Error()
+	}
+	b, err := json.Marshal(ghStatusReq{
+		State:       state,
+		TargetURL:   data.ResultsURL,
+		Description: shared.Truncate(fmt.Sprintf("[%s]: %s", data.ID, descr), ghStatusDescSz),
+		Context:     gd.cfg.Status.Context,
+	})
+	if err != nil {
+		return err
+	}
+	dlog.Printf("%s> [%s] posting commit status to %s", data.ID, data.Name, data.CallbackURL)
+	return postJSON(ctx, data.CallbackURL, b, map[string]string{
+		"Authorization": "Bearer " + gd.cfg.Status.Token,
+		"Accept":        "application/vnd.github+json",
+	})
+}
@@ -0,0 +1,295 @@
+package hookers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/google/uuid"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+const testSHA = "0123456789abcdef0123456789abcdef01234567"
+
+func mustDeployment(t *testing.T, src string) deploysrv.Deployment {
+	t.Helper()
+	var dep deploysrv.Deployment
+	if err := yaml.Unmarshal([]byte(src), &dep); err != nil {
+		t.Fatal(err)
+	}
+	return dep
+}
+
+func hmacSHA256(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mustRegister registers the deployments from the YAML sources with the
+// hooker.
+func mustRegister(t *testing.T, h deploysrv.Hooker, srcs ...string) {
+	t.Helper()
+	for _, src := range srcs {
+		if err := h.Register(mustDeployment(t, src)); err != nil {
+			t.Fatalf("Register() error = %v", err)
+		}
+	}
+}
+
+var githubValid = []string{`---
+name: web
+type: github
+payload:
+  repository: rusq/web
+  secret: s3cr3t
+  refs: [refs/heads/main]
+  status:
+    token: gh-token
+    api_url: https://api.example.test
+`, `---
+name: web-release
+type: github
+payload:
+  repository: rusq/web
+  secret: s3cr3t
+  events: [release, package, workflow_run]
+  tags: ["v*"]
+  versions: ["v*"]
+  workflows: [build]
+`}
+
+func TestGitHub_Register(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{"valid", "payload:\n  repository: a/b\n  secret: x\n", false},
+		{"no repository", "payload:\n  secret: x\n", true},
+		{"no secret", "payload:\n  repository: a/b\n", true},
+		{"bad event", "payload:\n  repository: a/b\n  secret: x\n  events: [issues]\n", true},
+		{"bad pattern", "payload:\n  repository: a/b\n  secret: x\n  refs: ['[']\n", true},
+		{"status without token", "payload:\n  repository: a/b\n  secret: x\n  status: {context: c}\n", true},
+		{"unknown field", "payload:\n  repository: a/b\n  secret: x\n  foo: bar\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := new(GitHub)
+			if err := g.Register(mustDeployment(t, tt.src)); (err != nil) != tt.wantErr {
+				t.Errorf("Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGitHub_Handler(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    string
+		body     string
+		secret   string
+		wantCode int
+		wantDeps []string
+		wantVars map[string]string
+	}{
+		{
+			name:     "push to main",
+			event:    "push",
+			body:     `{"ref":"refs/heads/main","after":"` + testSHA + `","repository":{"full_name":"rusq/web"},"sender":{"login":"rusq"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web"},
+			wantVars: map[string]string{"repo": "rusq/web", "ref": "refs/heads/main", "sha": testSHA, "event": "push", "sender": "rusq"},
+		},
+		{
+			name:     "push to branch",
+			event:    "push",
+			body:     `{"ref":"refs/heads/feature","repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid signature",
+			event:    "push",
+			body:     `{"ref":"refs/heads/main","repository":{"full_name":"rusq/web"}}`,
+			secret:   "wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown repository",
+			event:    "push",
+			body:     `{"ref":"refs/heads/main","repository":{"full_name":"rusq/other"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "branch deleted is ignored",
+			event:    "push",
+			body:     `{"ref":"refs/heads/main","after":"0000000000000000000000000000000000000000","deleted":true,"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "ping",
+			event:    "ping",
+			body:     `{"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "release published",
+			event:    "release",
+			body:     `{"action":"published","release":{"tag_name":"v1.2.3","target_commitish":"main"},"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web-release"},
+			wantVars: map[string]string{"repo": "rusq/web", "tag": "v1.2.3", "ref": "refs/tags/v1.2.3", "event": "release", "sender": ""},
+		},
+		{
+			name:     "release created is ignored",
+			event:    "release",
+			body:     `{"action":"created","release":{"tag_name":"v1.2.3"},"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "package published",
+			event:    "package",
+			body:     `{"action":"published","package":{"name":"web","package_version":{"version":"sha256:abc","container_metadata":{"tag":{"name":"v2","digest":"sha256:abc"}}}},"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web-release"},
+			wantVars: map[string]string{"repo": "rusq/web", "tag": "v2", "version": "sha256:abc", "package": "web", "digest": "sha256:abc", "event": "package", "sender": ""},
+		},
+		{
+			name:     "workflow run failed is ignored",
+			event:    "workflow_run",
+			body:     `{"action":"completed","workflow_run":{"name":"build","head_branch":"main","conclusion":"failure"},"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "workflow run succeeded",
+			event:    "workflow_run",
+			body:     `{"action":"completed","workflow_run":{"name":"build","head_branch":"main","head_sha":"` + testSHA + `","conclusion":"success"},"repository":{"full_name":"rusq/web"}}`,
+			secret:   "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web-release"},
+			wantVars: map[string]string{"repo": "rusq/web", "ref": "refs/heads/main", "sha": testSHA, "workflow": "build", "event": "workflow_run", "sender": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := new(GitHub)
+			mustRegister(t, g, githubValid...)
+			jobs := make(chan deploysrv.Job, 10)
+
+			r := httptest.NewRequest(http.MethodPost, "/webhooks/github/", strings.NewReader(tt.body))
+			r.Header.Set("X-GitHub-Event", tt.event)
+			r.Header.Set("X-Hub-Signature-256", "sha256="+hmacSHA256(tt.secret, tt.body))
+			w := httptest.NewRecorder()
+			g.Handler(jobs)(w, r)
+			close(jobs)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.wantCode, w.Body.String())
+			}
+			var got []deploysrv.Job
+			for j := range jobs {
+				got = append(got, j)
+			}
+			if len(got) != len(tt.wantDeps) {
+				t.Fatalf("got %d jobs, want %d", len(got), len(tt.wantDeps))
+			}
+			for i, j := range got {
+				if j.Dep.Name != tt.wantDeps[i] {
+					t.Errorf("job[%d] deployment = %q, want %q", i, j.Dep.Name, tt.wantDeps[i])
+				}
+				if j.Trigger.Source != DTGitHub {
+					t.Errorf("job[%d] trigger source = %q", i, j.Trigger.Source)
+				}
+				if len(j.Trigger.Vars) != len(tt.wantVars) {
+					t.Errorf("job[%d] vars = %v, want %v", i, j.Trigger.Vars, tt.wantVars)
+				}
+				for k, v := range tt.wantVars {
+					if j.Trigger.Vars[k] != v {
+						t.Errorf("job[%d] var %q = %q, want %q", i, k, j.Trigger.Vars[k], v)
+					}
+				}
+			}
+			if tt.name == "push to main" {
+				wantURL := "https://api.example.test/repos/rusq/web/statuses/" + testSHA
+				if got[0].CallbackURL != wantURL {
+					t.Errorf("CallbackURL = %q, want %q", got[0].CallbackURL, wantURL)
+				}
+			}
+		})
+	}
+}
+
+func TestGitHub_Callback(t *testing.T) {
+	var (
+		gotPath, gotAuth string
+		got              ghStatusReq
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuth = r.URL.Path, r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode status body: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	g := new(GitHub)
+	mustRegister(t, g, githubValid...)
+	err := g.Callback(deploysrv.CallbackData{
+		ID:          uuid.Must(uuid.NewUUID()),
+		Name:        "web",
+		CallbackURL: srv.URL + "/repos/rusq/web/statuses/" + testSHA,
+		Error:       errors.New("exit status 1"),
+		ResultsURL:  "https://example.test/results/id.txt",
+	})
+	if err != nil {
+		t.Fatalf("Callback() error = %v", err)
+	}
+	if gotPath != "/repos/rusq/web/statuses/"+testSHA {
+		t.Errorf("path = %q", gotPath)
+	}
+	if gotAuth != "Bearer gh-token" {
+		t.Errorf("authorization = %q", gotAuth)
+	}
+	if got.State != serror || got.Context != "hubdeploy/web" || got.TargetURL != "https://example.test/results/id.txt" {
+		t.Errorf("status = %+v", got)
+	}
+}
+
+func TestGitHub_CallbackContext_cancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request")
+	}))
+	defer srv.Close()
+
+	g := new(GitHub)
+	mustRegister(t, g, githubValid...)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := g.CallbackContext(ctx, deploysrv.CallbackData{
+		ID:          uuid.Must(uuid.NewUUID()),
+		Name:        "web",
+		CallbackURL: srv.URL + "/repos/rusq/web/statuses/" + testSHA,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("CallbackContext() error = %v, want %v", err, context.Canceled)
+	}
+}
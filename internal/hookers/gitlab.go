@@ -0,0 +1,416 @@
+package hookers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+const DTGitLab = "gitlab"
+
+// GitLab event types.
+const (
+	glPush     = "push"
+	glTagPush  = "tag_push"
+	glPipeline = "pipeline"
+	glRegistry = "registry"
+)
+
+const (
+	defGitLabAPI   = "https://gitlab.com/api/v4"
+	glStateSuccess = "success"
+	glStateFailed  = "failed"
+)
+
+// GitLab handles the GitLab project webhooks and the GitLab container
+// registry notifications.
+type GitLab struct {
+	deps []gitlabDep
+}
+
+type gitlabDep = hookDep[gitlabConfig]
+
+// gitlabConfig is the GitLab deployment payload configuration.
+type gitlabConfig struct {
+	// Project is the project path with namespace, i.e. "group/project".
+	Project string `yaml:"project"`
+	// Token is the secret token, that is sent in X-Gitlab-Token header.
+	Token string `yaml:"token"`
+	// Events is the list of events that trigger the deployment, default is
+	// push.
+	Events []string `yaml:"events,omitempty"`
+	// Refs are the ref patterns for the push and pipeline events, i.e.
+	// "refs/heads/main".
+	Refs []string `yaml:"refs,omitempty"`
+	// Tags are the tag patterns for the tag_push and registry events.
+	Tags []string `yaml:"tags,omitempty"`
+	// Report is the results reporting configuration, if not set, results
+	// are not reported.
+	Report *gitlabReport `yaml:"report,omitempty"`
+}
+
+type gitlabReport struct {
+	// Token is the API access token.
+	Token string `yaml:"token"`
+	// APIURL is the API base URL, default is https://gitlab.com/api/v4.
+	APIURL string `yaml:"api_url,omitempty"`
+	// Name is the commit status name, default is "hubdeploy/<name>".
+	Name string `yaml:"name,omitempty"`
+	// Environment, if set, switches the reporting from the commit status to
+	// the deployments API with this environment name.
+	Environment string `yaml:"environment,omitempty"`
+}
+
+// glEvent is the union of the fields of the supported events.
+type glEvent struct {
+	ObjectKind   string `json:"object_kind"`
+	Ref          string `json:"ref"`
+	CheckoutSHA  string `json:"checkout_sha"`
+	After        string `json:"after"`
+	UserUsername string `json:"user_username"`
+	Project      struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		Ref    string `json:"ref"`
+		Tag    bool   `json:"tag"`
+		SHA    string `json:"sha"`
+		Status string `json:"status"`
+	} `json:"object_attributes"`
+
+	// Events is set for the registry notifications.
+	Events []glRegistryEvent `json:"events"`
+}
+
+// glRegistryEvent is the container registry notification event, it has the
+// Docker Registry v2 notification format.
+type glRegistryEvent struct {
+	Action string `json:"action"`
+	Target struct {
+		Digest     string `json:"digest"`
+		Repository string `json:"repository"`
+		Tag        string `json:"tag"`
+	} `json:"target"`
+	Actor struct {
+		Name string `json:"name"`
+	} `json:"actor"`
+}
+
+// glTrigger is the normalised event.
+type glTrigger struct {
+	event   string
+	project string
+	ref     string
+	tag     string
+	sha     string
+	digest  string
+	user    string
+}
+
+type glStatusReq struct {
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type glDeploymentReq struct {
+	Environment string `json:"environment"`
+	SHA         string `json:"sha"`
+	Ref         string `json:"ref"`
+	Tag         bool   `json:"tag"`
+	Status      string `json:"status"`
+}
+
+func (*GitLab) Type() string {
+	return DTGitLab
+}
+
+func (g *GitLab) Register(dep deploysrv.Deployment) error {
+	var cfg gitlabConfig
+	if err := shared.UnmarshalPayload(dep.Payload, &cfg); err != nil {
+		return err
+	}
+	if cfg.Project == "" {
+		return errors.New("gitlab: project is not set")
+	}
+	if cfg.Token == "" {
+		return errors.New("gitlab: token is not set")
+	}
+	if len(cfg.Events) == 0 {
+		cfg.Events = []string{glPush}
+	}
+	for _, ev := range cfg.Events {
+		switch ev {
+		case glPush, glTagPush, glPipeline, glRegistry:
+		default:
+			return fmt.Errorf("gitlab: unsupported event %q", ev)
+		}
+	}
+	for _, pp := range [][]string{cfg.Refs, cfg.Tags} {
+		if err := validPatterns(pp); err != nil {
+			return fmt.Errorf("gitlab: %w", err)
+		}
+	}
+	if cfg.Report != nil {
+		if cfg.Report.Token == "" {
+			return errors.New("gitlab: report token is not set")
+		}
+		if cfg.Report.APIURL == "" {
+			cfg.Report.APIURL = defGitLabAPI
+		}
+		if cfg.Report.Name == "" {
+			cfg.Report.Name = "hubdeploy/" + dep.Name
+		}
+	}
+	g.deps = append(g.deps, gitlabDep{dep: dep, cfg: cfg})
+	return nil
+}
+
+func (g *GitLab) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			dlog.Printf("gitlab: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var ev glEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			dlog.Printf("gitlab: 400 invalid body: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		triggers := ev.normalise()
+		if len(triggers) == 0 {
+			dlog.Printf("gitlab: ignoring %q event", ev.ObjectKind)
+			w.Write([]byte("ignored"))
+			return
+		}
+		token := r.Header.Get("X-Gitlab-Token")
+		var (
+			known  bool
+			authed bool
+			queued int
+		)
+		for _, trg := range triggers {
+			for _, gd := range g.deps {
+				if !gd.cfg.ownsProject(trg.project) {
+					continue
+				}
+				known = true
+				if subtle.ConstantTimeCompare([]byte(gd.cfg.Token), []byte(token)) != 1 {
+					continue
+				}
+				authed = true
+				if !gd.cfg.matches(trg) {
+					continue
+				}
+				if gd.dep.Disabled {
+					dlog.Printf("gitlab: [%s] deployment %q is disabled", trg.project, gd.dep.Name)
+					continue
+				}
+				dlog.Printf("gitlab: [%s] %s event by %q, queueing deployment %q", trg.project, trg.event, trg.user, gd.dep.Name)
+				j <- deploysrv.Job{
+					Dep:         gd.dep,
+					CallbackURL: gd.cfg.reportURL(trg),
+					Trigger:     deploysrv.Trigger{Source: DTGitLab, Vars: trg.vars()},
+				}
+				queued++
+			}
+		}
+		// unknown project gets the same response as the invalid token, so
+		// that the configured projects can't be enumerated.
+		switch {
+		case !known:
+			dlog.Printf("gitlab: no deployment for project: %q", ev.Project.PathWithNamespace)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		case !authed:
+			dlog.Printf("gitlab: invalid token")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		case queued == 0:
+			dlog.Printf("gitlab: no deployment for %q event", ev.ObjectKind)
+			http.Error(w, "no deployment for this event", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(http.StatusText(http.StatusOK)))
+		}
+	}
+}
+
+// normalise returns the normalised events.  Registry notifications may
+// contain several events, the pipeline events are returned only for the
+// successful pipelines.
+func (ev *glEvent) normalise() []glTrigger {
+	if len(ev.Events) > 0 {
+		var tt []glTrigger
+		for _, re := range ev.Events {
+			if re.Action != "push" || re.Target.Tag == "" {
+				continue // blobs and manifests pushed by digest.
+			}
+			tt = append(tt, glTrigger{
+				event:   glRegistry,
+				project: re.Target.Repository,
+				tag:     re.Target.Tag,
+				digest:  re.Target.Digest,
+				user:    re.Actor.Name,
+			})
+		}
+		return tt
+	}
+	t := glTrigger{
+		event:   ev.ObjectKind,
+		project: ev.Project.PathWithNamespace,
+		user:    ev.UserUsername,
+	}
+	switch ev.ObjectKind {
+	case glPush, glTagPush:
+		if ev.CheckoutSHA == "" || ev.After == zeroSHA {
+			return nil // branch or tag is deleted.
+		}
+	}
+	switch ev.ObjectKind {
+	case glPush:
+		t.ref, t.sha = ev.Ref, ev.CheckoutSHA
+	case glTagPush:
+		t.ref, t.sha = ev.Ref, ev.CheckoutSHA
+		t.tag = strings.TrimPrefix(ev.Ref, "refs/tags/")
+	case glPipeline:
+		if ev.ObjectAttributes.Status != glStateSuccess {
+			return nil
+		}
+		oa := ev.ObjectAttributes
+		t.sha, t.user = oa.SHA, ev.User.Username
+		if oa.Tag {
+			t.ref, t.tag = "refs/tags/"+oa.Ref, oa.Ref
+		} else {
+			t.ref = "refs/heads/" + oa.Ref
+		}
+	default:
+		return nil
+	}
+	return []glTrigger{t}
+}
+
+// ownsProject reports whether the project, or the registry repository
+// belongs to the configured project.
+func (c *gitlabConfig) ownsProject(project string) bool {
+	return project == c.Project || strings.HasPrefix(project, c.Project+"/")
+}
+
+// matches reports whether the deployment configuration matches the event.
+func (c *gitlabConfig) matches(t glTrigger) bool {
+	if !slices.Contains(c.Events, t.event) {
+		return false
+	}
+	if t.event != glRegistry && t.project != c.Project {
+		// only registry repositories may be nested under the project.
+		return false
+	}
+	switch t.event {
+	case glPush, glPipeline:
+		return matchAny(c.Refs, t.ref)
+	case glTagPush, glRegistry:
+		return matchAny(c.Tags, t.tag)
+	}
+	return false
+}
+
+// reportURL returns the results reporting URL, or an empty string, if the
+// reporting is not configured or there's no commit SHA.
+func (c *gitlabConfig) reportURL(t glTrigger) string {
+	if c.Report == nil || t.sha == "" {
+		return ""
+	}
+	base := strings.TrimRight(c.Report.APIURL, "/") + "/projects/" + url.PathEscape(c.Project)
+	if c.Report.Environment != "" {
+		return base + "/deployments"
+	}
+	return base + "/statuses/" + t.sha
+}
+
+// vars returns the trigger variables.
+func (t glTrigger) vars() map[string]string {
+	return triggerVars(map[string]string{
+		"repo":  t.project,
+		"event": t.event,
+		"user":  t.user,
+	}, map[string]string{
+		"ref":    t.ref,
+		"tag":    t.tag,
+		"sha":    t.sha,
+		"digest": t.digest,
+	})
+}
+
+// Callback reports the result as the commit status or the deployment.
+func (g *GitLab) Callback(data deploysrv.CallbackData) error {
+	return g.CallbackContext(context.Background(), data)
+}
+
+// CallbackContext reports the result as the commit status or the
+// deployment, the request is cancelled with the context.
+func (g *GitLab) CallbackContext(ctx context.Context, data deploysrv.CallbackData) error {
+	if data.CallbackURL == "" {
+		return nil
+	}
+	gd, ok := byName(g.deps, data.Name)
+	if !ok || gd.cfg.Report == nil {
+		return fmt.Errorf("gitlab: no report configuration for deployment %q", data.Name)
+	}
+	state := glState(data)
+	descr := data.Description
+	if data.Error != nil {
+		descr = data.Error.Error()
+	}
+	var req any
+	if env := gd.cfg.Report.Environment; env != "" {
+		ref := data.Trigger.Vars["ref"]
+		tag := strings.HasPrefix(ref, "refs/tags/")
+		ref = strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+		req = glDeploymentReq{
+			Environment: env,
+			SHA:         data.Trigger.Vars["sha"],
+			Ref:         ref,
+			Tag:         tag,
+			Status:      state,
+		}
+	} else {
+		req = glStatusReq{
+			State:       state,
+			Name:        gd.cfg.Report.Name,
+			TargetURL:   data.ResultsURL,
+			Description: shared.Truncate(fmt.Sprintf("[%s]: %s", data.ID, descr), 255),
+		}
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	dlog.Printf("%s> [%s] posting results to %s", data.ID, data.Name, data.CallbackURL)
+	return postJSON(ctx, data.CallbackURL, b, map[string]string{"PRIVATE-TOKEN": gd.cfg.Report.Token})
+}
+
+// glState maps the deployment outcome to the GitLab commit status or
+// deployment state.  GitLab has no separate state for the errors and the
+// timeouts, so everything, that is not a success, is failed.
+func glState(data deploysrv.CallbackData) string {
+	if data.Status() == deploysrv.OutcomeSuccess {
+		return glStateSuccess
+	}
+	return glStateFailed
+}
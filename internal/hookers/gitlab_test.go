@@ -0,0 +1,232 @@
+package hookers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+var errTest = errors.New("exit status 1")
+
+var gitlabValid = []string{`---
+name: web
+type: gitlab
+payload:
+  project: group/web
+  token: s3cr3t
+  events: [push, pipeline]
+  refs: [refs/heads/main]
+  report:
+    token: gl-token
+    api_url: https://gitlab.example.test/api/v4
+`, `---
+name: web-prod
+type: gitlab
+payload:
+  project: group/web
+  token: s3cr3t
+  events: [tag_push, registry]
+  tags: ["v*"]
+  report:
+    token: gl-token
+    api_url: https://gitlab.example.test/api/v4
+    environment: production
+`}
+
+func TestGitLab_Register(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{"valid", "payload:\n  project: a/b\n  token: x\n", false},
+		{"no project", "payload:\n  token: x\n", true},
+		{"no token", "payload:\n  project: a/b\n", true},
+		{"bad event", "payload:\n  project: a/b\n  token: x\n  events: [merge_request]\n", true},
+		{"report without token", "payload:\n  project: a/b\n  token: x\n  report: {name: n}\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := new(GitLab).Register(mustDeployment(t, tt.src)); (err != nil) != tt.wantErr {
+				t.Errorf("Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGitLab_Handler(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		token    string
+		wantCode int
+		wantDeps []string
+		wantURL  string
+		wantTags []string
+	}{
+		{
+			name:     "push to main",
+			body:     `{"object_kind":"push","ref":"refs/heads/main","checkout_sha":"` + testSHA + `","user_username":"dev","project":{"path_with_namespace":"group/web"}}`,
+			token:    "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web"},
+			wantURL:  "https://gitlab.example.test/api/v4/projects/group%2Fweb/statuses/" + testSHA,
+		},
+		{
+			name:     "invalid token",
+			body:     `{"object_kind":"push","ref":"refs/heads/main","checkout_sha":"` + testSHA + `","project":{"path_with_namespace":"group/web"}}`,
+			token:    "wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown project",
+			body:     `{"object_kind":"push","ref":"refs/heads/main","checkout_sha":"` + testSHA + `","project":{"path_with_namespace":"group/other"}}`,
+			token:    "s3cr3t",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "branch deleted is ignored",
+			body:     `{"object_kind":"push","ref":"refs/heads/main","after":"0000000000000000000000000000000000000000","checkout_sha":null,"project":{"path_with_namespace":"group/web"}}`,
+			token:    "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "tag push",
+			body:     `{"object_kind":"tag_push","ref":"refs/tags/v1.0","checkout_sha":"` + testSHA + `","project":{"path_with_namespace":"group/web"}}`,
+			token:    "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web-prod"},
+			wantURL:  "https://gitlab.example.test/api/v4/projects/group%2Fweb/deployments",
+			wantTags: []string{"v1.0"},
+		},
+		{
+			name:     "pipeline running is ignored",
+			body:     `{"object_kind":"pipeline","object_attributes":{"ref":"main","status":"running"},"project":{"path_with_namespace":"group/web"}}`,
+			token:    "s3cr3t",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "pipeline success",
+			body:     `{"object_kind":"pipeline","object_attributes":{"ref":"main","status":"success","sha":"` + testSHA + `"},"project":{"path_with_namespace":"group/web"}}`,
+			token:    "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web"},
+			wantURL:  "https://gitlab.example.test/api/v4/projects/group%2Fweb/statuses/" + testSHA,
+		},
+		{
+			name:     "registry push",
+			body:     `{"events":[{"action":"push","target":{"repository":"group/web/app","tag":"v2","digest":"sha256:1"}},{"action":"pull","target":{"repository":"group/web/app","tag":"v2"}},{"action":"push","target":{"repository":"group/web/app","tag":"latest"}}]}`,
+			token:    "s3cr3t",
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web-prod"},
+			wantTags: []string{"v2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := new(GitLab)
+			mustRegister(t, g, gitlabValid...)
+			jobs := make(chan deploysrv.Job, 10)
+
+			r := httptest.NewRequest(http.MethodPost, "/webhooks/gitlab/", strings.NewReader(tt.body))
+			r.Header.Set("X-Gitlab-Token", tt.token)
+			w := httptest.NewRecorder()
+			g.Handler(jobs)(w, r)
+			close(jobs)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.wantCode, w.Body.String())
+			}
+			var got []deploysrv.Job
+			for j := range jobs {
+				got = append(got, j)
+			}
+			if len(got) != len(tt.wantDeps) {
+				t.Fatalf("got %d jobs, want %d", len(got), len(tt.wantDeps))
+			}
+			for i, j := range got {
+				if j.Dep.Name != tt.wantDeps[i] {
+					t.Errorf("job[%d] deployment = %q, want %q", i, j.Dep.Name, tt.wantDeps[i])
+				}
+				if j.CallbackURL != tt.wantURL {
+					t.Errorf("job[%d] CallbackURL = %q, want %q", i, j.CallbackURL, tt.wantURL)
+				}
+				if tt.wantTags != nil && j.Trigger.Vars["tag"] != tt.wantTags[i] {
+					t.Errorf("job[%d] tag = %q, want %q", i, j.Trigger.Vars["tag"], tt.wantTags[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGitLab_Callback(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     deploysrv.CallbackData
+		wantPath string
+		wantBody map[string]any
+	}{
+		{
+			name: "commit status",
+			data: deploysrv.CallbackData{
+				Name:        "web",
+				CallbackURL: "/projects/group%2Fweb/statuses/" + testSHA,
+				Description: "deployed OK",
+				ResultsURL:  "https://example.test/results/id.txt",
+			},
+			wantPath: "/projects/group%2Fweb/statuses/" + testSHA,
+			wantBody: map[string]any{"state": glStateSuccess, "name": "hubdeploy/web"},
+		},
+		{
+			name: "deployment",
+			data: deploysrv.CallbackData{
+				Name:        "web-prod",
+				CallbackURL: "/projects/group%2Fweb/deployments",
+				Error:       errTest,
+				Trigger:     deploysrv.Trigger{Vars: map[string]string{"ref": "refs/tags/v1.0", "sha": testSHA}},
+			},
+			wantPath: "/projects/group%2Fweb/deployments",
+			wantBody: map[string]any{"environment": "production", "sha": testSHA, "ref": "v1.0", "tag": true, "status": glStateFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				gotPath, gotToken string
+				got               map[string]any
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath, gotToken = r.URL.EscapedPath(), r.Header.Get("PRIVATE-TOKEN")
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("decode body: %v", err)
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer srv.Close()
+
+			g := new(GitLab)
+			mustRegister(t, g, gitlabValid...)
+			data := tt.data
+			data.ID = uuid.Must(uuid.NewUUID())
+			data.CallbackURL = srv.URL + data.CallbackURL
+			if err := g.Callback(data); err != nil {
+				t.Fatalf("Callback() error = %v", err)
+			}
+			if gotPath != tt.wantPath || gotToken != "gl-token" {
+				t.Errorf("path, token = %q, %q", gotPath, gotToken)
+			}
+			for k, v := range tt.wantBody {
+				if got[k] != v {
+					t.Errorf("body[%q] = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
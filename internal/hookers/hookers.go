@@ -0,0 +1,116 @@
+package hookers
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+const (
+	// maxBodySz is the maximum accepted webhook body size.
+	maxBodySz = 5 << 20
+	// callbackTimeout is the timeout of the callback request.
+	callbackTimeout = 30 * time.Second
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// readBody reads the request body up to maxBodySz bytes.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySz+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodySz {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// validHMAC reports whether the hex encoded signature sig is the valid HMAC of
+// body with the secret.
+func validHMAC(newHash func() hash.Hash, secret string, body []byte, sig string) bool {
+	if secret == "" || sig == "" {
+		return false
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// matchAny reports whether s matches any of the glob patterns (see
+// [path.Match]).  Empty list of patterns matches anything.
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, err := path.Match(p, s); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validPatterns checks the glob patterns syntax.
+func validPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postJSON posts the JSON body to the url with the headers, and expects the
+// 2xx status code.  The request is limited by callbackTimeout, if the context
+// doesn't have a shorter deadline.
+func postJSON(ctx context.Context, url string, body []byte, headers map[string]string) error {
+	hdr := make(http.Header, len(headers))
+	for k, v := range headers {
+		hdr.Set(k, v)
+	}
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+	return shared.Post(ctx, url, body, hdr)
+}
+
+// hookDep is the registered deployment with its payload configuration C.
+type hookDep[C any] struct {
+	dep deploysrv.Deployment
+	cfg C
+}
+
+// byName returns the deployment with the name.
+func byName[C any](deps []hookDep[C], name string) (hookDep[C], bool) {
+	for _, hd := range deps {
+		if hd.dep.Name == name {
+			return hd, true
+		}
+	}
+	return hookDep[C]{}, false
+}
+
+// triggerVars returns the trigger variables: the vars, and the optional ones,
+// that are not empty.
+func triggerVars(vars, optional map[string]string) map[string]string {
+	for k, v := range optional {
+		if v != "" {
+			vars[k] = v
+		}
+	}
+	return vars
+}
@@ -0,0 +1,109 @@
+package hookers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is the parsed path expression, a small subset of JSONPath:
+// $.field.sub[0]["quoted key"].
+type jsonPath []pathElem
+
+// pathElem is either the object key or the array index.
+type pathElem struct {
+	key   string
+	index int
+	isIdx bool
+}
+
+// parseJSONPath parses the path expression.
+func parseJSONPath(s string) (jsonPath, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("jsonpath %q: must start with $", s)
+	}
+	var (
+		p    jsonPath
+		rest = s[1:]
+	)
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("jsonpath %q: empty key", s)
+			}
+			p = append(p, pathElem{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("jsonpath %q: unclosed bracket", s)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				p = append(p, pathElem{key: inner[1 : len(inner)-1]})
+				continue
+			}
+			idx, err := strconv.Atoi(inner)
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("jsonpath %q: invalid index %q", s, inner)
+			}
+			p = append(p, pathElem{index: idx, isIdx: true})
+		default:
+			return nil, fmt.Errorf("jsonpath %q: unexpected %q", s, rest[0])
+		}
+	}
+	return p, nil
+}
+
+// lookup returns the value at the path in the decoded JSON document v.
+func (p jsonPath) lookup(v any) (any, bool) {
+	for _, e := range p {
+		switch node := v.(type) {
+		case map[string]any:
+			if e.isIdx {
+				return nil, false
+			}
+			var ok bool
+			if v, ok = node[e.key]; !ok {
+				return nil, false
+			}
+		case []any:
+			if !e.isIdx || e.index >= len(node) {
+				return nil, false
+			}
+			v = node[e.index]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonString returns the string representation of the JSON value: strings
+// as is, numbers and booleans formatted, objects and arrays as JSON.
+func jsonString(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	case bool:
+		return strconv.FormatBool(val)
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Sprint(val)
+		}
+		return string(b)
+	}
+}
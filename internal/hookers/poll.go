@@ -0,0 +1,431 @@
+package hookers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// DTPoll is the registry polling deployment type, for the hosts that the
+// registry webhooks can't reach.  It periodically checks the manifest digest
+// of the tag, and deploys, when it changes.
+const DTPoll = "poll"
+
+const (
+	defPollRegistry = "https://registry-1.docker.io"
+	defPollInterval = 5 * time.Minute
+	defPollTimeout  = 30 * time.Second
+)
+
+// manifestAccept are the manifest media types, that are accepted from the
+// registry.  The digest of a multi-arch image is the digest of its index.
+var manifestAccept = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+// Poll polls the registry v2 API for the tag digest changes.
+type Poll struct {
+	deps   []*pollDep
+	client *http.Client
+}
+
+// poll is the deployment payload configuration.
+type poll struct {
+	// Registry is the registry base URL, defaults to Docker Hub.
+	Registry string `yaml:"registry,omitempty"`
+	// Repository is the repository name, i.e. "library/nginx".
+	Repository string `yaml:"repository"`
+	// Tag is the tag to watch.
+	Tag string `yaml:"tag"`
+	// Interval is the polling interval, defaults to 5m.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Username and Password are the registry credentials, if not set, the
+	// anonymous token is requested.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// StateFile is the file, where the last seen digest is stored, defaults
+	// to .hubdeploy-<name>.digest in the deployment work directory.
+	StateFile string `yaml:"state_file,omitempty"`
+}
+
+type pollDep struct {
+	dep deploysrv.Deployment
+	cfg poll
+
+	mu    sync.Mutex
+	token string // cached bearer token
+
+	state *digestState
+}
+
+func (*Poll) Type() string {
+	return DTPoll
+}
+
+func (p *Poll) Register(dep deploysrv.Deployment) error {
+	var cfg poll
+	if err := shared.UnmarshalPayload(dep.Payload, &cfg); err != nil {
+		return err
+	}
+	if cfg.Repository == "" {
+		return errors.New("poll: repository is not set")
+	}
+	if cfg.Tag == "" {
+		return errors.New("poll: tag is not set")
+	}
+	if cfg.Registry == "" {
+		cfg.Registry = defPollRegistry
+	}
+	if u, err := url.Parse(cfg.Registry); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("poll: invalid registry URL: %q", cfg.Registry)
+	}
+	cfg.Registry = strings.TrimRight(cfg.Registry, "/")
+	if cfg.Interval < 0 {
+		return fmt.Errorf("poll: invalid interval: %s", cfg.Interval)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defPollInterval
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return errors.New("poll: both username and password must be set")
+	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = digestFile(dep)
+	}
+
+	state, err := newDigestState(DTPoll, dep.Name, cfg.StateFile)
+	if err != nil {
+		return fmt.Errorf("poll: %w", err)
+	}
+	p.deps = append(p.deps, &pollDep{dep: dep, cfg: cfg, state: state})
+	return nil
+}
+
+// Handler rejects all requests, polling deployments don't accept webhooks.
+func (*Poll) Handler(chan<- deploysrv.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "polling deployments don't accept webhooks", http.StatusNotFound)
+	}
+}
+
+// Callback does nothing, registry doesn't accept any results.
+func (*Poll) Callback(deploysrv.CallbackData) error {
+	return nil
+}
+
+// Poll polls all enabled deployments until the context is cancelled.
+func (p *Poll) Poll(ctx context.Context, jobs chan<- deploysrv.Job) {
+	var wg sync.WaitGroup
+	for _, pd := range p.deps {
+		if pd.dep.Disabled {
+			dlog.Printf("poll: [%s] deployment is disabled", pd.dep.Name)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run(ctx, pd, jobs)
+		}()
+	}
+	wg.Wait()
+}
+
+// run checks the deployment digest immediately, and then every interval.
+func (p *Poll) run(ctx context.Context, pd *pollDep, jobs chan<- deploysrv.Job) {
+	dlog.Printf("poll: [%s] watching %s/%s:%s every %s", pd.dep.Name, pd.cfg.Registry, pd.cfg.Repository, pd.cfg.Tag, pd.cfg.Interval)
+	t := time.NewTicker(pd.cfg.Interval)
+	defer t.Stop()
+	for {
+		if err := p.check(ctx, pd, jobs); err != nil && ctx.Err() == nil {
+			dlog.Printf("poll: [%s] %s", pd.dep.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// check fetches the current digest, and queues the deployment, if it's
+// different from the last seen one.  The first seen digest becomes the
+// baseline, and is not deployed.
+func (p *Poll) check(ctx context.Context, pd *pollDep, jobs chan<- deploysrv.Job) error {
+	digest, err := p.digest(ctx, pd)
+	if err != nil {
+		return err
+	}
+	prev, ok := pd.state.swap(digest)
+	if !ok {
+		return nil
+	}
+	if prev == "" {
+		dlog.Printf("poll: [%s] initial digest of %s:%s is %s", pd.dep.Name, pd.cfg.Repository, pd.cfg.Tag, digest)
+		return pd.state.save(digest)
+	}
+
+	dlog.Printf("poll: [%s] %s:%s digest changed %s -> %s, queueing deployment", pd.dep.Name, pd.cfg.Repository, pd.cfg.Tag, prev, digest)
+	job := deploysrv.Job{
+		Dep: pd.dep,
+		Trigger: deploysrv.Trigger{
+			Source: DTPoll,
+			Vars: map[string]string{
+				"repo":        pd.cfg.Repository,
+				"tag":         pd.cfg.Tag,
+				"digest":      digest,
+				"prev_digest": prev,
+				"registry":    pd.cfg.Registry,
+			},
+		},
+		Done: pd.state.done(digest),
+	}
+	select {
+	case <-ctx.Done():
+		pd.state.rollback(digest)
+		return ctx.Err()
+	case jobs <- job:
+	}
+	return nil
+}
+
+// digestState is the last digest of the deployment.  The digest is swapped
+// in, when the deployment is queued, so that it is not queued twice, and
+// written to the state file only after the successful deployment.
+type digestState struct {
+	typ  string
+	name string
+	file string
+
+	mu    sync.Mutex
+	last  string // last queued digest
+	saved string // last deployed digest
+}
+
+// newDigestState returns the digest state of the deployment, loaded from the
+// state file.
+func newDigestState(typ, name, filename string) (*digestState, error) {
+	last, err := loadDigest(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &digestState{typ: typ, name: name, file: filename, last: last, saved: last}, nil
+}
+
+// swap remembers the digest as the last queued one.  It returns the previous
+// digest, and false, if the digest is already the last one.
+func (ds *digestState) swap(digest string) (string, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if digest == ds.last {
+		return "", false
+	}
+	prev := ds.last
+	ds.last = digest
+	return prev, true
+}
+
+// rollback restores the last deployed digest, unless another digest has been
+// queued since.
+func (ds *digestState) rollback(digest string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.last == digest {
+		ds.last = ds.saved
+	}
+}
+
+// save remembers the digest as the deployed one, and writes it to the state
+// file.
+func (ds *digestState) save(digest string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := saveDigest(ds.file, digest); err != nil {
+		return err
+	}
+	ds.saved = digest
+	return nil
+}
+
+// done returns the [deploysrv.Job] Done func, that saves the digest, if the
+// deployment succeeded, or rolls it back otherwise, so that it's deployed
+// again on the next notification or check.
+func (ds *digestState) done(digest string) func(error) {
+	return func(err error) {
+		if err != nil {
+			ds.rollback(digest)
+			return
+		}
+		if err := ds.save(digest); err != nil {
+			dlog.Printf("%s: [%s] unable to save the digest: %s", ds.typ, ds.name, err)
+		}
+	}
+}
+
+// digestFile returns the default digest state file of the deployment.
+func digestFile(dep deploysrv.Deployment) string {
+	return filepath.Join(dep.Workdir, ".hubdeploy-"+dep.Name+".digest")
+}
+
+// loadDigest reads the digest from the state file.  It returns an empty
+// string, if the file does not exist.
+func loadDigest(filename string) (string, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// saveDigest atomically writes the digest to the state file.
+func saveDigest(filename string, digest string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(digest+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// digest returns the manifest digest of the tag.  If the registry requests
+// the authentication, the bearer token is obtained, and the request is
+// retried.
+func (p *Poll) digest(ctx context.Context, pd *pollDep) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, defPollTimeout)
+	defer cancel()
+
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", pd.cfg.Registry, pd.cfg.Repository, url.PathEscape(pd.cfg.Tag))
+	resp, err := p.head(ctx, u, pd.bearer())
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := p.fetchToken(ctx, pd, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		pd.mu.Lock()
+		pd.token = token
+		pd.mu.Unlock()
+		if resp, err = p.head(ctx, u, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HEAD %s: %s", u, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("HEAD %s: no digest in the response", u)
+	}
+	return digest, nil
+}
+
+// bearer returns the cached token.
+func (pd *pollDep) bearer() string {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return pd.token
+}
+
+func (p *Poll) head(ctx context.Context, u string, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (p *Poll) httpClient() *http.Client {
+	if p.client != nil {
+		return p.client
+	}
+	return http.DefaultClient
+}
+
+// reAuthParam matches the parameters of the WWW-Authenticate header.
+var reAuthParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken requests the bearer token from the token server, specified in
+// the WWW-Authenticate challenge, see
+// https://distribution.github.io/distribution/spec/auth/token/
+func (p *Poll) fetchToken(ctx context.Context, pd *pollDep, challenge string) (string, error) {
+	params, ok := strings.CutPrefix(challenge, "Bearer ")
+	if !ok {
+		return "", fmt.Errorf("unsupported authentication challenge: %q", challenge)
+	}
+	var realm string
+	q := url.Values{}
+	for _, m := range reAuthParam.FindAllStringSubmatch(params, -1) {
+		switch m[1] {
+		case "realm":
+			realm = m[2]
+		case "service", "scope":
+			q.Set(m[1], m[2])
+		}
+	}
+	if realm == "" {
+		return "", fmt.Errorf("no realm in the authentication challenge: %q", challenge)
+	}
+	if !q.Has("scope") {
+		q.Set("scope", "repository:"+pd.cfg.Repository+":pull")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if pd.cfg.Username != "" {
+		req.SetBasicAuth(pd.cfg.Username, pd.cfg.Password)
+	}
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %s", resp.Status)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySz)).Decode(&tr); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if tr.Token == "" {
+		tr.Token = tr.AccessToken
+	}
+	if tr.Token == "" {
+		return "", errors.New("token response: empty token")
+	}
+	return tr.Token, nil
+}
@@ -0,0 +1,238 @@
+package hookers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+// pollRegistry is the registry v2 stand-in with the token authentication.
+type pollRegistry struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	digest string
+	heads  int
+}
+
+func newPollRegistry(t *testing.T, digest string) *pollRegistry {
+	t.Helper()
+	reg := &pollRegistry{digest: digest}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /token", func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "bot" || p != "pa55" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:team/web:pull" || r.URL.Query().Get("service") != "test" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"token":"reg-token"}`))
+	})
+	mux.HandleFunc("HEAD /v2/team/web/manifests/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		reg.heads++
+		if r.Header.Get("Authorization") != "Bearer reg-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+reg.URL+`/token",service="test",scope="repository:team/web:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.PathValue("tag") != "latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", reg.digest)
+	})
+	reg.Server = httptest.NewServer(mux)
+	t.Cleanup(reg.Close)
+	return reg
+}
+
+func (reg *pollRegistry) setDigest(d string) {
+	reg.mu.Lock()
+	reg.digest = d
+	reg.mu.Unlock()
+}
+
+// pollWeb is the polling deployment of the registry %[1]s, tag %[2]s, with
+// the state file %[3]s.
+const pollWeb = `---
+name: web
+type: poll
+payload:
+  registry: %[1]s
+  repository: team/web
+  tag: %[2]s
+  interval: 10ms
+  username: bot
+  password: pa55
+  state_file: %[3]s
+`
+
+func TestPoll_Register(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{"valid", "payload:\n  repository: library/nginx\n  tag: latest\n", false},
+		{"no repository", "payload:\n  tag: latest\n", true},
+		{"no tag", "payload:\n  repository: library/nginx\n", true},
+		{"bad registry", "payload:\n  registry: registry.test\n  repository: a/b\n  tag: latest\n", true},
+		{"username only", "payload:\n  repository: a/b\n  tag: latest\n  username: bot\n", true},
+		{"negative interval", "payload:\n  repository: a/b\n  tag: latest\n  interval: -1m\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Poll)
+			err := p.Register(mustDeployment(t, tt.src))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && p.deps[0].cfg.Interval != defPollInterval {
+				t.Errorf("interval = %s, want %s", p.deps[0].cfg.Interval, defPollInterval)
+			}
+		})
+	}
+}
+
+func TestPoll_check(t *testing.T) {
+	reg := newPollRegistry(t, "sha256:1")
+	stateFile := filepath.Join(t.TempDir(), "state", "web.digest")
+	p := new(Poll)
+	mustRegister(t, p, fmt.Sprintf(pollWeb, reg.URL, "latest", stateFile))
+	pd := p.deps[0]
+	jobs := make(chan deploysrv.Job, 1)
+	ctx := context.Background()
+
+	// baseline
+	if err := p.check(ctx, pd, jobs); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatal("initial digest must not be deployed")
+	}
+	if got, _ := os.ReadFile(stateFile); strings.TrimSpace(string(got)) != "sha256:1" {
+		t.Fatalf("state = %q, want %q", got, "sha256:1")
+	}
+
+	// unchanged, the cached token is reused.
+	reg.mu.Lock()
+	reg.heads = 0
+	reg.mu.Unlock()
+	if err := p.check(ctx, pd, jobs); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatal("unchanged digest must not be deployed")
+	}
+	if reg.heads != 1 {
+		t.Errorf("HEAD requests = %d, want 1", reg.heads)
+	}
+
+	// changed
+	reg.setDigest("sha256:2")
+	if err := p.check(ctx, pd, jobs); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Fatal("changed digest must be deployed")
+	}
+	j := <-jobs
+	want := map[string]string{"repo": "team/web", "tag": "latest", "digest": "sha256:2", "prev_digest": "sha256:1", "registry": reg.URL}
+	for k, v := range want {
+		if j.Trigger.Vars[k] != v {
+			t.Errorf("var %q = %q, want %q", k, j.Trigger.Vars[k], v)
+		}
+	}
+	if j.Dep.Name != "web" || j.Trigger.Source != DTPoll {
+		t.Errorf("deployment, source = %q, %q", j.Dep.Name, j.Trigger.Source)
+	}
+	if got, _ := os.ReadFile(stateFile); strings.TrimSpace(string(got)) != "sha256:1" {
+		t.Fatalf("state = %q before the deployment, want %q", got, "sha256:1")
+	}
+
+	// the failed deployment is retried on the next check.
+	j.Done(errTest)
+	if err := p.check(ctx, pd, jobs); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Fatal("failed digest must be deployed again")
+	}
+	(<-jobs).Done(nil)
+	if got, _ := os.ReadFile(stateFile); strings.TrimSpace(string(got)) != "sha256:2" {
+		t.Fatalf("state = %q after the deployment, want %q", got, "sha256:2")
+	}
+
+	// the state survives the restart.
+	p = new(Poll)
+	mustRegister(t, p, fmt.Sprintf(pollWeb, reg.URL, "latest", stateFile))
+	if err := p.check(ctx, p.deps[0], jobs); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatal("digest seen before restart must not be deployed")
+	}
+}
+
+func TestPoll_checkError(t *testing.T) {
+	reg := newPollRegistry(t, "sha256:1")
+	p := new(Poll)
+	mustRegister(t, p, fmt.Sprintf(pollWeb, reg.URL, "missing", filepath.Join(t.TempDir(), "web.digest")))
+	if err := p.check(context.Background(), p.deps[0], make(chan deploysrv.Job, 1)); err == nil {
+		t.Fatal("check() expected error for the missing tag")
+	}
+}
+
+func TestPoll_Poll(t *testing.T) {
+	reg := newPollRegistry(t, "sha256:1")
+	stateFile := filepath.Join(t.TempDir(), "web.digest")
+	p := new(Poll)
+	mustRegister(t, p, fmt.Sprintf(pollWeb, reg.URL, "latest", stateFile))
+	jobs := make(chan deploysrv.Job)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Poll(ctx, jobs)
+		close(done)
+	}()
+	// wait for the baseline.
+	for i := 0; ; i++ {
+		if _, err := os.Stat(stateFile); err == nil {
+			break
+		}
+		if i == 500 {
+			t.Fatal("timed out waiting for the initial digest")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	reg.setDigest("sha256:2")
+
+	select {
+	case j := <-jobs:
+		if j.Trigger.Vars["digest"] != "sha256:2" {
+			t.Errorf("digest = %q, want %q", j.Trigger.Vars["digest"], "sha256:2")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the job")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Poll didn't stop after cancel")
+	}
+}
@@ -0,0 +1,173 @@
+package hookers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+const DTQuay = "quay"
+
+// Quay handles the Quay.io repository push notifications.  Deployments are
+// matched by the same rules as for Docker Hub.  Quay can't set the request
+// headers, so the token is passed in the "token" query parameter of the
+// notification URL, i.e. https://example.com/webhooks/quay/?token=s3cr3t, or
+// as the bearer token.
+type Quay struct {
+	mapping tagMapping
+	tokens  map[string]string // by deployment name
+}
+
+// quayPush is the repository push notification, see
+// https://docs.quay.io/guides/notifications.html
+type quayPush struct {
+	Name        string   `json:"name"`
+	Repository  string   `json:"repository"`
+	Namespace   string   `json:"namespace"`
+	DockerURL   string   `json:"docker_url"`
+	Homepage    string   `json:"homepage"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+// quay is the deployment payload configuration.
+type quay struct {
+	// Repository is the repository name with namespace, i.e.
+	// "namespace/repo".
+	Repository string `yaml:"repository"`
+	// Tags are the tags to deploy, if empty, any tag is deployed.
+	Tags []string `yaml:"tags,omitempty"`
+	// Token is the secret token of the notification URL.
+	Token string `yaml:"token"`
+}
+
+func (*Quay) Type() string {
+	return DTQuay
+}
+
+func (q *Quay) Register(dep deploysrv.Deployment) error {
+	var cfg quay
+	if err := shared.UnmarshalPayload(dep.Payload, &cfg); err != nil {
+		return err
+	}
+	if cfg.Repository == "" {
+		return errors.New("quay: repository is not set")
+	}
+	if cfg.Token == "" {
+		return errors.New("quay: token is not set")
+	}
+	if q.tokens == nil {
+		q.tokens = make(map[string]string)
+	}
+	q.tokens[dep.Name] = cfg.Token
+	q.mapping.add(cfg.Repository, cfg.Tags, dep)
+	return nil
+}
+
+func (q *Quay) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if !q.validToken(token) {
+			dlog.Printf("quay: invalid token")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			dlog.Printf("quay: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var p quayPush
+		if err := json.Unmarshal(body, &p); err != nil {
+			dlog.Printf("quay: 400 invalid body: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		// repositories of the other tokens are unknown to the caller.
+		if !q.ownsRepo(p.Repository, token) {
+			dlog.Printf("quay: no deployment for repository: %q", p.Repository)
+			http.Error(w, errNoRepo.Error(), http.StatusNotFound)
+			return
+		}
+
+		// several updated tags may resolve to the same deployment, it is
+		// queued once with the first matching tag.
+		var (
+			seen   = make(map[string]bool)
+			queued int
+		)
+		for _, tag := range p.UpdatedTags {
+			dp, err := q.mapping.lookup(p.Repository, tag)
+			if err != nil || seen[dp.Name] || !q.tokenFor(dp.Name, token) {
+				continue
+			}
+			seen[dp.Name] = true
+			if dp.Disabled {
+				dlog.Printf("quay: [%s] deployment %q for tag: %q is disabled", p.Repository, dp.Name, tag)
+				continue
+			}
+			dlog.Printf("quay: [%s] tag %q updated, queueing deployment %q", p.Repository, tag, dp.Name)
+			j <- deploysrv.Job{
+				Dep: dp,
+				Trigger: deploysrv.Trigger{
+					Source: DTQuay,
+					Vars: map[string]string{
+						"repo":       p.Repository,
+						"tag":        tag,
+						"docker_url": p.DockerURL,
+					},
+				},
+			}
+			queued++
+		}
+		if queued == 0 {
+			dlog.Printf("quay: [%s] no deployment for tags: %q", p.Repository, p.UpdatedTags)
+			http.Error(w, errNoTag.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	}
+}
+
+// validToken reports whether the token belongs to any of the deployments.
+func (q *Quay) validToken(token string) bool {
+	var valid bool
+	for name := range q.tokens {
+		if q.tokenFor(name, token) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// ownsRepo reports whether the repository has any deployment with the token.
+func (q *Quay) ownsRepo(repo, token string) bool {
+	for _, dp := range q.mapping[repo] {
+		if q.tokenFor(dp.Name, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenFor reports whether the token is the one of the deployment.
+func (q *Quay) tokenFor(name, token string) bool {
+	want, ok := q.tokens[name]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(token)) == 1
+}
+
+// Callback does nothing, Quay doesn't accept any results.
+func (*Quay) Callback(deploysrv.CallbackData) error {
+	return nil
+}
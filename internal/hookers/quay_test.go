@@ -0,0 +1,114 @@
+package hookers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+func TestQuay_Handler(t *testing.T) {
+	q := new(Quay)
+	for _, src := range []string{
+		"name: web-stable\npayload:\n  repository: vendor/web\n  tags: [stable, latest]\n  token: s3cr3t\n",
+		"name: web-edge\npayload:\n  repository: vendor/web\n  tags: [edge]\n  token: s3cr3t\n",
+		"name: api\npayload:\n  repository: vendor/api\n  token: other\n",
+	} {
+		if err := q.Register(mustDeployment(t, src)); err != nil {
+			t.Fatalf("Register() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		auth     string
+		body     string
+		wantCode int
+		wantDeps []string
+		wantTags []string
+	}{
+		{
+			name:     "multiple tags",
+			target:   "/webhooks/quay/?token=s3cr3t",
+			body:     `{"repository":"vendor/web","namespace":"vendor","docker_url":"quay.io/vendor/web","updated_tags":["stable","latest","edge","other"]}`,
+			wantCode: http.StatusOK,
+			wantDeps: []string{"web-stable", "web-edge"},
+			wantTags: []string{"stable", "edge"},
+		},
+		{
+			name:     "any tag",
+			auth:     "Bearer other",
+			body:     `{"repository":"vendor/api","updated_tags":["1.0"]}`,
+			wantCode: http.StatusOK,
+			wantDeps: []string{"api"},
+			wantTags: []string{"1.0"},
+		},
+		{
+			name:     "no matching tag",
+			target:   "/webhooks/quay/?token=s3cr3t",
+			body:     `{"repository":"vendor/web","updated_tags":["nightly"]}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "unknown repository",
+			target:   "/webhooks/quay/?token=s3cr3t",
+			body:     `{"repository":"vendor/db","updated_tags":["latest"]}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "repository of the other token",
+			target:   "/webhooks/quay/?token=other",
+			body:     `{"repository":"vendor/web","updated_tags":["latest"]}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "no token",
+			body:     `{"repository":"vendor/web","updated_tags":["latest"]}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong token",
+			target:   "/webhooks/quay/?token=wrong",
+			body:     `{"repository":"vendor/db","updated_tags":["latest"]}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "invalid body",
+			target:   "/webhooks/quay/?token=s3cr3t",
+			body:     `[`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := make(chan deploysrv.Job, 10)
+			target := tt.target
+			if target == "" {
+				target = "/webhooks/quay/"
+			}
+			r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", tt.auth)
+			w := httptest.NewRecorder()
+			q.Handler(jobs)(w, r)
+			close(jobs)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			var gotDeps, gotTags []string
+			for j := range jobs {
+				gotDeps = append(gotDeps, j.Dep.Name)
+				gotTags = append(gotTags, j.Trigger.Vars["tag"])
+			}
+			if strings.Join(gotDeps, ",") != strings.Join(tt.wantDeps, ",") {
+				t.Errorf("deployments = %v, want %v", gotDeps, tt.wantDeps)
+			}
+			if strings.Join(gotTags, ",") != strings.Join(tt.wantTags, ",") {
+				t.Errorf("tags = %v, want %v", gotTags, tt.wantTags)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package hookers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rusq/dlog"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// DTRegistry is the Docker Registry v2 notifications deployment type, it
+// works with the self-hosted distribution, Harbor and Zot, or anything else,
+// that sends the distribution notification envelopes.
+const DTRegistry = "registry"
+
+// Registry handles the Docker Registry v2 notifications.
+type Registry struct {
+	deps []*registryDep
+}
+
+type registryDep struct {
+	dep   deploysrv.Deployment
+	cfg   registry
+	state *digestState
+}
+
+// registry is the deployment payload configuration.
+type registry struct {
+	// Repository is the repository name, i.e. "team/web".
+	Repository string `yaml:"repository"`
+	// Tags are the tag patterns, if empty, any tag matches.
+	Tags []string `yaml:"tags,omitempty"`
+	// Token is the bearer token, that the registry sends in the
+	// Authorization header (set in the endpoint headers of the registry
+	// notifications configuration).
+	Token string `yaml:"token"`
+	// StateFile is the file, where the last deployed digest is stored,
+	// defaults to .hubdeploy-<name>.digest in the deployment work directory.
+	StateFile string `yaml:"state_file,omitempty"`
+}
+
+func (*Registry) Type() string {
+	return DTRegistry
+}
+
+func (rg *Registry) Register(dep deploysrv.Deployment) error {
+	var cfg registry
+	if err := shared.UnmarshalPayload(dep.Payload, &cfg); err != nil {
+		return err
+	}
+	if cfg.Repository == "" {
+		return errors.New("registry: repository is not set")
+	}
+	if cfg.Token == "" {
+		return errors.New("registry: token is not set")
+	}
+	if err := validPatterns(cfg.Tags); err != nil {
+		return fmt.Errorf("registry: %w", err)
+	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = digestFile(dep)
+	}
+	state, err := newDigestState(DTRegistry, dep.Name, cfg.StateFile)
+	if err != nil {
+		return fmt.Errorf("registry: %w", err)
+	}
+	rg.deps = append(rg.deps, &registryDep{dep: dep, cfg: cfg, state: state})
+	return nil
+}
+
+func (rg *Registry) Handler(j chan<- deploysrv.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !rg.validToken(token) {
+			dlog.Printf("registry: invalid token")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			dlog.Printf("registry: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var env distEnvelope
+		if err := json.Unmarshal(body, &env); err != nil {
+			dlog.Printf("registry: 400 invalid body: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// the registry retries the whole batch until it gets 2xx, so all
+		// notifications are acknowledged, even if nothing matched.
+		for _, ev := range env.tagPushes() {
+			for _, rd := range rg.deps {
+				if subtle.ConstantTimeCompare([]byte(rd.cfg.Token), []byte(token)) != 1 {
+					continue
+				}
+				if rd.cfg.Repository != ev.Target.Repository || !matchAny(rd.cfg.Tags, ev.Target.Tag) {
+					continue
+				}
+				if rd.dep.Disabled {
+					dlog.Printf("registry: [%s] deployment %q is disabled", ev.Target.Repository, rd.dep.Name)
+					continue
+				}
+				// the same digest is often pushed with several tags, or
+				// reported several times, i.e. on the batch retry, deploy
+				// it once.
+				if _, ok := rd.state.swap(ev.Target.Digest); !ok {
+					continue
+				}
+				dlog.Printf("registry: [%s] tag %q (%s) pushed by %q, queueing deployment %q", ev.Target.Repository, ev.Target.Tag, ev.Target.Digest, ev.Actor.Name, rd.dep.Name)
+				j <- deploysrv.Job{
+					Dep: rd.dep,
+					Trigger: deploysrv.Trigger{
+						Source: DTRegistry,
+						Vars: map[string]string{
+							"repo":   ev.Target.Repository,
+							"tag":    ev.Target.Tag,
+							"digest": ev.Target.Digest,
+							"pusher": ev.Actor.Name,
+							"host":   ev.Request.Host,
+						},
+					},
+					Done: rd.state.done(ev.Target.Digest),
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	}
+}
+
+// validToken reports whether the token belongs to any of the deployments.
+func (rg *Registry) validToken(token string) bool {
+	var valid bool
+	for _, rd := range rg.deps {
+		if subtle.ConstantTimeCompare([]byte(rd.cfg.Token), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Callback does nothing, registry doesn't accept any results.
+func (*Registry) Callback(deploysrv.CallbackData) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package hookers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+// registryWeb and registryAPI are the registry deployments in the work
+// directory %[1]s.
+const (
+	registryWeb = `---
+name: web
+type: registry
+work_dir: %[1]s
+payload:
+  repository: team/web
+  tags: ["v*", latest]
+  token: s3cr3t
+`
+	registryAPI = `---
+name: api
+type: registry
+work_dir: %[1]s
+payload:
+  repository: team/api
+  token: other
+`
+)
+
+func TestRegistry_Register(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{"valid", "payload:\n  repository: a/b\n  token: x\n", false},
+		{"no repository", "payload:\n  token: x\n", true},
+		{"no token", "payload:\n  repository: a/b\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := new(Registry).Register(mustDeployment(t, tt.src)); (err != nil) != tt.wantErr {
+				t.Errorf("Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	const batch = `{"events":[
+	{"action":"push","target":{"repository":"team/web","tag":"v1","digest":"sha256:aaa"},"actor":{"name":"ci"},"request":{"host":"registry.test"}},
+	{"action":"push","target":{"repository":"team/web","tag":"latest","digest":"sha256:aaa"}},
+	{"action":"push","target":{"repository":"team/web","digest":"sha256:bbb"}},
+	{"action":"pull","target":{"repository":"team/web","tag":"v2","digest":"sha256:ccc"}},
+	{"action":"push","target":{"repository":"team/web","tag":"dev","digest":"sha256:ddd"}},
+	{"action":"push","target":{"repository":"team/web","tag":"v3","digest":"sha256:eee"}},
+	{"action":"push","target":{"repository":"team/api","tag":"v1","digest":"sha256:fff"}}
+]}`
+	tests := []struct {
+		name        string
+		auth        string
+		body        string
+		wantCode    int
+		wantDigests []string
+	}{
+		{"batch", "Bearer s3cr3t", batch, http.StatusOK, []string{"sha256:aaa", "sha256:eee"}},
+		{"no token", "", batch, http.StatusUnauthorized, nil},
+		{"wrong token", "Bearer wrong", batch, http.StatusUnauthorized, nil},
+		{"other deployment token", "Bearer other", batch, http.StatusOK, []string{"sha256:fff"}},
+		{"invalid body", "Bearer s3cr3t", "{", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			rg := new(Registry)
+			mustRegister(t, rg, fmt.Sprintf(registryWeb, workdir), fmt.Sprintf(registryAPI, workdir))
+			code, got := postRegistry(rg, tt.auth, tt.body, nil)
+			if code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", code, tt.wantCode)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantDigests, ",") {
+				t.Errorf("queued digests = %v, want %v", got, tt.wantDigests)
+			}
+		})
+	}
+}
+
+func TestRegistry_Handler_redelivery(t *testing.T) {
+	const (
+		first  = `{"events":[{"action":"push","target":{"repository":"team/web","tag":"v1","digest":"sha256:aaa"}}]}`
+		second = `{"events":[{"action":"push","target":{"repository":"team/web","tag":"latest","digest":"sha256:aaa"}},{"action":"push","target":{"repository":"team/web","tag":"v2","digest":"sha256:bbb"}}]}`
+	)
+	workdir := t.TempDir()
+	rg := new(Registry)
+	mustRegister(t, rg, fmt.Sprintf(registryWeb, workdir))
+	if _, got := postRegistry(rg, "Bearer s3cr3t", first, nil); len(got) != 1 {
+		t.Fatalf("first delivery queued %v, want one job", got)
+	}
+	// the state must survive the restart.
+	rg = new(Registry)
+	mustRegister(t, rg, fmt.Sprintf(registryWeb, workdir))
+	if _, got := postRegistry(rg, "Bearer s3cr3t", first, nil); len(got) != 0 {
+		t.Errorf("redelivery queued %v, want nothing", got)
+	}
+	if _, got := postRegistry(rg, "Bearer s3cr3t", second, nil); strings.Join(got, ",") != "sha256:bbb" {
+		t.Errorf("second delivery queued %v, want [sha256:bbb]", got)
+	}
+}
+
+func TestRegistry_Handler_failedDeployment(t *testing.T) {
+	const push = `{"events":[{"action":"push","target":{"repository":"team/web","tag":"v1","digest":"sha256:aaa"}}]}`
+	workdir := t.TempDir()
+	rg := new(Registry)
+	mustRegister(t, rg, fmt.Sprintf(registryWeb, workdir))
+	if _, got := postRegistry(rg, "Bearer s3cr3t", push, errTest); len(got) != 1 {
+		t.Fatalf("first delivery queued %v, want one job", got)
+	}
+	// the failed digest is deployed again, and is not saved.
+	if _, got := postRegistry(rg, "Bearer s3cr3t", push, nil); len(got) != 1 {
+		t.Fatalf("redelivery after failure queued %v, want one job", got)
+	}
+	rg = new(Registry)
+	mustRegister(t, rg, fmt.Sprintf(registryWeb, workdir))
+	if _, got := postRegistry(rg, "Bearer s3cr3t", push, nil); len(got) != 0 {
+		t.Errorf("redelivery after success and restart queued %v, want nothing", got)
+	}
+}
+
+// postRegistry posts the notification envelope to the registry handler and
+// returns the status code and the queued digests.  The queued deployments
+// complete with deployErr.
+func postRegistry(rg *Registry, auth, body string, deployErr error) (int, []string) {
+	jobs := make(chan deploysrv.Job, 10)
+
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/registry/", strings.NewReader(body))
+	r.Header.Set("Authorization", auth)
+	w := httptest.NewRecorder()
+	rg.Handler(jobs)(w, r)
+	close(jobs)
+
+	var got []string
+	for j := range jobs {
+		got = append(got, j.Trigger.Vars["digest"])
+		j.Done(deployErr)
+	}
+	return w.Code, got
+}
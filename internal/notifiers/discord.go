@@ -0,0 +1,80 @@
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// TypeDiscord is the Discord webhook notifier type.
+const TypeDiscord = "discord"
+
+const (
+	// discordMaxTitle and discordMaxDescr are the embed limits.
+	discordMaxTitle = 256
+	discordMaxDescr = 4096
+)
+
+const defDiscordText = "{{if .Trigger}}**Trigger:** {{.Trigger}}\n{{end}}" +
+	"**Duration:** {{.Duration}}\n" +
+	"{{if .Error}}**Error:** {{.Error}}\n{{end}}" +
+	"{{if .Tail}}```\n{{.Tail}}\n```{{end}}"
+
+// Discord posts the notifications to the Discord webhook.
+type Discord struct {
+	cfg chat
+	tt  templates
+}
+
+// discordMessage is the webhook message, see
+// https://discord.com/developers/docs/resources/webhook#execute-webhook
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string        `json:"title"`
+	URL         string        `json:"url,omitempty"`
+	Description string        `json:"description"`
+	Color       int           `json:"color"`
+	Footer      discordFooter `json:"footer"`
+	Timestamp   string        `json:"timestamp"`
+}
+
+type discordFooter struct {
+	Text string `json:"text"`
+}
+
+// NewDiscord creates the Discord notifier from the destination payload.
+func NewDiscord(payload any) (deploysrv.Notifier, error) {
+	cfg, tt, err := parseChat(payload, defDiscordText)
+	if err != nil {
+		return nil, fmt.Errorf("discord: %w", err)
+	}
+	return &Discord{cfg: cfg, tt: tt}, nil
+}
+
+func (d *Discord) Notify(ctx context.Context, n deploysrv.Notification) error {
+	m := newMessage(n, d.cfg.TailLines)
+	title, text, err := d.tt.render(m)
+	if err != nil {
+		return fmt.Errorf("discord: %w", err)
+	}
+	msg := discordMessage{
+		Embeds: []discordEmbed{{
+			Title:       shared.Truncate(title, discordMaxTitle),
+			URL:         m.ResultsURL,
+			Description: shared.Truncate(text, discordMaxDescr),
+			Color:       colors[n.Event],
+			Footer:      discordFooter{Text: "hubdeploy " + m.ID},
+			Timestamp:   m.Time.Format(time.RFC3339),
+		}},
+	}
+	if err := shared.PostJSON(ctx, d.cfg.URL, msg, nil); err != nil {
+		return fmt.Errorf("discord: %w", err)
+	}
+	return nil
+}
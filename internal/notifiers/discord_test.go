@@ -0,0 +1,45 @@
+package notifiers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDiscord_Notify(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		srv, bodies := newCapture(t, http.StatusNoContent)
+		n, err := NewDiscord(map[string]any{"url": srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err != nil {
+			t.Fatalf("Notify() error = %v", err)
+		}
+		var got discordMessage
+		decode(t, bodies, &got)
+		if len(got.Embeds) != 1 {
+			t.Fatalf("message = %+v", got)
+		}
+		e := got.Embeds[0]
+		if e.Title != "web deployment failed" || e.URL != testNotification.ResultsURL || e.Color != 0xe01e5a || e.Timestamp != "2024-01-01T12:00:00Z" {
+			t.Errorf("embed = %+v", e)
+		}
+		for _, want := range []string{"**Trigger:** team/web:v1.2 by dev", "**Duration:** 1m23.4s", "**Error:** exit status 1", "line 1\nline 2\nboom"} {
+			if !strings.Contains(e.Description, want) {
+				t.Errorf("description %q does not contain %q", e.Description, want)
+			}
+		}
+	})
+	t.Run("rate limited", func(t *testing.T) {
+		srv, _ := newCapture(t, http.StatusTooManyRequests)
+		n, err := NewDiscord(map[string]any{"url": srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err == nil {
+			t.Fatal("Notify() expected error")
+		}
+	})
+}
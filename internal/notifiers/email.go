@@ -0,0 +1,390 @@
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// TypeEmail is the SMTP email notifier type.
+const TypeEmail = "email"
+
+// TLS modes.
+const (
+	// TLSStartTLS upgrades the plain connection with STARTTLS, the default.
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects over TLS (SMTPS).
+	TLSImplicit = "implicit"
+	// TLSNone doesn't use TLS.  The authentication is refused on the
+	// unencrypted connections to the hosts other than localhost.
+	TLSNone = "none"
+)
+
+// Authentication mechanisms.
+const (
+	AuthPlain = "plain"
+	AuthLogin = "login"
+)
+
+const (
+	defMaxAttachment = 64 << 10
+	defEmailSubject  = "[hubdeploy] {{.Name}} deployment {{.Status}}"
+	defEmailText     = `Deployment: {{.Name}}
+Status:     {{.Status}}
+{{if .Trigger}}Trigger:    {{.Trigger}}
+{{end}}Duration:   {{.Duration}}
+{{if .Error}}Error:      {{.Error}}
+{{end}}{{if .ResultsURL}}Results:    {{.ResultsURL}}
+{{end}}Job ID:     {{.ID}}
+`
+)
+
+var defPorts = map[string]int{
+	TLSStartTLS: 587,
+	TLSImplicit: 465,
+	TLSNone:     25,
+}
+
+// email is the email notifier configuration.
+type email struct {
+	// Host is the SMTP server host name.
+	Host string `yaml:"host"`
+	// Port is the SMTP server port, defaults to 587 for STARTTLS, 465 for
+	// implicit TLS and 25 without TLS.
+	Port int `yaml:"port,omitempty"`
+	// TLS is the TLS mode: starttls (default), implicit or none.
+	TLS string `yaml:"tls,omitempty"`
+	// CACert is the PEM file with the CA certificates to verify the server
+	// certificate with, if not set, the system roots are used.
+	CACert string `yaml:"ca_cert,omitempty"`
+	// Username and Password are the SMTP credentials, the authentication is
+	// skipped, if Username is not set.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Auth is the authentication mechanism: plain (default) or login.
+	Auth string `yaml:"auth,omitempty"`
+	// From is the sender address.
+	From string `yaml:"from"`
+	// To are the default recipients.
+	To []string `yaml:"to,omitempty"`
+	// Recipients are the recipients of the specific deployments, they are
+	// used instead of the default ones.
+	Recipients map[string][]string `yaml:"recipients,omitempty"`
+	// Subject is the subject template.
+	Subject string `yaml:"subject,omitempty"`
+	// Template is the message body template.
+	Template string `yaml:"template,omitempty"`
+	// MaxAttachment is the maximum size of the output attachment in bytes,
+	// defaults to 64KiB.  Longer output is truncated from the beginning.
+	// Negative value disables the attachment.
+	MaxAttachment int `yaml:"max_attachment,omitempty"`
+}
+
+// Email sends the notifications by email.
+type Email struct {
+	cfg    email
+	tt     templates
+	tlsCfg *tls.Config
+}
+
+// NewEmail creates the email notifier from the destination payload.
+func NewEmail(payload any) (deploysrv.Notifier, error) {
+	var cfg email
+	if err := shared.UnmarshalPayload(payload, &cfg); err != nil {
+		return nil, err
+	}
+	e, err := newEmail(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("email: %w", err)
+	}
+	return e, nil
+}
+
+func newEmail(cfg email) (*Email, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("host is not set")
+	}
+	if cfg.TLS == "" {
+		cfg.TLS = TLSStartTLS
+	}
+	if _, ok := defPorts[cfg.TLS]; !ok {
+		return nil, fmt.Errorf("invalid tls mode: %q", cfg.TLS)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = defPorts[cfg.TLS]
+	}
+	if cfg.Auth == "" {
+		cfg.Auth = AuthPlain
+	}
+	if cfg.Auth != AuthPlain && cfg.Auth != AuthLogin {
+		return nil, fmt.Errorf("invalid auth mechanism: %q", cfg.Auth)
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	if len(cfg.To) == 0 && len(cfg.Recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	for _, addrs := range append([][]string{cfg.To}, mapValues(cfg.Recipients)...) {
+		for _, a := range addrs {
+			if _, err := mail.ParseAddress(a); err != nil {
+				return nil, fmt.Errorf("recipient %q: %w", a, err)
+			}
+		}
+	}
+	if cfg.Subject == "" {
+		cfg.Subject = defEmailSubject
+	}
+	if cfg.Template == "" {
+		cfg.Template = defEmailText
+	}
+	if cfg.MaxAttachment == 0 {
+		cfg.MaxAttachment = defMaxAttachment
+	}
+	tt, err := parseTemplates(cfg.Subject, cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Email{cfg: cfg, tt: tt, tlsCfg: &tls.Config{ServerName: cfg.Host}}
+	if cfg.CACert != "" {
+		pool, err := shared.LoadCertPool(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		e.tlsCfg.RootCAs = pool
+	}
+	return e, nil
+}
+
+func mapValues(m map[string][]string) [][]string {
+	vv := make([][]string, 0, len(m))
+	for _, v := range m {
+		vv = append(vv, v)
+	}
+	return vv
+}
+
+// recipients returns the recipients of the deployment.
+func (e *Email) recipients(name string) []string {
+	if rcpt, ok := e.cfg.Recipients[name]; ok {
+		return rcpt
+	}
+	return e.cfg.To
+}
+
+func (e *Email) Notify(ctx context.Context, n deploysrv.Notification) error {
+	rcpt := e.recipients(n.Name)
+	if len(rcpt) == 0 {
+		return nil
+	}
+	m := newMessage(n, 0)
+	subject, text, err := e.tt.render(m)
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	msg, err := e.compose(subject, text, rcpt, n)
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if err := e.send(ctx, rcpt, msg); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	return nil
+}
+
+// compose composes the MIME message with the text body and the output
+// attachment.
+func (e *Email) compose(subject, text string, rcpt []string, n deploysrv.Notification) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	// the subject is a single line, whatever the template produces.
+	subject = strings.Join(strings.Fields(subject), " ")
+	for _, h := range [][2]string{
+		{"From", e.cfg.From},
+		{"To", strings.Join(rcpt, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", n.Time.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + n.ID.String() + "." + n.Event + "@hubdeploy>"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/mixed; boundary=" + strconv.Quote(mw.Boundary())},
+	} {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qw := quotedprintable.NewWriter(pw)
+	if _, err := qw.Write([]byte(text + "\n")); err != nil {
+		return nil, err
+	}
+	if err := qw.Close(); err != nil {
+		return nil, err
+	}
+
+	if output := truncateOutput(n.Output, e.cfg.MaxAttachment); len(output) > 0 {
+		filename := n.Name + "-" + n.ID.String() + ".log"
+		aw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType("text/plain", map[string]string{"charset": "utf-8", "name": filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64(aw, output); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// truncateOutput returns the last max bytes of the output, with the
+// truncation note.
+func truncateOutput(output []byte, max int) []byte {
+	if max < 0 {
+		return nil
+	}
+	if len(output) <= max {
+		return output
+	}
+	note := fmt.Sprintf("[... %d bytes truncated ...]\n", len(output)-max)
+	return append([]byte(note), output[len(output)-max:]...)
+}
+
+// writeBase64 writes the base64 encoded data split into 76 character lines.
+func writeBase64(w io.Writer, data []byte) error {
+	const lineLen = 76
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 0 {
+		n := min(lineLen, len(enc))
+		if _, err := fmt.Fprintf(w, "%s\r\n", enc[:n]); err != nil {
+			return err
+		}
+		enc = enc[n:]
+	}
+	return nil
+}
+
+// send sends the message to the recipients.
+func (e *Email) send(ctx context.Context, rcpt []string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(e.cfg.Host, strconv.Itoa(e.cfg.Port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if e.cfg.TLS == TLSImplicit {
+		conn = tls.Client(conn, e.tlsCfg)
+	}
+	c, err := smtp.NewClient(conn, e.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if e.cfg.TLS == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server doesn't support STARTTLS")
+		}
+		if err := c.StartTLS(e.tlsCfg); err != nil {
+			return err
+		}
+	}
+	if e.cfg.Username != "" {
+		var auth smtp.Auth
+		if e.cfg.Auth == AuthLogin {
+			auth = &loginAuth{username: e.cfg.Username, password: e.cfg.Password, host: e.cfg.Host}
+		} else {
+			auth = smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.cfg.Host)
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(e.cfg.From)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, r := range rcpt {
+		addr, _ := mail.ParseAddress(r)
+		if err := c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// loginAuth is the LOGIN authentication mechanism, that is not implemented
+// by net/smtp.  As PlainAuth, it refuses to send the credentials over the
+// unencrypted connection to the hosts other than localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,372 @@
+package notifiers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMail is the message received by the fake SMTP server.
+type fakeMail struct {
+	from string
+	to   []string
+	data []byte
+	tls  bool
+	auth string
+}
+
+// fakeSMTP is the minimal in-process SMTP server.
+type fakeSMTP struct {
+	ln       net.Listener
+	tlsCfg   *tls.Config // nil disables STARTTLS
+	implicit bool
+	user     string
+	pass     string
+
+	mu   sync.Mutex
+	mail []fakeMail
+}
+
+// newFakeSMTP starts the fake SMTP server, and returns it and the CA
+// certificate file to trust.
+func newFakeSMTP(t *testing.T, starttls, implicit bool) (*fakeSMTP, string) {
+	t.Helper()
+	cert, caFile := genTLSCert(t)
+	f := &fakeSMTP{implicit: implicit, user: "bot", pass: "pa55"}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if starttls {
+		f.tlsCfg = tlsCfg
+	}
+	var err error
+	if implicit {
+		f.ln, err = tls.Listen("tcp", "127.0.0.1:0", tlsCfg)
+	} else {
+		f.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.ln.Close() })
+	go func() {
+		for {
+			conn, err := f.ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, caFile
+}
+
+func (f *fakeSMTP) port() int {
+	return f.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSMTP) received() []fakeMail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mail
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	var (
+		tp    = textproto.NewConn(conn)
+		isTLS = f.implicit
+		m     fakeMail
+	)
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-fake")
+			if !isTLS && f.tlsCfg != nil {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tconn := tls.Server(conn, f.tlsCfg)
+			if err := tconn.Handshake(); err != nil {
+				return
+			}
+			conn, tp, isTLS = tconn, textproto.NewConn(tconn), true
+		case "AUTH":
+			var user, pass string
+			mech, ir, _ := strings.Cut(arg, " ")
+			switch mech {
+			case "PLAIN":
+				b, _ := base64.StdEncoding.DecodeString(ir)
+				if parts := strings.Split(string(b), "\x00"); len(parts) == 3 {
+					user, pass = parts[1], parts[2]
+				}
+			case "LOGIN":
+				tp.PrintfLine("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				l, _ := tp.ReadLine()
+				b, _ := base64.StdEncoding.DecodeString(l)
+				user = string(b)
+				tp.PrintfLine("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				l, _ = tp.ReadLine()
+				b, _ = base64.StdEncoding.DecodeString(l)
+				pass = string(b)
+			}
+			if user != f.user || pass != f.pass {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			m.auth = mech
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			m.from = arg
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			m.to = append(m.to, arg)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.data, m.tls = data, isTLS
+			f.mu.Lock()
+			f.mail = append(f.mail, m)
+			f.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// genTLSCert generates the self-signed certificate for 127.0.0.1, and
+// writes it to the file.
+func genTLSCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// parseMail parses the received message, and returns its headers, text and
+// attachment.
+func parseMail(t *testing.T, data []byte) (mail.Header, string, string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text, attachment string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p) // quoted-printable is decoded by the reader.
+		if p.FileName() != "" {
+			dec, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(body), "\r\n", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			attachment = string(dec)
+		} else {
+			text = string(body)
+		}
+	}
+	return msg.Header, text, attachment
+}
+
+func TestNewEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload map[string]any
+		wantErr bool
+	}{
+		{"valid", map[string]any{"host": "smtp.test", "from": "hubdeploy@example.test", "to": []string{"ops@example.test"}}, false},
+		{"recipients only", map[string]any{"host": "smtp.test", "from": "hubdeploy@example.test", "recipients": map[string]any{"web": []string{"a@example.test"}}}, false},
+		{"no host", map[string]any{"from": "hubdeploy@example.test", "to": []string{"ops@example.test"}}, true},
+		{"no recipients", map[string]any{"host": "smtp.test", "from": "hubdeploy@example.test"}, true},
+		{"bad from", map[string]any{"host": "smtp.test", "from": "hubdeploy", "to": []string{"ops@example.test"}}, true},
+		{"bad recipient", map[string]any{"host": "smtp.test", "from": "hubdeploy@example.test", "recipients": map[string]any{"web": []string{"a"}}}, true},
+		{"bad tls", map[string]any{"host": "smtp.test", "from": "hubdeploy@example.test", "to": []string{"ops@example.test"}, "tls": "ssl"}, true},
+		{"bad auth", map[string]any{"host": "smtp.test", "from": "hubdeploy@example.test", "to": []string{"ops@example.test"}, "auth": "cram-md5"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewEmail(tt.payload); (err != nil) != tt.wantErr {
+				t.Errorf("NewEmail() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEmail_Notify(t *testing.T) {
+	t.Run("starttls plain", func(t *testing.T) {
+		srv, caFile := newFakeSMTP(t, true, false)
+		n, err := NewEmail(map[string]any{
+			"host":           "127.0.0.1",
+			"port":           srv.port(),
+			"ca_cert":        caFile,
+			"username":       "bot",
+			"password":       "pa55",
+			"from":           "Hubdeploy <hubdeploy@example.test>",
+			"to":             []string{"ops@example.test"},
+			"recipients":     map[string]any{"web": []string{"auditors@example.test", "Lead <lead@example.test>"}},
+			"max_attachment": 10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err != nil {
+			t.Fatalf("Notify() error = %v", err)
+		}
+		got := srv.received()
+		if len(got) != 1 {
+			t.Fatalf("received %d messages, want 1", len(got))
+		}
+		m := got[0]
+		if !m.tls || m.auth != "PLAIN" || m.from != "FROM:<hubdeploy@example.test>" {
+			t.Errorf("tls, auth, from = %v, %q, %q", m.tls, m.auth, m.from)
+		}
+		if strings.Join(m.to, ",") != "TO:<auditors@example.test>,TO:<lead@example.test>" {
+			t.Errorf("recipients = %v", m.to)
+		}
+		hdr, text, attachment := parseMail(t, m.data)
+		subject, _ := new(mime.WordDecoder).DecodeHeader(hdr.Get("Subject"))
+		if subject != "[hubdeploy] web deployment failed" {
+			t.Errorf("subject = %q", subject)
+		}
+		for _, want := range []string{"Status:     failed", "Trigger:    team/web:v1.2 by dev", "Error:      exit status 1", "Results:    " + testNotification.ResultsURL} {
+			if !strings.Contains(text, want) {
+				t.Errorf("text %q does not contain %q", text, want)
+			}
+		}
+		wantAttachment := "[... " + strconv.Itoa(len(testNotification.Output)-10) + " bytes truncated ...]\nne 2\nboom\n"
+		if attachment != wantAttachment {
+			t.Errorf("attachment = %q, want %q", attachment, wantAttachment)
+		}
+	})
+	t.Run("implicit tls login", func(t *testing.T) {
+		srv, caFile := newFakeSMTP(t, false, true)
+		n, err := NewEmail(map[string]any{
+			"host":     "127.0.0.1",
+			"port":     srv.port(),
+			"tls":      TLSImplicit,
+			"ca_cert":  caFile,
+			"username": "bot",
+			"password": "pa55",
+			"auth":     AuthLogin,
+			"from":     "hubdeploy@example.test",
+			"to":       []string{"ops@example.test"},
+			"subject":  "{{.Name}}\n{{.Event}}",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err != nil {
+			t.Fatalf("Notify() error = %v", err)
+		}
+		got := srv.received()
+		if len(got) != 1 || !got[0].tls || got[0].auth != "LOGIN" {
+			t.Fatalf("received = %+v", got)
+		}
+		hdr, _, attachment := parseMail(t, got[0].data)
+		if hdr.Get("Subject") != "web failure" {
+			t.Errorf("subject = %q", hdr.Get("Subject"))
+		}
+		if attachment != string(testNotification.Output) {
+			t.Errorf("attachment = %q", attachment)
+		}
+	})
+	t.Run("starttls not supported", func(t *testing.T) {
+		srv, _ := newFakeSMTP(t, false, false)
+		n, err := NewEmail(map[string]any{"host": "127.0.0.1", "port": srv.port(), "from": "hubdeploy@example.test", "to": []string{"ops@example.test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err == nil {
+			t.Fatal("Notify() expected error")
+		}
+	})
+	t.Run("untrusted certificate", func(t *testing.T) {
+		srv, _ := newFakeSMTP(t, true, false)
+		n, err := NewEmail(map[string]any{"host": "127.0.0.1", "port": srv.port(), "from": "hubdeploy@example.test", "to": []string{"ops@example.test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err == nil {
+			t.Fatal("Notify() expected error")
+		}
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		srv, caFile := newFakeSMTP(t, true, false)
+		n, err := NewEmail(map[string]any{"host": "127.0.0.1", "port": srv.port(), "ca_cert": caFile, "username": "bot", "password": "wrong", "from": "hubdeploy@example.test", "to": []string{"ops@example.test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err == nil {
+			t.Fatal("Notify() expected error")
+		}
+		if len(srv.received()) != 0 {
+			t.Error("message was sent")
+		}
+	})
+}
@@ -0,0 +1,202 @@
+// Package notifiers contains the deployment result notifiers.
+package notifiers
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+const (
+	defTitle     = "{{.Name}} deployment {{.Status}}"
+	defTailLines = 10
+	// maxTailSz is the maximum size of the output tail in bytes.
+	maxTailSz = 1500
+)
+
+// chat is the chat webhook notifier configuration.
+type chat struct {
+	// URL is the incoming webhook URL.
+	URL string `yaml:"url"`
+	// Title is the message title template.
+	Title string `yaml:"title,omitempty"`
+	// Template is the message text template.
+	Template string `yaml:"template,omitempty"`
+	// TailLines is the number of the last output lines to include in the
+	// message, defaults to 10, negative value disables the output.
+	TailLines int `yaml:"tail_lines,omitempty"`
+}
+
+// templates are the parsed message title (or subject) and text templates.
+type templates struct {
+	title *template.Template
+	text  *template.Template
+}
+
+// parseTemplates parses the title and text templates.
+func parseTemplates(title, text string) (templates, error) {
+	var (
+		tt  templates
+		err error
+	)
+	if tt.title, err = template.New("title").Parse(title); err != nil {
+		return tt, err
+	}
+	if tt.text, err = template.New("text").Parse(text); err != nil {
+		return tt, err
+	}
+	return tt, nil
+}
+
+// parseChat parses the chat notifier configuration, using the default
+// templates for the ones that are not set.
+func parseChat(payload any, defText string) (chat, templates, error) {
+	var cfg chat
+	if err := shared.UnmarshalPayload(payload, &cfg); err != nil {
+		return cfg, templates{}, err
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return cfg, templates{}, fmt.Errorf("invalid webhook url: %q", cfg.URL)
+	}
+	if cfg.Title == "" {
+		cfg.Title = defTitle
+	}
+	if cfg.Template == "" {
+		cfg.Template = defText
+	}
+	if cfg.TailLines == 0 {
+		cfg.TailLines = defTailLines
+	}
+	tt, err := parseTemplates(cfg.Title, cfg.Template)
+	return cfg, tt, err
+}
+
+// render renders the title and the text of the message.
+func (tt templates) render(m message) (title, text string, err error) {
+	var buf bytes.Buffer
+	if err := tt.title.Execute(&buf, m); err != nil {
+		return "", "", err
+	}
+	title = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := tt.text.Execute(&buf, m); err != nil {
+		return "", "", err
+	}
+	return title, strings.TrimSpace(buf.String()), nil
+}
+
+// message is the data, that the templates are executed with.
+type message struct {
+	// ID is the job ID.
+	ID string
+	// Name is the deployment name.
+	Name string
+	// Event is the notification event: started, success, failure or
+	// recovery.
+	Event string
+	// Status is the human readable event: started, succeeded, failed or
+	// recovered.
+	Status string
+	// Source is the trigger source.
+	Source string
+	// Trigger is the trigger summary, i.e. "team/web:v1.2 by dev".
+	Trigger string
+	// Vars are the trigger variables.
+	Vars map[string]string
+	// Duration is the deployment duration.
+	Duration time.Duration
+	// Error is the deployment error message.
+	Error string
+	// Tail is the tail of the deployment output.
+	Tail string
+	// ResultsURL is the deployment results URL.
+	ResultsURL string
+	// Time is when the deployment finished, or started.
+	Time time.Time
+}
+
+// colors are the message accent colours of the events.
+var colors = map[string]int{
+	deploysrv.EventStarted:  0x9e9e9e,
+	deploysrv.EventSuccess:  0x2eb67d,
+	deploysrv.EventFailure:  0xe01e5a,
+	deploysrv.EventRecovery: 0x36c5f0,
+}
+
+var statuses = map[string]string{
+	deploysrv.EventStarted:  "started",
+	deploysrv.EventSuccess:  "succeeded",
+	deploysrv.EventFailure:  "failed",
+	deploysrv.EventRecovery: "recovered",
+}
+
+// newMessage returns the template data of the notification.
+func newMessage(n deploysrv.Notification, tailLines int) message {
+	m := message{
+		ID:         n.ID.String(),
+		Name:       n.Name,
+		Event:      n.Event,
+		Status:     statuses[n.Event],
+		Source:     n.Trigger.Source,
+		Trigger:    triggerSummary(n.Trigger),
+		Vars:       n.Trigger.Vars,
+		Duration:   n.Duration.Round(100 * time.Millisecond),
+		Tail:       tail(n.Output, tailLines),
+		ResultsURL: n.ResultsURL,
+		Time:       n.Time,
+	}
+	if n.Error != nil {
+		m.Error = n.Error.Error()
+	}
+	return m
+}
+
+// triggerSummary returns the human readable trigger summary, i.e.
+// "team/web:v1.2 by dev".
+func triggerSummary(t deploysrv.Trigger) string {
+	v := t.Vars
+	s := v["repo"]
+	switch {
+	case v["tag"] != "":
+		s += ":" + v["tag"]
+	case v["ref"] != "":
+		s += "@" + v["ref"]
+	}
+	if s == "" {
+		s = t.Source
+	}
+	for _, who := range []string{"pusher", "sender"} {
+		if v[who] != "" {
+			s += " by " + v[who]
+			break
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// tail returns the last n lines of the output, limited to maxTailSz bytes.
+func tail(output []byte, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	s := strings.Join(lines, "\n")
+	if len(s) > maxTailSz {
+		s = s[len(s)-maxTailSz:]
+		// drop the partial line.
+		if i := strings.IndexByte(s, '\n'); i != -1 {
+			s = s[i+1:]
+		}
+		s = strings.ToValidUTF8(s, "")
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package notifiers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+var testNotification = deploysrv.Notification{
+	ID:         uuid.MustParse("5f1f9a5e-7a7e-11ef-9d4b-0242ac120002"),
+	Name:       "web",
+	Event:      deploysrv.EventFailure,
+	Error:      errors.New("exit status 1"),
+	Output:     []byte("pulling\nline 1\nline 2\nboom\n"),
+	ResultsURL: "https://hubdeploy.test/results/id.txt",
+	Trigger:    deploysrv.Trigger{Source: "dockerhub", Vars: map[string]string{"repo": "team/web", "tag": "v1.2", "pusher": "dev"}},
+	Duration:   83*time.Second + 420*time.Millisecond,
+	Time:       time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+}
+
+// newCapture starts the webhook stand-in, that responds with the status code
+// and sends the raw request bodies to the returned channel.
+func newCapture(t *testing.T, code int) (*httptest.Server, <-chan []byte) {
+	t.Helper()
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, bodies
+}
+
+// decode decodes the captured body into v.
+func decode(t *testing.T, bodies <-chan []byte, v any) {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("decode body: %v: %s", err, body)
+		}
+	default:
+		t.Fatal("nothing was posted")
+	}
+}
+
+func TestTail(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	tests := []struct {
+		name   string
+		output string
+		n      int
+		want   string
+	}{
+		{"last lines", "a\nb\nc\nd\n", 2, "c\nd"},
+		{"fewer lines", "a\nb", 10, "a\nb"},
+		{"disabled", "a\nb", -1, ""},
+		{"size limit", long + "\n" + long + "\nend", 10, long + "\nend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tail([]byte(tt.output), tt.n); got != tt.want {
+				t.Errorf("tail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTriggerSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		trg  deploysrv.Trigger
+		want string
+	}{
+		{"tag", deploysrv.Trigger{Vars: map[string]string{"repo": "team/web", "tag": "v1", "pusher": "dev"}}, "team/web:v1 by dev"},
+		{"ref", deploysrv.Trigger{Vars: map[string]string{"repo": "team/web", "ref": "refs/heads/main", "sender": "dev"}}, "team/web@refs/heads/main by dev"},
+		{"no vars", deploysrv.Trigger{Source: "schedule"}, "schedule"},
+		{"empty", deploysrv.Trigger{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := triggerSummary(tt.trg); got != tt.want {
+				t.Errorf("triggerSummary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChat(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload any
+		wantErr bool
+	}{
+		{"valid", map[string]any{"url": "https://hooks.test/x"}, false},
+		{"no url", map[string]any{}, true},
+		{"bad url", map[string]any{"url": "hooks.test/x"}, true},
+		{"unknown field", map[string]any{"url": "https://hooks.test/x", "channel": "#ops"}, true},
+		{"bad template", map[string]any{"url": "https://hooks.test/x", "template": "{{.Name"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := parseChat(tt.payload, defSlackText); (err != nil) != tt.wantErr {
+				t.Errorf("parseChat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// TypeSlack is the Slack incoming webhook notifier type.
+const TypeSlack = "slack"
+
+// slackMaxText is the maximum length of the attachment text.
+const slackMaxText = 3000
+
+const defSlackText = "{{if .Trigger}}*Trigger:* {{.Trigger}}\n{{end}}" +
+	"*Duration:* {{.Duration}}\n" +
+	"{{if .Error}}*Error:* {{.Error}}\n{{end}}" +
+	"{{if .Tail}}```\n{{.Tail}}\n```{{end}}"
+
+// Slack posts the notifications to the Slack incoming webhook.
+type Slack struct {
+	cfg chat
+	tt  templates
+}
+
+// slackMessage is the incoming webhook message, see
+// https://api.slack.com/reference/surfaces/formatting#when-to-use-attachments
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color     string   `json:"color"`
+	Title     string   `json:"title"`
+	TitleLink string   `json:"title_link,omitempty"`
+	Text      string   `json:"text"`
+	MrkdwnIn  []string `json:"mrkdwn_in"`
+	Footer    string   `json:"footer"`
+	Ts        int64    `json:"ts"`
+}
+
+// NewSlack creates the Slack notifier from the destination payload.
+func NewSlack(payload any) (deploysrv.Notifier, error) {
+	cfg, tt, err := parseChat(payload, defSlackText)
+	if err != nil {
+		return nil, fmt.Errorf("slack: %w", err)
+	}
+	return &Slack{cfg: cfg, tt: tt}, nil
+}
+
+func (s *Slack) Notify(ctx context.Context, n deploysrv.Notification) error {
+	m := newMessage(n, s.cfg.TailLines)
+	title, text, err := s.tt.render(slackEscape(m))
+	if err != nil {
+		return fmt.Errorf("slack: %w", err)
+	}
+	msg := slackMessage{
+		Text: title,
+		Attachments: []slackAttachment{{
+			Color:     fmt.Sprintf("#%06x", colors[n.Event]),
+			Title:     title,
+			TitleLink: m.ResultsURL,
+			Text:      shared.Truncate(text, slackMaxText),
+			MrkdwnIn:  []string{"text"},
+			Footer:    "hubdeploy " + m.ID,
+			Ts:        m.Time.Unix(),
+		}},
+	}
+	if err := shared.PostJSON(ctx, s.cfg.URL, msg, nil); err != nil {
+		return fmt.Errorf("slack: %w", err)
+	}
+	return nil
+}
+
+// slackReplacer escapes the control characters of the Slack text, see
+// https://api.slack.com/reference/surfaces/formatting#escaping
+var slackReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackEscape returns the message with the payload derived fields escaped, so
+// that they can't inject the links or mentions into the text.
+func slackEscape(m message) message {
+	m.Name = slackReplacer.Replace(m.Name)
+	m.Trigger = slackReplacer.Replace(m.Trigger)
+	m.Error = slackReplacer.Replace(m.Error)
+	m.Tail = slackReplacer.Replace(m.Tail)
+	vars := make(map[string]string, len(m.Vars))
+	for k, v := range m.Vars {
+		vars[k] = slackReplacer.Replace(v)
+	}
+	m.Vars = vars
+	return m
+}
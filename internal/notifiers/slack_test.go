@@ -0,0 +1,88 @@
+package notifiers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+func TestSlack_Notify(t *testing.T) {
+	t.Run("default template", func(t *testing.T) {
+		srv, bodies := newCapture(t, http.StatusOK)
+		n, err := NewSlack(map[string]any{"url": srv.URL, "tail_lines": 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err != nil {
+			t.Fatalf("Notify() error = %v", err)
+		}
+		var got slackMessage
+		decode(t, bodies, &got)
+		if got.Text != "web deployment failed" || len(got.Attachments) != 1 {
+			t.Fatalf("message = %+v", got)
+		}
+		a := got.Attachments[0]
+		if a.Color != "#e01e5a" || a.TitleLink != testNotification.ResultsURL || a.Ts != testNotification.Time.Unix() {
+			t.Errorf("attachment = %+v", a)
+		}
+		for _, want := range []string{"*Trigger:* team/web:v1.2 by dev", "*Duration:* 1m23.4s", "*Error:* exit status 1", "```\nline 2\nboom\n```"} {
+			if !strings.Contains(a.Text, want) {
+				t.Errorf("text %q does not contain %q", a.Text, want)
+			}
+		}
+		if strings.Contains(a.Text, "line 1") {
+			t.Errorf("text %q contains more than 2 lines of output", a.Text)
+		}
+	})
+	t.Run("custom template", func(t *testing.T) {
+		srv, bodies := newCapture(t, http.StatusOK)
+		n, err := NewSlack(map[string]any{
+			"url":      srv.URL,
+			"title":    "{{.Name}}: {{.Event}}",
+			"template": "{{.Vars.tag}} in {{.Duration}}",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok := testNotification
+		ok.Event, ok.Error = deploysrv.EventRecovery, nil
+		if err := n.Notify(context.Background(), ok); err != nil {
+			t.Fatalf("Notify() error = %v", err)
+		}
+		var got slackMessage
+		decode(t, bodies, &got)
+		if got.Text != "web: recovery" || got.Attachments[0].Text != "v1.2 in 1m23.4s" || got.Attachments[0].Color != "#36c5f0" {
+			t.Errorf("message = %+v", got)
+		}
+	})
+	t.Run("escaped", func(t *testing.T) {
+		srv, bodies := newCapture(t, http.StatusOK)
+		n, err := NewSlack(map[string]any{"url": srv.URL, "template": "{{.Trigger}} {{.Vars.ref}}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		evil := testNotification
+		evil.Trigger = deploysrv.Trigger{Vars: map[string]string{"repo": "team/web", "ref": "<!channel>", "pusher": "a&b <https://evil.test|click>"}}
+		if err := n.Notify(context.Background(), evil); err != nil {
+			t.Fatalf("Notify() error = %v", err)
+		}
+		var got slackMessage
+		decode(t, bodies, &got)
+		if want := "team/web@&lt;!channel&gt; by a&amp;b &lt;https://evil.test|click&gt; &lt;!channel&gt;"; got.Attachments[0].Text != want {
+			t.Errorf("text = %q, want %q", got.Attachments[0].Text, want)
+		}
+	})
+	t.Run("server error", func(t *testing.T) {
+		srv, _ := newCapture(t, http.StatusInternalServerError)
+		n, err := NewSlack(map[string]any{"url": srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), testNotification); err == nil {
+			t.Fatal("Notify() expected error")
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package notifiers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// TypeTeams is the Microsoft Teams incoming webhook (or Workflows webhook)
+// notifier type.
+const TypeTeams = "teams"
+
+// Adaptive cards don't render the code blocks, so the output tail is added to
+// the card as a separate monospace block, and is not a part of the text.
+const defTeamsText = "{{if .Trigger}}**Trigger:** {{.Trigger}}\n\n{{end}}" +
+	"**Duration:** {{.Duration}}" +
+	"{{if .Error}}\n\n**Error:** {{.Error}}{{end}}"
+
+// teamsColors are the adaptive card text colours of the events.
+var teamsColors = map[string]string{
+	deploysrv.EventStarted:  "Default",
+	deploysrv.EventSuccess:  "Good",
+	deploysrv.EventFailure:  "Attention",
+	deploysrv.EventRecovery: "Accent",
+}
+
+// Teams posts the notifications as adaptive cards to the Teams webhook.
+type Teams struct {
+	cfg chat
+	tt  templates
+}
+
+// teamsMessage is the webhook message with the adaptive card attachment, see
+// https://learn.microsoft.com/en-us/microsoftteams/platform/webhooks-and-connectors/how-to/connectors-using
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string        `json:"$schema"`
+	Type    string        `json:"type"`
+	Version string        `json:"version"`
+	Body    []teamsBlock  `json:"body"`
+	Actions []teamsAction `json:"actions,omitempty"`
+}
+
+type teamsBlock struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Wrap     bool   `json:"wrap"`
+	Size     string `json:"size,omitempty"`
+	Weight   string `json:"weight,omitempty"`
+	Color    string `json:"color,omitempty"`
+	FontType string `json:"fontType,omitempty"`
+}
+
+type teamsAction struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// NewTeams creates the Teams notifier from the destination payload.
+func NewTeams(payload any) (deploysrv.Notifier, error) {
+	cfg, tt, err := parseChat(payload, defTeamsText)
+	if err != nil {
+		return nil, fmt.Errorf("teams: %w", err)
+	}
+	return &Teams{cfg: cfg, tt: tt}, nil
+}
+
+func (t *Teams) Notify(ctx context.Context, n deploysrv.Notification) error {
+	m := newMessage(n, t.cfg.TailLines)
+	title, text, err := t.tt.render(m)
+	if err != nil {
+		return fmt.Errorf("teams: %w", err)
+	}
+	card := teamsCard{
+		Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+		Type:    "AdaptiveCard",
+		Version: "1.4",
+		Body: []teamsBlock{
+			{Type: "TextBlock", Text: title, Wrap: true, Size: "Medium", Weight: "Bolder", Color: teamsColors[n.Event]},
+			{Type: "TextBlock", Text: text, Wrap: true},
+		},
+	}
+	if m.Tail != "" {
+		card.Body = append(card.Body, teamsBlock{Type: "TextBlock", Text: m.Tail, Wrap: true, FontType: "Monospace"})
+	}
+	if m.ResultsURL != "" {
+		card.Actions = []teamsAction{{Type: "Action.OpenUrl", Title: "Results", URL: m.ResultsURL}}
+	}
+	msg := teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content:     card,
+		}},
+	}
+	if err := shared.PostJSON(ctx, t.cfg.URL, msg, nil); err != nil {
+		return fmt.Errorf("teams: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package notifiers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTeams_Notify(t *testing.T) {
+	srv, bodies := newCapture(t, http.StatusAccepted)
+	n, err := NewTeams(map[string]any{"url": srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), testNotification); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	var got teamsMessage
+	decode(t, bodies, &got)
+	if got.Type != "message" || len(got.Attachments) != 1 || got.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" {
+		t.Fatalf("message = %+v", got)
+	}
+	card := got.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || len(card.Body) != 3 {
+		t.Fatalf("card = %+v", card)
+	}
+	if b := card.Body[0]; b.Text != "web deployment failed" || b.Color != "Attention" {
+		t.Errorf("title block = %+v", b)
+	}
+	for _, want := range []string{"**Trigger:** team/web:v1.2 by dev", "**Duration:** 1m23.4s", "**Error:** exit status 1"} {
+		if !strings.Contains(card.Body[1].Text, want) {
+			t.Errorf("text %q does not contain %q", card.Body[1].Text, want)
+		}
+	}
+	if b := card.Body[2]; b.FontType != "Monospace" || !strings.HasSuffix(b.Text, "boom") {
+		t.Errorf("output block = %+v", b)
+	}
+	if len(card.Actions) != 1 || card.Actions[0].URL != testNotification.ResultsURL {
+		t.Errorf("actions = %+v", card.Actions)
+	}
+}
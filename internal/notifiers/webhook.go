@@ -0,0 +1,166 @@
+package notifiers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+	"github.com/rusq/hubdeploy/internal/shared"
+)
+
+// TypeWebhook is the outgoing JSON webhook notifier type.
+const TypeWebhook = "webhook"
+
+// Webhook events.
+const (
+	EventJobStarted   = "job.started"
+	EventJobSucceeded = "job.succeeded"
+	EventJobFailed    = "job.failed"
+)
+
+// Webhook request headers.
+const (
+	hdrEvent     = "X-Hubdeploy-Event"
+	hdrDelivery  = "X-Hubdeploy-Delivery"
+	hdrSignature = "X-Hubdeploy-Signature"
+)
+
+// webhookEvents maps the notification events to the webhook events.
+var webhookEvents = map[string]string{
+	deploysrv.EventStarted:  EventJobStarted,
+	deploysrv.EventSuccess:  EventJobSucceeded,
+	deploysrv.EventRecovery: EventJobSucceeded,
+	deploysrv.EventFailure:  EventJobFailed,
+}
+
+// webhook is the outgoing webhook notifier configuration.
+type webhook struct {
+	// URL is the URL to post the events to.
+	URL string `yaml:"url"`
+	// Secret is the HMAC-SHA256 key to sign the payload with.
+	Secret string `yaml:"secret"`
+	// Headers are the additional request headers, i.e. Authorization.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// TailLines is the number of the last output lines to include in the
+	// payload, defaults to 10, negative value disables the output.
+	TailLines int `yaml:"tail_lines,omitempty"`
+}
+
+// Webhook posts the signed JSON events to the URL.  The signature of the
+// request body is sent in the X-Hubdeploy-Signature header as
+// "sha256=<hex>".  The X-Hubdeploy-Delivery header carries the delivery ID,
+// that stays the same, when the delivery is retried, so that the receiver
+// can drop the duplicates.
+type Webhook struct {
+	cfg webhook
+	hdr http.Header
+}
+
+// webhookPayload is the webhook request body.
+type webhookPayload struct {
+	Delivery string     `json:"delivery"`
+	Event    string     `json:"event"`
+	Job      webhookJob `json:"job"`
+}
+
+type webhookJob struct {
+	ID         string            `json:"id"`
+	Deployment string            `json:"deployment"`
+	Status     string            `json:"status"`
+	Source     string            `json:"source,omitempty"`
+	Vars       map[string]string `json:"vars,omitempty"`
+	Duration   float64           `json:"duration_seconds"`
+	Error      string            `json:"error,omitempty"`
+	OutputTail string            `json:"output_tail,omitempty"`
+	ResultsURL string            `json:"results_url,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// NewWebhook creates the webhook notifier from the destination payload.
+func NewWebhook(payload any) (deploysrv.Notifier, error) {
+	var cfg webhook
+	if err := shared.UnmarshalPayload(payload, &cfg); err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	w, err := newWebhook(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	return w, nil
+}
+
+func newWebhook(cfg webhook) (*Webhook, error) {
+	if u, err := url.Parse(cfg.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid webhook url: %q", cfg.URL)
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("secret is not set")
+	}
+	if cfg.TailLines == 0 {
+		cfg.TailLines = defTailLines
+	}
+	hdr := make(http.Header, len(cfg.Headers))
+	for k, v := range cfg.Headers {
+		hdr.Set(k, v)
+	}
+	return &Webhook{cfg: cfg, hdr: hdr}, nil
+}
+
+// deliveryID returns the delivery ID of the notification, it is derived from
+// the job ID and the event, so it's stable between the attempts.
+func deliveryID(n deploysrv.Notification) uuid.UUID {
+	return uuid.NewSHA1(n.ID, []byte(n.Event))
+}
+
+func (w *Webhook) Notify(ctx context.Context, n deploysrv.Notification) error {
+	ev, ok := webhookEvents[n.Event]
+	if !ok {
+		return fmt.Errorf("webhook: unsupported event: %q", n.Event)
+	}
+	m := newMessage(n, w.cfg.TailLines)
+	p := webhookPayload{
+		Delivery: deliveryID(n).String(),
+		Event:    ev,
+		Job: webhookJob{
+			ID:         m.ID,
+			Deployment: m.Name,
+			Status:     m.Status,
+			Source:     m.Source,
+			Vars:       m.Vars,
+			Duration:   n.Duration.Seconds(),
+			Error:      m.Error,
+			OutputTail: m.Tail,
+			ResultsURL: m.ResultsURL,
+			Time:       m.Time,
+		},
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	hdr := w.hdr.Clone()
+	hdr.Set(hdrEvent, ev)
+	hdr.Set(hdrDelivery, p.Delivery)
+	hdr.Set(hdrSignature, "sha256="+sign(w.cfg.Secret, body))
+	if err := shared.Post(ctx, w.cfg.URL, body, hdr); err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,138 @@
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rusq/hubdeploy/internal/deploysrv"
+)
+
+// webhookRequest is the request received by the webhook stand-in.
+type webhookRequest struct {
+	hdr  http.Header
+	body []byte
+}
+
+func newWebhookReceiver(t *testing.T, code int) (*httptest.Server, <-chan webhookRequest) {
+	t.Helper()
+	reqs := make(chan webhookRequest, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs <- webhookRequest{hdr: r.Header, body: body}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func TestNewWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload map[string]any
+		wantErr bool
+	}{
+		{"valid", map[string]any{"url": "https://cmdb.test/hooks", "secret": "s3cr3t"}, false},
+		{"no secret", map[string]any{"url": "https://cmdb.test/hooks"}, true},
+		{"bad url", map[string]any{"url": "cmdb.test/hooks", "secret": "s3cr3t"}, true},
+		{"unknown field", map[string]any{"url": "https://cmdb.test/hooks", "secret": "s3cr3t", "events": "all"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewWebhook(tt.payload); (err != nil) != tt.wantErr {
+				t.Errorf("NewWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhook_Notify(t *testing.T) {
+	srv, reqs := newWebhookReceiver(t, http.StatusAccepted)
+	n, err := NewWebhook(map[string]any{
+		"url":        srv.URL,
+		"secret":     "s3cr3t",
+		"headers":    map[string]string{"authorization": "Bearer cmdb-token"},
+		"tail_lines": 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := testNotification
+	started.Event, started.Error, started.Output, started.Duration = deploysrv.EventStarted, nil, nil, 0
+	recovered := testNotification
+	recovered.Event, recovered.Error = deploysrv.EventRecovery, nil
+
+	tests := []struct {
+		name       string
+		n          deploysrv.Notification
+		wantEvent  string
+		wantStatus string
+	}{
+		{"started", started, EventJobStarted, "started"},
+		{"failed", testNotification, EventJobFailed, "failed"},
+		{"recovered", recovered, EventJobSucceeded, "recovered"},
+	}
+	deliveries := make(map[string]bool)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := n.Notify(context.Background(), tt.n); err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+			req := <-reqs
+			if got := req.hdr.Get(hdrSignature); got != "sha256="+sign("s3cr3t", req.body) {
+				t.Errorf("signature = %q", got)
+			}
+			if got := req.hdr.Get("Authorization"); got != "Bearer cmdb-token" {
+				t.Errorf("Authorization = %q", got)
+			}
+			var p webhookPayload
+			if err := json.Unmarshal(req.body, &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Event != tt.wantEvent || req.hdr.Get(hdrEvent) != tt.wantEvent {
+				t.Errorf("event = %q, header = %q, want %q", p.Event, req.hdr.Get(hdrEvent), tt.wantEvent)
+			}
+			if p.Delivery == "" || req.hdr.Get(hdrDelivery) != p.Delivery || deliveries[p.Delivery] {
+				t.Errorf("delivery = %q, header = %q", p.Delivery, req.hdr.Get(hdrDelivery))
+			}
+			deliveries[p.Delivery] = true
+			if p.Job.Status != tt.wantStatus || p.Job.ID != tt.n.ID.String() || p.Job.Deployment != "web" || p.Job.Vars["tag"] != "v1.2" {
+				t.Errorf("job = %+v", p.Job)
+			}
+		})
+	}
+
+	t.Run("retry keeps delivery and signature", func(t *testing.T) {
+		for range 2 {
+			if err := n.Notify(context.Background(), testNotification); err != nil {
+				t.Fatal(err)
+			}
+		}
+		first, second := <-reqs, <-reqs
+		if first.hdr.Get(hdrDelivery) != second.hdr.Get(hdrDelivery) || first.hdr.Get(hdrSignature) != second.hdr.Get(hdrSignature) {
+			t.Errorf("retried delivery differs: %v vs %v", first.hdr, second.hdr)
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(first.body, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Job.Error != "exit status 1" || p.Job.OutputTail != "boom" || p.Job.Duration != 83.42 {
+			t.Errorf("job = %+v", p.Job)
+		}
+	})
+}
+
+func TestWebhook_Notify_error(t *testing.T) {
+	srv, _ := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	n, err := NewWebhook(map[string]any{"url": srv.URL, "secret": "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), testNotification); err == nil {
+		t.Fatal("Notify() expected error")
+	}
+}
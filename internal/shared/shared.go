@@ -0,0 +1,112 @@
+// Package shared contains the helpers, that are shared by the hookers, the
+// notifiers and the server.
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// UnmarshalPayload converts the deployment or destination payload to the
+// specific configuration in v.  Unknown fields are rejected.
+func UnmarshalPayload(payload, v any) error {
+	encoded, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalWithOptions(encoded, v, yaml.DisallowUnknownField())
+}
+
+// Truncate truncates s to n runes.
+func Truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// PostJSON posts v as JSON to the url with the additional headers, and
+// expects the 2xx status code.
+func PostJSON(ctx context.Context, u string, v any, hdr http.Header) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return Post(ctx, u, body, hdr)
+}
+
+// Post posts the JSON body with the additional headers to the url, and
+// expects the 2xx status code.
+func Post(ctx context.Context, u string, body []byte, hdr http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vv := range hdr {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// StatusError is returned by [Post], if the server responds with the non-2xx
+// status code.
+type StatusError struct {
+	// Code is the HTTP status code.
+	Code int
+	// Status is the HTTP status line, i.e. "404 Not Found".
+	Status string
+	// Body is the beginning of the response body.
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s: %s", e.Status, e.Body)
+}
+
+// Temporary reports whether the request may succeed, if retried later, that
+// is the server error, the request timeout, or the rate limit.  Other client
+// errors will fail the same way.
+func (e *StatusError) Temporary() bool {
+	switch {
+	case e.Code == http.StatusRequestTimeout, e.Code == http.StatusTooManyRequests:
+		return true
+	case 400 <= e.Code && e.Code < 500:
+		return false
+	}
+	return true
+}
+
+// LoadCertPool loads the PEM encoded certificates from the file.
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,123 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnmarshalPayload(t *testing.T) {
+	type cfg struct {
+		URL string `yaml:"url"`
+	}
+	tests := []struct {
+		name    string
+		payload any
+		want    string
+		wantErr bool
+	}{
+		{"valid", map[string]any{"url": "https://example.test"}, "https://example.test", false},
+		{"unknown field", map[string]any{"url": "x", "foo": "bar"}, "", true},
+		{"empty", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got cfg
+			err := UnmarshalPayload(tt.payload, &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.URL != tt.want {
+				t.Errorf("URL = %q, want %q", got.URL, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{"short", "abc", 5, "abc"},
+		{"exact", "abcde", 5, "abcde"},
+		{"long", "abcdef", 5, "abcd…"},
+		{"runes", "ааааа", 3, "аа…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Truncate(tt.s, tt.n); got != tt.want {
+				t.Errorf("Truncate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		wantErr bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"created", http.StatusCreated, false},
+		{"bad request", http.StatusBadRequest, true},
+		{"server error", http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotType, gotAuth, gotBody string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotType, gotAuth = r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+				b := make([]byte, 64)
+				n, _ := r.Body.Read(b)
+				gotBody = string(b[:n])
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			err := PostJSON(context.Background(), srv.URL, map[string]string{"a": "b"}, http.Header{"Authorization": {"token x"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PostJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotType != "application/json" || gotAuth != "token x" || gotBody != `{"a":"b"}` {
+				t.Errorf("request: content-type=%q authorization=%q body=%q", gotType, gotAuth, gotBody)
+			}
+		})
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(dir, "missing.pem"), invalid} {
+		if _, err := LoadCertPool(name); err == nil {
+			t.Errorf("LoadCertPool(%q) error = nil, want error", name)
+		}
+	}
+}
+
+func TestStatusError_Temporary(t *testing.T) {
+	for code, want := range map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        false,
+		http.StatusNotFound:            false,
+		http.StatusUnprocessableEntity: false,
+		http.StatusRequestTimeout:      true,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+	} {
+		if got := (&StatusError{Code: code}).Temporary(); got != want {
+			t.Errorf("Temporary() for %d = %v, want %v", code, got, want)
+		}
+	}
+}
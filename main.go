@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/rusq/dlog"
 	"github.com/rusq/gotsr"
@@ -12,15 +16,18 @@ import (
 
 	"github.com/rusq/hubdeploy/internal/deploysrv"
 	"github.com/rusq/hubdeploy/internal/hookers"
+	"github.com/rusq/hubdeploy/internal/notifiers"
 )
 
+// Listener settings have no flag defaults, so that the precedence is flag
+// over env over config file over defaults, see [deploysrv.Config.ApplyOverrides].
 var (
-	port    = flag.String("p", osenv.Value("PORT", "9999"), "http server `port`")
-	host    = flag.String("host", osenv.Value("HOST", "127.0.0.1"), "`host or ip` to bind to")
-	prefix  = flag.String("prefix", osenv.Value("PREFIX", "/"), "api path prefix")
+	port    = flag.String("p", "", "http server `port` (default "+deploysrv.DefaultPort+")")
+	host    = flag.String("host", "", "`host or ip` to bind to (default "+deploysrv.DefaultHost+")")
+	prefix  = flag.String("prefix", "", "api path prefix (default "+deploysrv.DefaultPrefix+")")
 	cert    = flag.String("cert", "", "certificate path")
 	key     = flag.String("key", "", "certificate key")
-	config  = flag.String("c", osenv.Value("CONFIG_YAML", "hubdeploy.yml"), "config `file`")
+	config  = flag.String("c", osenv.Value("CONFIG_YAML", "hubdeploy.yml"), "config `file` or directory")
 	verbose = flag.Bool("v", false, "verbose output")
 	log     = flag.String("l", "", "log `file` or device")
 	stop    = flag.Bool("stop", false, "stops the process")
@@ -28,14 +35,14 @@ var (
 
 func main() {
 	flag.Parse()
-	if *port == "" {
-		flag.Usage()
-		dlog.Fatal("invalid port")
-	}
 	if *config == "" {
 		flag.Usage()
 		dlog.Fatal("no config file")
 	}
+	if (*cert == "") != (*key == "") {
+		flag.Usage()
+		dlog.Fatal("-cert and -key must be set together")
+	}
 	p, err := gotsr.New()
 	if err != nil {
 		dlog.Fatal(err)
@@ -51,6 +58,16 @@ func main() {
 		dlog.Println("stopped")
 		return
 	}
+	if flag.NArg() > 0 {
+		cfg, err := loadConfig(*config)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		if err := command(cfg, flag.Args()); err != nil {
+			dlog.Fatal(err)
+		}
+		return
+	}
 	if running, err := p.IsRunning(); err != nil {
 		dlog.Fatal(err)
 	} else if running {
@@ -62,28 +79,58 @@ func main() {
 		dlog.Fatal(err)
 	}
 
-	addr := *host + ":" + *port
 	if !headless {
 		dlog.Println("starting up...")
-		dlog.Println("listening on", addr)
 		return
 	} else {
 		dlog.SetDebug(*verbose)
-		cfg, err := deploysrv.LoadConfig(*config)
+		cfg, err := loadConfig(*config)
 		if err != nil {
 			dlog.Fatal(err)
 		}
-		if err := deploysrv.Register(new(hookers.DockerHub)); err != nil {
-			dlog.Fatal(err)
+		for _, h := range []deploysrv.Hooker{
+			new(hookers.DockerHub),
+			new(hookers.GitHub),
+			new(hookers.GitLab),
+			new(hookers.Gitea),
+			new(hookers.Registry),
+			new(hookers.Quay),
+			new(hookers.Generic),
+			new(hookers.Poll),
+		} {
+			if err := deploysrv.Register(h); err != nil {
+				dlog.Fatal(err)
+			}
 		}
-		srv, err := deploysrv.New(cfg, deploysrv.OptWithCert(*cert, *key), deploysrv.OptWithPrefix(*prefix))
+		for typ, f := range map[string]deploysrv.NotifierFactory{
+			notifiers.TypeSlack:   notifiers.NewSlack,
+			notifiers.TypeDiscord: notifiers.NewDiscord,
+			notifiers.TypeTeams:   notifiers.NewTeams,
+			notifiers.TypeEmail:   notifiers.NewEmail,
+			notifiers.TypeWebhook: notifiers.NewWebhook,
+		} {
+			if err := deploysrv.RegisterNotifier(typ, f); err != nil {
+				dlog.Fatal(err)
+			}
+		}
+		srv, err := deploysrv.New(cfg)
 		if err != nil {
 			dlog.Fatal(err)
 		}
-		if err := initlog(*log); err != nil {
+		if err := initlog(cfg.Listen.Log, cfg.RedactWriter); err != nil {
 			dlog.Fatal(err)
 		}
 
+		// the pending callbacks are left in the state directory on
+		// shutdown, and resumed on the next start.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+
+		addr := cfg.Listen.Addr()
 		dlog.Println("listening on", addr)
 		if err := srv.ListenAndServe(addr); err != nil {
 			dlog.Fatal(err)
@@ -91,9 +138,51 @@ func main() {
 	}
 }
 
-func initlog(filename string) error {
+// loadConfig loads the config and applies the environment and command line
+// overrides.
+func loadConfig(filename string) (deploysrv.Config, error) {
+	cfg, err := deploysrv.LoadConfig(filename)
+	if err != nil {
+		return deploysrv.Config{}, err
+	}
+	env := deploysrv.Overrides{
+		Listen: deploysrv.Listen{
+			Host:   osenv.Value("HOST", ""),
+			Port:   osenv.Value("PORT", ""),
+			Prefix: osenv.Value("PREFIX", ""),
+			Log:    osenv.Value("LOG", ""),
+		},
+	}
+	flags := deploysrv.Overrides{
+		Listen: deploysrv.Listen{
+			Host:   *host,
+			Port:   *port,
+			Prefix: *prefix,
+			Log:    *log,
+		},
+		Cert: *cert,
+		Key:  *key,
+	}
+	cfg.ApplyOverrides(env, flags)
+	return cfg, nil
+}
+
+// command runs the command given in the args.
+func command(cfg deploysrv.Config, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "config" && args[1] == "print":
+		return cfg.Print(os.Stdout)
+	default:
+		flag.Usage()
+		return errors.New("unknown command")
+	}
+}
+
+// initlog initialises the log output, wrap allows to wrap the output writer,
+// i.e. to redact secrets.
+func initlog(filename string, wrap func(io.Writer) io.Writer) error {
 	if filename == "-" {
-		dlog.SetOutput(os.Stderr)
+		dlog.SetOutput(wrap(os.Stderr))
 		return nil
 	} else if filename == "" {
 		exe, err := os.Executable()
@@ -109,6 +198,6 @@ func initlog(filename string) error {
 	if err != nil {
 		return err
 	}
-	dlog.SetOutput(f)
+	dlog.SetOutput(wrap(f))
 	return nil
 }